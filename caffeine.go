@@ -1,10 +1,15 @@
 package main
 
 import (
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/namsral/flag"
 
 	"github.com/rehacktive/caffeine/database"
@@ -26,6 +31,18 @@ const (
 	PG     = "postgres"
 	FS     = "fs"
 	SQLITE = "sqlite"
+	BOLT   = "bolt"
+	REDIS  = "redis"
+	S3     = "s3"
+
+	// event buses
+	busNone  = "none"
+	busRedis = "redis"
+	busPg    = "postgres"
+
+	// event sinks
+	sinkNone = "none"
+	sinkNats = "nats"
 
 	// env
 	envHostPort    = "IP_PORT"
@@ -35,44 +52,204 @@ const (
 	envPgPass      = "PG_PASS"
 	envDbPath      = "DB_PATH"
 	envAuthEnabled = "AUTH_ENABLED"
+
+	envMemSnapshotDir      = "MEM_SNAPSHOT_DIR"
+	envMemSnapshotInterval = "MEM_SNAPSHOT_INTERVAL"
+	envMemFsync            = "MEM_FSYNC"
+	envFsSharded           = "FS_SHARDED"
+	envSQLiteJournalMode   = "SQLITE_JOURNAL_MODE"
+	envSQLiteBusyTimeout   = "SQLITE_BUSY_TIMEOUT"
+	envSQLiteSynchronous   = "SQLITE_SYNCHRONOUS"
+	envSQLiteMaxOpenConns  = "SQLITE_MAX_OPEN_CONNS"
+	envSQLiteWriteBatch    = "SQLITE_WRITE_BATCH"
+	envBoltNoSync          = "BOLT_NO_SYNC"
+	envRedisAddr           = "REDIS_ADDR"
+	envRedisPass           = "REDIS_PASS"
+	envRedisDb             = "REDIS_DB"
+	envRedisPrefix         = "REDIS_PREFIX"
+	envEventBus            = "EVENT_BUS"
+	envCacheMaxEntries     = "CACHE_MAX_ENTRIES"
+	envCacheMaxBytes       = "CACHE_MAX_BYTES"
+	envCacheTTL            = "CACHE_TTL"
+	envS3Endpoint          = "S3_ENDPOINT"
+	envS3AccessKey         = "S3_ACCESS_KEY"
+	envS3SecretKey         = "S3_SECRET_KEY"
+	envS3Bucket            = "S3_BUCKET"
+	envS3Region            = "S3_REGION"
+	envS3Secure            = "S3_SECURE"
+	envS3Prefix            = "S3_PREFIX"
+	envReplicaOf           = "REPLICA_OF"
+	envReplicaOffsetFile   = "REPLICA_OFFSET_FILE"
+	envReplicaToken        = "REPLICA_TOKEN"
+	envReplicationLogSize  = "REPLICATION_LOG_SIZE"
+	envChangesFeed         = "CHANGES_FEED"
+	envChangesRetention    = "CHANGES_RETENTION"
+	envChangesMax          = "CHANGES_MAX"
+	envWebhooks            = "WEBHOOKS"
+	envWebhookMaxAttempts  = "WEBHOOK_MAX_ATTEMPTS"
+	envWebhookBackoff      = "WEBHOOK_BACKOFF"
+	envWebhookMaxBackoff   = "WEBHOOK_MAX_BACKOFF"
+	envWebhookTimeout      = "WEBHOOK_TIMEOUT"
+	envWebhookAllowPrivate = "WEBHOOK_ALLOW_PRIVATE"
+	envEventSink           = "EVENT_SINK"
+	envEventSinkSubject    = "EVENT_SINK_SUBJECT"
+	envOutboxRetry         = "OUTBOX_RETRY"
+	envNatsURL             = "NATS_URL"
+	envHookTimeout         = "HOOK_TIMEOUT"
+	envUnwrapLegacy        = "UNWRAP_LEGACY"
+
+	envPgPort            = "PG_PORT"
+	envPgDb              = "PG_DB"
+	envPgSSLMode         = "PG_SSLMODE"
+	envPgSSLRootCert     = "PG_SSLROOTCERT"
+	envPgSSLCert         = "PG_SSLCERT"
+	envPgSSLKey          = "PG_SSLKEY"
+	envPgConnectTimeout  = "PG_CONNECT_TIMEOUT"
+	envPgMaxOpenConns    = "PG_MAX_OPEN_CONNS"
+	envPgMaxIdleConns    = "PG_MAX_IDLE_CONNS"
+	envPgConnMaxLifetime = "PG_CONN_MAX_LIFETIME"
+	envPgConnMaxIdleTime = "PG_CONN_MAX_IDLE_TIME"
+	envPgGinIndex        = "PG_GIN_INDEX"
+
+	// commands
+	cmdMigrate = "migrate"
 )
 
+type dbConfig struct {
+	dbType string
+	dbPath string
+
+	pgHost            string
+	pgPort            int
+	pgUser            string
+	pgPass            string
+	pgDb              string
+	pgSSLMode         string
+	pgSSLRootCert     string
+	pgSSLCert         string
+	pgSSLKey          string
+	pgConnectTimeout  time.Duration
+	pgMaxOpenConns    int
+	pgMaxIdleConns    int
+	pgConnMaxLifetime time.Duration
+	pgConnMaxIdleTime time.Duration
+	pgGinIndex        bool
+
+	memSnapshotDir      string
+	memSnapshotInterval time.Duration
+	memFsync            string
+	fsSharded           bool
+
+	sqliteJournalMode  string
+	sqliteBusyTimeout  time.Duration
+	sqliteSynchronous  string
+	sqliteMaxOpenConns int
+	sqliteWriteBatch   int
+
+	boltNoSync bool
+
+	redisAddr   string
+	redisPass   string
+	redisDb     int
+	redisPrefix string
+
+	s3Endpoint  string
+	s3AccessKey string
+	s3SecretKey string
+	s3Bucket    string
+	s3Region    string
+	s3Secure    bool
+	s3Prefix    string
+}
+
 func main() {
-	var addr, dbType, pgHost, pgUser, pgPass, dbPath string
-	var authEnabled bool
+	if len(os.Args) > 1 && os.Args[1] == cmdMigrate {
+		migrate(os.Args[2:])
+		return
+	}
+
+	var addr string
+	var config dbConfig
+	var authEnabled, unwrapLegacy bool
+	var eventBus string
+	var cache service.CacheOptions
+	var replicaOf, replicaOffsetFile, replicaToken string
+	var replicationLogSize int
+	var changesFeed bool
+	var feed service.ChangeFeed
+	var webhooksEnabled bool
+	var webhookTimeout time.Duration
+	var webhooks service.WebhookDispatcher
+	var eventSink, natsURL string
+	var outbox service.Outbox
+	var hookTimeout time.Duration
 	flag.StringVar(&addr, envHostPort, ":8000", "ip:port to expose")
-	flag.StringVar(&dbType, envDbType, MEMORY, "db type to use, options: memory | postgres | fs")
-	flag.StringVar(&pgHost, envPgHost, "0.0.0.0", "postgres host (port is 5432)")
-	flag.StringVar(&pgUser, envPgUser, "", "postgres user")
-	flag.StringVar(&pgPass, envPgPass, "", "postgres password")
-	flag.StringVar(&dbPath, envDbPath, "./data", "path of the file storage root or sqlite")
 	flag.BoolVar(&authEnabled, envAuthEnabled, false, "enable JWT auth")
+	flag.BoolVar(&unwrapLegacy, envUnwrapLegacy, false, "unwrap, once, the documents stored wrapped with their user by the versions before the metadata")
+	flag.StringVar(&eventBus, envEventBus, busNone, "bus sharing the realtime events between instances, options: none | redis | postgres")
+	flag.IntVar(&cache.MaxEntries, envCacheMaxEntries, 0, "max number of reads cached in front of the database (0 disables the cache)")
+	flag.Int64Var(&cache.MaxBytes, envCacheMaxBytes, 0, "max total size in bytes of the cached reads (0 is unlimited)")
+	flag.DurationVar(&cache.TTL, envCacheTTL, time.Minute, "expiration of the cached reads (0 never expires)")
+	flag.StringVar(&replicaOf, envReplicaOf, "", "url of the leader to replicate, e.g. http://leader:8000, making this instance a read-only follower")
+	flag.StringVar(&replicaOffsetFile, envReplicaOffsetFile, "./replica.offset", "file where a follower saves its replication offset")
+	flag.StringVar(&replicaToken, envReplicaToken, "", "JWT sent by a follower to a leader with auth enabled")
+	flag.IntVar(&replicationLogSize, envReplicationLogSize, service.DefaultReplicationLogSize, "number of changes kept for the followers to catch up, before they need a new snapshot")
+	flag.BoolVar(&changesFeed, envChangesFeed, false, "record every change for the clients polling /changes, not available with an event bus")
+	flag.DurationVar(&feed.Retention, envChangesRetention, 7*24*time.Hour, "how long the changes are kept (0 forever)")
+	flag.IntVar(&feed.MaxChanges, envChangesMax, 100000, "max number of changes kept (0 is unlimited)")
+	flag.BoolVar(&webhooksEnabled, envWebhooks, false, "deliver the events to the webhooks registered on /webhooks")
+	flag.IntVar(&webhooks.MaxAttempts, envWebhookMaxAttempts, 5, "attempts of a webhook delivery before moving it to the dead letters")
+	flag.DurationVar(&webhooks.InitialBackoff, envWebhookBackoff, time.Second, "wait before the first retry of a webhook delivery, doubled at every attempt")
+	flag.DurationVar(&webhooks.MaxBackoff, envWebhookMaxBackoff, 5*time.Minute, "max wait between the retries of a webhook delivery")
+	flag.DurationVar(&webhookTimeout, envWebhookTimeout, 10*time.Second, "timeout of a webhook delivery")
+	flag.BoolVar(&webhooks.AllowPrivate, envWebhookAllowPrivate, false, "allow the webhooks on loopback, link-local and private addresses")
+	flag.StringVar(&eventSink, envEventSink, sinkNone, "message bus every event is published to, options: none | nats")
+	flag.StringVar(&outbox.Subject, envEventSinkSubject, service.DefaultSinkSubject, "subject of the published events, {namespace} and {event} are replaced")
+	flag.DurationVar(&outbox.RetryInterval, envOutboxRetry, 5*time.Second, "wait before publishing again the events when the message bus is down")
+	flag.StringVar(&natsURL, envNatsURL, "nats://localhost:4222", "NATS server url")
+	flag.DurationVar(&hookTimeout, envHookTimeout, service.DefaultHookTimeout, "max execution time of a namespace hook")
+	config.registerFlags(flag.CommandLine)
 	flag.Parse()
 
 	server := service.Server{
-		Address:     addr,
-		AuthEnabled: authEnabled,
+		Address:            addr,
+		AuthEnabled:        authEnabled,
+		UnwrapLegacy:       unwrapLegacy,
+		Bus:                newEventBus(eventBus, config),
+		ReplicationLogSize: replicationLogSize,
+		HookTimeout:        hookTimeout,
 	}
-
-	var db service.Database
-	switch dbType {
-	case MEMORY:
-		db = &database.MemDatabase{}
-	case PG:
-		db = &database.PGDatabase{
-			Host: pgHost,
-			User: pgUser,
-			Pass: pgPass,
+	if changesFeed {
+		// the sequence numbers are assigned by each instance
+		if eventBus != busNone {
+			log.Fatalf("the change feed can't be enabled with an event bus, instances sharing the storage would overwrite each other's changes")
 		}
-	case FS:
-		db = &database.StorageDatabase{
-			RootDirPath: dbPath,
-		}
-	case SQLITE:
-		db = &database.SQLiteDatabase{
-			DirPath: dbPath,
+		server.Feed = &feed
+	}
+	if webhooksEnabled {
+		webhooks.Client = &http.Client{Timeout: webhookTimeout}
+		server.Webhooks = &webhooks
+	}
+	switch eventSink {
+	case sinkNone:
+	case sinkNats:
+		outbox.Sink = &service.NatsSink{URL: natsURL}
+		server.Outbox = &outbox
+	default:
+		log.Fatalf("unknown event sink '%v'", eventSink)
+	}
+	if replicaOf != "" {
+		server.Replica = &service.Replica{
+			LeaderURL:  replicaOf,
+			OffsetPath: replicaOffsetFile,
+			Token:      replicaToken,
 		}
 	}
+
+	db := newDatabase(config)
+	if cache.MaxEntries > 0 {
+		db = service.NewCachedDatabase(db, cache)
+	}
 	go server.Init(db)
 
 	log.Println(projectName, " version: ", projectVersion)
@@ -83,5 +260,219 @@ func main() {
 
 	<-stop
 
+	if closer, ok := outbox.Sink.(io.Closer); ok {
+		closer.Close()
+	}
+	closeDatabase(db)
 	log.Println("bye")
 }
+
+// closeDatabase flushes and releases the databases holding files or connections
+func closeDatabase(db service.Database) {
+	if closer, ok := db.(io.Closer); ok {
+		err := closer.Close()
+		if err != nil {
+			log.Println("error on closing the database: ", err)
+		}
+	}
+}
+
+func (c *dbConfig) registerFlags(flags *flag.FlagSet) {
+	flags.StringVar(&c.dbType, envDbType, MEMORY, "db type to use, options: memory | postgres | fs | sqlite | bolt | redis | s3")
+	flags.StringVar(&c.dbPath, envDbPath, "./data", "path of the file storage root, sqlite or bolt database")
+	flags.StringVar(&c.pgHost, envPgHost, "0.0.0.0", "postgres host")
+	flags.IntVar(&c.pgPort, envPgPort, 5432, "postgres port")
+	flags.StringVar(&c.pgUser, envPgUser, "", "postgres user")
+	flags.StringVar(&c.pgPass, envPgPass, "", "postgres password")
+	flags.StringVar(&c.pgDb, envPgDb, "", "postgres database name, created if missing (default is the user name)")
+	flags.StringVar(&c.pgSSLMode, envPgSSLMode, "disable", "postgres sslmode, options: disable | require | verify-ca | verify-full")
+	flags.StringVar(&c.pgSSLRootCert, envPgSSLRootCert, "", "postgres root certificate file")
+	flags.StringVar(&c.pgSSLCert, envPgSSLCert, "", "postgres client certificate file")
+	flags.StringVar(&c.pgSSLKey, envPgSSLKey, "", "postgres client key file")
+	flags.DurationVar(&c.pgConnectTimeout, envPgConnectTimeout, 0, "postgres connection timeout (0 waits indefinitely)")
+	flags.IntVar(&c.pgMaxOpenConns, envPgMaxOpenConns, 0, "postgres max open connections (0 is unlimited)")
+	flags.IntVar(&c.pgMaxIdleConns, envPgMaxIdleConns, 2, "postgres max idle connections")
+	flags.DurationVar(&c.pgConnMaxLifetime, envPgConnMaxLifetime, 0, "postgres max connection lifetime (0 is unlimited)")
+	flags.DurationVar(&c.pgConnMaxIdleTime, envPgConnMaxIdleTime, 0, "postgres max connection idle time (0 is unlimited)")
+	flags.BoolVar(&c.pgGinIndex, envPgGinIndex, false, "add a GIN index on the data of every postgres namespace")
+	flags.StringVar(&c.memSnapshotDir, envMemSnapshotDir, "", "if set, the memory db is persisted to this directory")
+	flags.DurationVar(&c.memSnapshotInterval, envMemSnapshotInterval, 5*time.Minute, "interval between snapshots of the memory db")
+	flags.StringVar(&c.memFsync, envMemFsync, database.FsyncInterval, "fsync policy of the memory db write log, options: always | interval | never")
+	flags.BoolVar(&c.fsSharded, envFsSharded, false, "spread the documents of fs namespaces over hashed subdirectories")
+	flags.StringVar(&c.sqliteJournalMode, envSQLiteJournalMode, "WAL", "sqlite journal mode, options: WAL | DELETE | TRUNCATE | PERSIST | MEMORY | OFF")
+	flags.DurationVar(&c.sqliteBusyTimeout, envSQLiteBusyTimeout, 5*time.Second, "how long sqlite waits for a lock before failing")
+	flags.StringVar(&c.sqliteSynchronous, envSQLiteSynchronous, "NORMAL", "sqlite synchronous mode, options: OFF | NORMAL | FULL | EXTRA")
+	flags.IntVar(&c.sqliteMaxOpenConns, envSQLiteMaxOpenConns, 4, "sqlite max open connections (0 is unlimited)")
+	flags.IntVar(&c.sqliteWriteBatch, envSQLiteWriteBatch, 64, "max number of sqlite writes committed in a single transaction")
+	flags.BoolVar(&c.boltNoSync, envBoltNoSync, false, "skip the bolt fsync on every commit (a crash can lose the last writes)")
+	flags.StringVar(&c.redisAddr, envRedisAddr, "localhost:6379", "redis host:port")
+	flags.StringVar(&c.redisPass, envRedisPass, "", "redis password")
+	flags.IntVar(&c.redisDb, envRedisDb, 0, "redis database number")
+	flags.StringVar(&c.redisPrefix, envRedisPrefix, "caffeine", "prefix of the redis keys and channels used by caffeine")
+	flags.StringVar(&c.s3Endpoint, envS3Endpoint, "s3.amazonaws.com", "s3 endpoint host[:port]")
+	flags.StringVar(&c.s3AccessKey, envS3AccessKey, "", "s3 access key")
+	flags.StringVar(&c.s3SecretKey, envS3SecretKey, "", "s3 secret key")
+	flags.StringVar(&c.s3Bucket, envS3Bucket, "caffeine", "s3 bucket, created if missing")
+	flags.StringVar(&c.s3Region, envS3Region, "", "s3 region")
+	flags.BoolVar(&c.s3Secure, envS3Secure, true, "connect to s3 with TLS")
+	flags.StringVar(&c.s3Prefix, envS3Prefix, "", "prefix of the s3 objects used by caffeine")
+}
+
+func newDatabase(config dbConfig) service.Database {
+	switch config.dbType {
+	case MEMORY:
+		return &database.MemDatabase{
+			SnapshotDir:      config.memSnapshotDir,
+			SnapshotInterval: config.memSnapshotInterval,
+			FsyncPolicy:      config.memFsync,
+		}
+	case PG:
+		return &database.PGDatabase{
+			Host:            config.pgHost,
+			Port:            config.pgPort,
+			User:            config.pgUser,
+			Pass:            config.pgPass,
+			DbName:          config.pgDb,
+			SSLMode:         config.pgSSLMode,
+			SSLRootCert:     config.pgSSLRootCert,
+			SSLCert:         config.pgSSLCert,
+			SSLKey:          config.pgSSLKey,
+			ConnectTimeout:  config.pgConnectTimeout,
+			MaxOpenConns:    config.pgMaxOpenConns,
+			MaxIdleConns:    config.pgMaxIdleConns,
+			ConnMaxLifetime: config.pgConnMaxLifetime,
+			ConnMaxIdleTime: config.pgConnMaxIdleTime,
+			GinIndex:        config.pgGinIndex,
+		}
+	case FS:
+		return &database.StorageDatabase{
+			RootDirPath: config.dbPath,
+			Sharded:     config.fsSharded,
+		}
+	case SQLITE:
+		return &database.SQLiteDatabase{
+			DirPath:      config.dbPath,
+			JournalMode:  config.sqliteJournalMode,
+			BusyTimeout:  config.sqliteBusyTimeout,
+			Synchronous:  config.sqliteSynchronous,
+			MaxOpenConns: config.sqliteMaxOpenConns,
+			WriteBatch:   config.sqliteWriteBatch,
+		}
+	case BOLT:
+		return &database.BoltDatabase{
+			DirPath: config.dbPath,
+			NoSync:  config.boltNoSync,
+		}
+	case REDIS:
+		return &database.RedisDatabase{
+			Addr:     config.redisAddr,
+			Password: config.redisPass,
+			DB:       config.redisDb,
+			Prefix:   config.redisPrefix,
+		}
+	case S3:
+		return &database.S3Database{
+			Endpoint:  config.s3Endpoint,
+			AccessKey: config.s3AccessKey,
+			SecretKey: config.s3SecretKey,
+			Bucket:    config.s3Bucket,
+			Region:    config.s3Region,
+			Secure:    config.s3Secure,
+			Prefix:    config.s3Prefix,
+		}
+	}
+	log.Fatalf("unknown db type '%v'", config.dbType)
+	return nil
+}
+
+func newEventBus(busType string, config dbConfig) service.EventBus {
+	switch busType {
+	case busNone:
+		return nil
+	case busRedis:
+		return &service.RedisBus{
+			Client: redis.NewClient(&redis.Options{
+				Addr:     config.redisAddr,
+				Password: config.redisPass,
+				DB:       config.redisDb,
+			}),
+			Channel: config.redisPrefix + ":events",
+		}
+	case busPg:
+		return &service.PgBus{
+			DSN: newDatabase(config.withType(PG)).(*database.PGDatabase).DSN(),
+		}
+	}
+	log.Fatalf("unknown event bus '%v'", busType)
+	return nil
+}
+
+// migrate copies all data between two backends, e.g.
+// caffeine migrate --from fs:./data --to sqlite:./db
+func migrate(args []string) {
+	var from, to, statePath string
+	var dryRun bool
+	var config dbConfig
+	flags := flag.NewFlagSet(cmdMigrate, flag.ExitOnError)
+	flags.StringVar(&from, "from", "", "source database as type:location, e.g. fs:./data | sqlite:./db | bolt:./db | memory:./snapshots | redis:host:port | s3:bucket | postgres:host")
+	flags.StringVar(&to, "to", "", "destination database as type:location")
+	flags.StringVar(&statePath, "state", "", "file recording the migrated namespaces, to resume an interrupted migration")
+	flags.BoolVar(&dryRun, "dry-run", false, "only report what would be copied")
+	// type and location come from --from and --to, the other settings (e.g. postgres credentials) from the usual flags
+	config.registerFlags(flags)
+	flags.Parse(args)
+
+	if from == "" || to == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	for _, spec := range []string{from, to} {
+		// without snapshots, a memory database would be lost when the command exits
+		if c := config.withSpec(spec); c.dbType == MEMORY && c.memSnapshotDir == "" {
+			log.Fatalf("'%v': a memory database needs the directory of its snapshots, e.g. memory:./snapshots", spec)
+		}
+	}
+	source := newDatabase(config.withSpec(from))
+	destination := newDatabase(config.withSpec(to))
+	source.Init()
+	if !dryRun {
+		destination.Init()
+	}
+
+	migration := service.Migration{
+		From:      source,
+		To:        destination,
+		DryRun:    dryRun,
+		StatePath: statePath,
+	}
+	report, err := migration.Run()
+	closeDatabase(source)
+	if !dryRun {
+		closeDatabase(destination)
+	}
+	if err != nil {
+		log.Fatalf("migration failed: %v", err)
+	}
+	log.Printf("migration completed: %v namespaces, %v keys copied, %v namespaces skipped\n", report.Namespaces, report.Keys, report.Skipped)
+}
+
+// withType returns a copy of the config for another db type
+func (c dbConfig) withType(dbType string) dbConfig {
+	c.dbType = dbType
+	return c
+}
+
+// withSpec returns a copy of the config for a type:location database spec
+func (c dbConfig) withSpec(spec string) dbConfig {
+	parts := strings.SplitN(spec, ":", 2)
+	c.dbType = parts[0]
+	if len(parts) == 2 {
+		c.dbPath = parts[1]
+		c.memSnapshotDir = parts[1]
+		c.pgHost = parts[1]
+		c.redisAddr = parts[1]
+		c.s3Bucket = parts[1]
+	}
+	return c
+}
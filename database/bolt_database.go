@@ -0,0 +1,233 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	bolt_dbName         = "caffeine.db"
+	bolt_defaultTimeout = 5 * time.Second
+)
+
+// BoltDatabase stores every namespace as a bucket of a single bbolt file: pure Go,
+// keys are kept sorted and every write is a transaction.
+type BoltDatabase struct {
+	DirPath string
+	// Timeout is how long Init waits for the file lock held by another process
+	Timeout time.Duration
+	// NoSync skips the fsync on every commit, faster but a crash can lose the last writes
+	NoSync bool
+
+	db *bolt.DB
+}
+
+func (b *BoltDatabase) Init() {
+	err := os.MkdirAll(b.DirPath, 0755)
+	if err != nil {
+		log.Fatalf("error creating bolt directory: %v", err)
+	}
+	timeout := b.Timeout
+	if timeout <= 0 {
+		timeout = bolt_defaultTimeout
+	}
+	b.db, err = bolt.Open(filepath.Join(b.DirPath, bolt_dbName), 0644, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		log.Fatalf("error opening bolt database: %v", err)
+	}
+	b.db.NoSync = b.NoSync
+}
+
+func (b *BoltDatabase) Close() error {
+	if b.db == nil {
+		return nil
+	}
+	return b.db.Close()
+}
+
+func (b *BoltDatabase) Upsert(namespace string, key string, value []byte) *DbError {
+	return b.UpsertBatch(namespace, map[string][]byte{key: value})
+}
+
+// UpsertBatch writes all the values in a single transaction: either all of them are stored or none
+func (b *BoltDatabase) UpsertBatch(namespace string, values map[string][]byte) *DbError {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(namespace))
+		if err != nil {
+			return err
+		}
+		for key, value := range values {
+			err = bucket.Put([]byte(key), value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Upsert: %v", err),
+		}
+	}
+	return nil
+}
+
+func (b *BoltDatabase) Get(namespace string, key string) ([]byte, *DbError) {
+	var ret []byte
+	dbErr := b.view(namespace, func(bucket *bolt.Bucket) *DbError {
+		value := bucket.Get([]byte(key))
+		if value == nil {
+			return &DbError{
+				ErrorCode: ID_NOT_FOUND,
+				Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+			}
+		}
+		// values are only valid during the transaction
+		ret = append([]byte(nil), value...)
+		return nil
+	})
+	return ret, dbErr
+}
+
+func (b *BoltDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
+	ret := make(map[string][]byte)
+	dbErr := b.view(namespace, func(bucket *bolt.Bucket) *DbError {
+		err := bucket.ForEach(func(k, v []byte) error {
+			ret[string(k)] = append([]byte(nil), v...)
+			return nil
+		})
+		if err != nil {
+			return &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("error on GetAll: %v", err),
+			}
+		}
+		return nil
+	})
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	return ret, nil
+}
+
+// GetRange returns the documents in key order, as bolt iterates them
+func (b *BoltDatabase) GetRange(namespace string, from string, limit int) ([]Document, *DbError) {
+	ret := make([]Document, 0)
+	dbErr := b.view(namespace, func(bucket *bolt.Bucket) *DbError {
+		cursor := bucket.Cursor()
+		for k, v := cursor.Seek([]byte(from)); k != nil && len(ret) < limit; k, v = cursor.Next() {
+			ret = append(ret, Document{Key: string(k), Value: append([]byte(nil), v...)})
+		}
+		return nil
+	})
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	return ret, nil
+}
+
+func (b *BoltDatabase) Delete(namespace string, key string) *DbError {
+	return b.update(namespace, func(tx *bolt.Tx, bucket *bolt.Bucket) *DbError {
+		if bucket.Get([]byte(key)) == nil {
+			return &DbError{
+				ErrorCode: ID_NOT_FOUND,
+				Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+			}
+		}
+		err := bucket.Delete([]byte(key))
+		if err != nil {
+			return &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("error on Delete: %v", err),
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltDatabase) DeleteAll(namespace string) *DbError {
+	return b.update(namespace, func(tx *bolt.Tx, bucket *bolt.Bucket) *DbError {
+		err := tx.DeleteBucket([]byte(namespace))
+		if err != nil {
+			return &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("error on DeleteAll: %v", err),
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltDatabase) GetNamespaces() []string {
+	ret := make([]string, 0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			ret = append(ret, string(name))
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("error listing namespaces: %v\n", err)
+	}
+	return ret
+}
+
+func (b *BoltDatabase) view(namespace string, fn func(bucket *bolt.Bucket) *DbError) *DbError {
+	var dbErr *DbError
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(namespace))
+		if bucket == nil {
+			dbErr = namespaceNotFound(namespace)
+			return nil
+		}
+		dbErr = fn(bucket)
+		return nil
+	})
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	return dbErr
+}
+
+// update rolls back the transaction if fn fails
+func (b *BoltDatabase) update(namespace string, fn func(tx *bolt.Tx, bucket *bolt.Bucket) *DbError) *DbError {
+	var dbErr *DbError
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(namespace))
+		if bucket == nil {
+			dbErr = namespaceNotFound(namespace)
+			return dbErr
+		}
+		dbErr = fn(tx, bucket)
+		if dbErr != nil {
+			return dbErr
+		}
+		return nil
+	})
+	if dbErr != nil {
+		return dbErr
+	}
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   err.Error(),
+		}
+	}
+	return nil
+}
+
+func namespaceNotFound(namespace string) *DbError {
+	return &DbError{
+		ErrorCode: NAMESPACE_NOT_FOUND,
+		Message:   fmt.Sprintf("namespace '%v' does not exist.", namespace),
+	}
+}
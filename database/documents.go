@@ -0,0 +1,7 @@
+package database
+
+// Document is a key of a namespace with its value, returned by the reads keeping the key order
+type Document struct {
+	Key   string
+	Value []byte
+}
@@ -10,6 +10,8 @@ const (
 	ID_NOT_FOUND           ErrorCode = 2
 	UNABLE_TO_CREATE_TABLE ErrorCode = 3
 	FILESYSTEM_ERROR       ErrorCode = 4
+	VERSION_CONFLICT       ErrorCode = 5
+	UNIQUE_VIOLATION       ErrorCode = 6
 )
 
 type DbError struct {
@@ -1,44 +1,67 @@
 package database
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fs_dirPerm       = 0755
+	fs_quarantineDir = ".quarantine"
+	fs_lockStripes   = 256
 )
 
 type StorageDatabase struct {
 	RootDirPath string
+	// Sharded spreads the documents of a namespace over hashed subdirectories,
+	// for namespaces with huge key counts. Existing data is migrated at Init when it changes.
+	Sharded bool
+
+	// striped per-key locks, so concurrent writers of the same document do not interleave
+	locks [fs_lockStripes]sync.Mutex
 }
 
 func (s *StorageDatabase) Init() {
-	err := os.MkdirAll(s.RootDirPath, os.ModePerm)
+	err := os.MkdirAll(s.RootDirPath, fs_dirPerm)
+	if err != nil {
+		log.Fatalf("error on StorageDatabase Init: %v", err)
+	}
+	err = s.ensureLayout()
+	if err != nil {
+		log.Fatalf("error on StorageDatabase layout migration: %v", err)
+	}
+	err = s.scan()
 	if err != nil {
 		log.Fatalf("error on StorageDatabase Init: %v", err)
 	}
 }
 
 func (s *StorageDatabase) Upsert(namespace string, key string, value []byte) *DbError {
-	err := s.ensureNamespace(namespace)
+	filePath := s.getFilePath(namespace, key)
+	err := os.MkdirAll(filepath.Dir(filePath), fs_dirPerm)
 	if err != nil {
 		return &DbError{
 			ErrorCode: FILESYSTEM_ERROR,
 			Message:   err.Error(),
 		}
 	}
-	filePath := s.getFilePath(namespace, key)
 
-	_, statErr := os.Stat(filePath)
-	if statErr == nil || errors.Is(statErr, os.ErrNotExist) {
-		err = os.WriteFile(filePath, value, os.ModePerm)
-		if err != nil {
-			return &DbError{
-				ErrorCode: FILESYSTEM_ERROR,
-				Message:   err.Error(),
-			}
+	unlock := s.lock(filePath)
+	defer unlock()
+
+	err = writeFileAtomic(filePath, value)
+	if err != nil {
+		return &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   err.Error(),
 		}
 	}
 	return nil
@@ -46,37 +69,33 @@ func (s *StorageDatabase) Upsert(namespace string, key string, value []byte) *Db
 
 func (s *StorageDatabase) Get(namespace string, key string) ([]byte, *DbError) {
 	filePath := s.getFilePath(namespace, key)
-	bytes, err := ioutil.ReadFile(filepath.Clean(filePath))
+	bytes, ok, err := s.readDocument(namespace, filepath.Clean(filePath))
+	if err == nil && !ok {
+		err = fmt.Errorf("corrupted document '%v' of namespace '%v' moved to quarantine", key, namespace)
+	}
 	if err != nil {
 		return nil, &DbError{
 			ErrorCode: FILESYSTEM_ERROR,
 			Message:   err.Error(),
 		}
-	} else {
-		return bytes, nil
 	}
+	return bytes, nil
 }
 
 func (s *StorageDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
 	result := make(map[string][]byte)
 
-	docs, readDirErr := ioutil.ReadDir(s.getNamespacePath(namespace))
-	if readDirErr != nil {
+	err := s.currentLayout().walk(s.getNamespacePath(namespace), func(key, path string) error {
+		content, ok, err := s.readDocument(namespace, path)
+		if ok {
+			result[key] = content
+		}
+		return err
+	})
+	if err != nil {
 		return nil, &DbError{
 			ErrorCode: FILESYSTEM_ERROR,
-			Message:   readDirErr.Error(),
-		}
-	}
-	for _, doc := range docs {
-		keyParts := strings.SplitN(doc.Name(), ".", 2)
-		if len(keyParts) != 2 || keyParts[1] != "json" {
-			continue
-		}
-		rawKey := keyParts[0]
-		var err *DbError
-		result[rawKey], err = s.Get(namespace, rawKey)
-		if err != nil {
-			return nil, err
+			Message:   err.Error(),
 		}
 	}
 
@@ -86,6 +105,9 @@ func (s *StorageDatabase) GetAll(namespace string) (map[string][]byte, *DbError)
 func (s *StorageDatabase) Delete(namespace string, key string) *DbError {
 	filePath := s.getFilePath(namespace, key)
 
+	unlock := s.lock(filePath)
+	defer unlock()
+
 	_, err := os.Stat(filePath)
 	if err != nil {
 		return &DbError{
@@ -127,20 +149,64 @@ func (s *StorageDatabase) GetNamespaces() []string {
 	}
 
 	for _, ns := range namespaces {
-		if ns.IsDir() {
+		if ns.IsDir() && !strings.HasPrefix(ns.Name(), ".") {
 			results = append(results, ns.Name())
 		}
 	}
 	return results
 }
 
-func (s *StorageDatabase) ensureNamespace(namespace string) error {
-	path := s.getNamespacePath(namespace)
-	return os.MkdirAll(path, os.ModePerm)
+func (s *StorageDatabase) lock(filePath string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(filePath))
+	mu := &s.locks[h.Sum32()%fs_lockStripes]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// scan removes temporary files left by an interrupted write. It only lists the directories,
+// the documents are checked when read.
+func (s *StorageDatabase) scan() error {
+	for _, namespace := range s.GetNamespaces() {
+		err := removeTemporaryFiles(s.getNamespacePath(namespace))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDocument reads a document, moving it to the quarantine directory if it is not valid JSON,
+// so it can't break GetAll: writes are atomic, so it was changed outside of caffeine
+func (s *StorageDatabase) readDocument(namespace string, docPath string) ([]byte, bool, error) {
+	content, err := ioutil.ReadFile(docPath)
+	if err != nil || json.Valid(content) {
+		return content, err == nil, err
+	}
+
+	unlock := s.lock(docPath)
+	defer unlock()
+	// it could have been rewritten meanwhile
+	content, err = ioutil.ReadFile(docPath)
+	if err != nil || json.Valid(content) {
+		return content, err == nil, err
+	}
+	quarantinePath := filepath.Join(s.RootDirPath, fs_quarantineDir, namespace)
+	err = os.MkdirAll(quarantinePath, fs_dirPerm)
+	if err != nil {
+		return nil, false, err
+	}
+	target := filepath.Join(quarantinePath, fmt.Sprintf("%v.%v", filepath.Base(docPath), time.Now().UnixNano()))
+	log.Printf("corrupted document %v moved to %v\n", docPath, target)
+	return nil, false, os.Rename(docPath, target)
 }
 
 func (s *StorageDatabase) getFilePath(namespace, key string) string {
-	return filepath.Join(s.getNamespacePath(namespace), fmt.Sprintf("%s.json", key))
+	return s.currentLayout().path(s.getNamespacePath(namespace), key)
+}
+
+func (s *StorageDatabase) currentLayout() fsLayout {
+	return fsLayout{Version: fs_layoutVersion, Sharded: s.Sharded}
 }
 
 func (s *StorageDatabase) getNamespacePath(namespace string) string {
@@ -0,0 +1,266 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	fs_layoutVersion = 2
+	fs_layoutFile    = ".layout"
+	fs_migrateDir    = ".migrate"
+	fs_oldDir        = ".old"
+	fs_extension     = ".json"
+	fs_escape        = '_'
+)
+
+// fsLayout describes how documents are stored in a namespace directory.
+// Version 1 used the raw key as filename, version 2 encodes it (see encodeKey)
+// and can spread the files over 256 hashed subdirectories.
+type fsLayout struct {
+	Version int  `json:"version"`
+	Sharded bool `json:"sharded"`
+}
+
+func (l fsLayout) path(nsPath, key string) string {
+	if l.Version < 2 {
+		return filepath.Join(nsPath, key+fs_extension)
+	}
+	if l.Sharded {
+		return filepath.Join(nsPath, shardOf(key), encodeKey(key)+fs_extension)
+	}
+	return filepath.Join(nsPath, encodeKey(key)+fs_extension)
+}
+
+// walk calls fn for every document of a namespace directory
+func (l fsLayout) walk(nsPath string, fn func(key, path string) error) error {
+	entries, err := os.ReadDir(nsPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		entryPath := filepath.Join(nsPath, entry.Name())
+		if entry.IsDir() {
+			if !l.Sharded || l.Version < 2 {
+				continue
+			}
+			err = fsLayout{Version: l.Version}.walk(entryPath, fn)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasSuffix(entry.Name(), fs_extension) {
+			continue
+		}
+		key := strings.TrimSuffix(entry.Name(), fs_extension)
+		if l.Version >= 2 {
+			key, err = decodeKey(key)
+			if err != nil {
+				log.Printf("skipping %v: %v\n", entryPath, err)
+				continue
+			}
+		}
+		err = fn(key, entryPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeKey makes any key a safe, reversible filename: bytes other than
+// ASCII letters, digits and '-' are written as '_' followed by two hex digits
+func encodeKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%c%02x", fs_escape, c)
+		}
+	}
+	return b.String()
+}
+
+func decodeKey(name string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != fs_escape {
+			b.WriteByte(name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return "", fmt.Errorf("invalid encoded key '%v'", name)
+		}
+		c, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid encoded key '%v'", name)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func shardOf(key string) string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%02x", h.Sum32()&0xff)
+}
+
+func removeTemporaryFiles(nsPath string) error {
+	return filepath.WalkDir(nsPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasPrefix(d.Name(), ".") && strings.Contains(d.Name(), ".tmp-") {
+			log.Printf("removing leftover temporary file %v\n", path)
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+func (s *StorageDatabase) readLayout() (fsLayout, error) {
+	var layout fsLayout
+	content, err := os.ReadFile(filepath.Join(s.RootDirPath, fs_layoutFile))
+	if errors.Is(err, os.ErrNotExist) {
+		// data written before the layout was recorded
+		layout.Version = 1
+		return layout, nil
+	}
+	if err != nil {
+		return layout, err
+	}
+	err = json.Unmarshal(content, &layout)
+	return layout, err
+}
+
+func writeLayout(dir string, layout fsLayout) error {
+	content, err := json.Marshal(layout)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, fs_layoutFile), content)
+}
+
+// ensureLayout rewrites the data directory if it was written with a different layout.
+// The new tree is built aside in .migrate (the old one is untouched, so a crash just restarts the build),
+// then namespaces are swapped one by one; a crash while swapping is resumed at the next Init.
+func (s *StorageDatabase) ensureLayout() error {
+	migrateRoot := filepath.Join(s.RootDirPath, fs_migrateDir)
+	if _, err := os.Stat(filepath.Join(migrateRoot, fs_layoutFile)); err == nil {
+		err = s.swapLayout()
+		if err != nil {
+			return err
+		}
+	}
+
+	current, err := s.readLayout()
+	if err != nil {
+		return err
+	}
+	target := s.currentLayout()
+	if current == target {
+		return nil
+	}
+	namespaces := s.GetNamespaces()
+	if len(namespaces) == 0 {
+		return writeLayout(s.RootDirPath, target)
+	}
+
+	log.Printf("migrating %v from layout %+v to %+v\n", s.RootDirPath, current, target)
+	for _, dir := range []string{migrateRoot, filepath.Join(s.RootDirPath, fs_oldDir)} {
+		err = os.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+	}
+	for _, namespace := range namespaces {
+		newNsPath := filepath.Join(migrateRoot, namespace)
+		err = os.MkdirAll(newNsPath, fs_dirPerm)
+		if err != nil {
+			return err
+		}
+		err = current.walk(s.getNamespacePath(namespace), func(key, path string) error {
+			newPath := target.path(newNsPath, key)
+			err := os.MkdirAll(filepath.Dir(newPath), fs_dirPerm)
+			if err != nil {
+				return err
+			}
+			if os.Link(path, newPath) == nil {
+				return nil
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return writeFileAtomic(newPath, content)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = writeLayout(migrateRoot, target)
+	if err != nil {
+		return err
+	}
+	return s.swapLayout()
+}
+
+func (s *StorageDatabase) swapLayout() error {
+	migrateRoot := filepath.Join(s.RootDirPath, fs_migrateDir)
+	oldRoot := filepath.Join(s.RootDirPath, fs_oldDir)
+	err := os.MkdirAll(oldRoot, fs_dirPerm)
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(migrateRoot)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		nsPath := s.getNamespacePath(entry.Name())
+		if _, statErr := os.Stat(nsPath); statErr == nil {
+			err = os.Rename(nsPath, filepath.Join(oldRoot, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+		err = os.Rename(filepath.Join(migrateRoot, entry.Name()), nsPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Rename(filepath.Join(migrateRoot, fs_layoutFile), filepath.Join(s.RootDirPath, fs_layoutFile))
+	if err != nil {
+		return err
+	}
+	err = syncDir(s.RootDirPath)
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(oldRoot)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(migrateRoot)
+}
@@ -1,19 +1,59 @@
 package database
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
+)
+
+const (
+	FsyncAlways   = "always"
+	FsyncInterval = "interval"
+	FsyncNever    = "never"
+
+	mem_snapshotFile     = "snapshot.json"
+	mem_logFile          = "wal.log"
+	mem_rotatedLogFile   = "wal.log.1"
+	mem_defaultInterval  = 5 * time.Minute
+	mem_fsyncEvery       = time.Second
+	mem_opUpsert         = "upsert"
+	mem_opDelete         = "delete"
+	mem_opDeleteAll      = "delete_all"
+	mem_maxLogRecordSize = 64 * 1048576
 )
 
 type MemDatabase struct {
+	// SnapshotDir enables persistence: periodic snapshots plus an append-only log of the writes
+	// done in between, replayed at Init. If empty, data lives in memory only.
+	SnapshotDir      string
+	SnapshotInterval time.Duration
+	// FsyncPolicy tells when the write log is flushed to disk: always | interval (the default) | never
+	FsyncPolicy string
+
 	mu         sync.Mutex
+	snapshotMu sync.Mutex
 	namespaces map[string]namespace
+	wal        *os.File
+	stop       chan struct{}
 }
 
 type namespace struct {
 	data map[string][]byte
 }
 
+type memLogRecord struct {
+	Op        string `json:"op"`
+	Namespace string `json:"namespace"`
+	Key       string `json:"key,omitempty"`
+	Value     []byte `json:"value,omitempty"`
+}
+
 func newNamespace() namespace {
 	return namespace{
 		data: make(map[string][]byte),
@@ -22,18 +62,76 @@ func newNamespace() namespace {
 
 func (mb *MemDatabase) Init() {
 	mb.namespaces = make(map[string]namespace)
+	if mb.SnapshotDir == "" {
+		return
+	}
+	switch mb.FsyncPolicy {
+	case "":
+		mb.FsyncPolicy = FsyncInterval
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		log.Fatalf("unknown fsync policy '%v', options: %v | %v | %v", mb.FsyncPolicy, FsyncAlways, FsyncInterval, FsyncNever)
+	}
+
+	err := os.MkdirAll(mb.SnapshotDir, 0755)
+	if err != nil {
+		log.Fatalf("error on MemDatabase Init: %v", err)
+	}
+	err = mb.loadSnapshot()
+	if err != nil {
+		log.Fatalf("error loading snapshot: %v", err)
+	}
+	for _, logFile := range []string{mem_rotatedLogFile, mem_logFile} {
+		err = mb.replay(filepath.Join(mb.SnapshotDir, logFile))
+		if err != nil {
+			log.Fatalf("error replaying write log: %v", err)
+		}
+	}
+	mb.wal, err = os.OpenFile(filepath.Join(mb.SnapshotDir, mem_logFile), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		log.Fatalf("error opening write log: %v", err)
+	}
+	err = terminateLog(mb.wal)
+	if err != nil {
+		log.Fatalf("error opening write log: %v", err)
+	}
+
+	if mb.SnapshotInterval <= 0 {
+		mb.SnapshotInterval = mem_defaultInterval
+	}
+	mb.stop = make(chan struct{})
+	go mb.persist()
+}
+
+// Close takes a last snapshot and releases the write log
+func (mb *MemDatabase) Close() error {
+	if mb.wal == nil {
+		return nil
+	}
+	close(mb.stop)
+	err := mb.Snapshot()
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if closeErr := mb.wal.Close(); err == nil {
+		err = closeErr
+	}
+	mb.wal = nil
+	return err
 }
 
 func (mb *MemDatabase) Upsert(namespace string, key string, value []byte) *DbError {
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
 
-	ns, ok := mb.namespaces[namespace]
-	if !ok {
-		ns = newNamespace()
-		mb.namespaces[namespace] = ns
+	err := mb.appendLog(memLogRecord{Op: mem_opUpsert, Namespace: namespace, Key: key, Value: value})
+	if err != nil {
+		return &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   err.Error(),
+		}
 	}
-	ns.data[key] = value
+	mb.upsert(namespace, key, value)
 	return nil
 }
 
@@ -69,7 +167,12 @@ func (mb *MemDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
 			Message:   fmt.Sprintf("namespace '%v' does not exist.", namespace),
 		}
 	}
-	return ns.data, nil
+	// a copy, the namespace can change while the caller reads it
+	ret := make(map[string][]byte, len(ns.data))
+	for key, value := range ns.data {
+		ret[key] = value
+	}
+	return ret, nil
 }
 
 func (mb *MemDatabase) Delete(namespace string, key string) *DbError {
@@ -91,6 +194,13 @@ func (mb *MemDatabase) Delete(namespace string, key string) *DbError {
 		}
 	}
 
+	err := mb.appendLog(memLogRecord{Op: mem_opDelete, Namespace: namespace, Key: key})
+	if err != nil {
+		return &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   err.Error(),
+		}
+	}
 	delete(ns.data, key)
 	return nil
 }
@@ -106,6 +216,14 @@ func (mb *MemDatabase) DeleteAll(namespace string) *DbError {
 			Message:   fmt.Sprintf("namespace '%v' does not exist.", namespace),
 		}
 	}
+
+	err := mb.appendLog(memLogRecord{Op: mem_opDeleteAll, Namespace: namespace})
+	if err != nil {
+		return &DbError{
+			ErrorCode: FILESYSTEM_ERROR,
+			Message:   err.Error(),
+		}
+	}
 	delete(mb.namespaces, namespace)
 	return nil
 }
@@ -120,3 +238,192 @@ func (mb *MemDatabase) GetNamespaces() []string {
 	}
 	return ret
 }
+
+// Snapshot writes the whole content to disk and discards the write log covered by it.
+// The log is rotated under lock, the (slow) snapshot write happens without blocking writers.
+func (mb *MemDatabase) Snapshot() error {
+	mb.snapshotMu.Lock()
+	defer mb.snapshotMu.Unlock()
+
+	mb.mu.Lock()
+	if mb.wal == nil {
+		mb.mu.Unlock()
+		return nil
+	}
+	content := make(map[string]map[string][]byte, len(mb.namespaces))
+	for name, ns := range mb.namespaces {
+		data := make(map[string][]byte, len(ns.data))
+		for k, v := range ns.data {
+			data[k] = v
+		}
+		content[name] = data
+	}
+	err := mb.rotateLog()
+	mb.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(filepath.Join(mb.SnapshotDir, mem_snapshotFile), encoded)
+	if err != nil {
+		return err
+	}
+	// replaying the rotated log over the new snapshot would be harmless, but it's useless now
+	return os.Remove(filepath.Join(mb.SnapshotDir, mem_rotatedLogFile))
+}
+
+func (mb *MemDatabase) persist() {
+	snapshotTicker := time.NewTicker(mb.SnapshotInterval)
+	defer snapshotTicker.Stop()
+	fsyncTicker := time.NewTicker(mem_fsyncEvery)
+	defer fsyncTicker.Stop()
+
+	for {
+		select {
+		case <-mb.stop:
+			return
+		case <-snapshotTicker.C:
+			err := mb.Snapshot()
+			if err != nil {
+				log.Printf("error on snapshot: %v\n", err)
+			}
+		case <-fsyncTicker.C:
+			if mb.FsyncPolicy != FsyncInterval {
+				continue
+			}
+			mb.mu.Lock()
+			if mb.wal != nil {
+				err := mb.wal.Sync()
+				if err != nil {
+					log.Printf("error on write log sync: %v\n", err)
+				}
+			}
+			mb.mu.Unlock()
+		}
+	}
+}
+
+// appendLog must be called with the lock held
+func (mb *MemDatabase) appendLog(record memLogRecord) error {
+	if mb.wal == nil {
+		return nil
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = mb.wal.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	if mb.FsyncPolicy == FsyncAlways {
+		return mb.wal.Sync()
+	}
+	return nil
+}
+
+// rotateLog must be called with the lock held
+func (mb *MemDatabase) rotateLog() error {
+	err := mb.wal.Sync()
+	if err != nil {
+		return err
+	}
+	err = mb.wal.Close()
+	if err != nil {
+		return err
+	}
+	logPath := filepath.Join(mb.SnapshotDir, mem_logFile)
+	rotatedPath := filepath.Join(mb.SnapshotDir, mem_rotatedLogFile)
+	if _, statErr := os.Stat(rotatedPath); statErr == nil {
+		// a previous snapshot failed: keep the older entries in front of the newer ones
+		err = appendFile(rotatedPath, logPath)
+	} else {
+		err = os.Rename(logPath, rotatedPath)
+	}
+	if err != nil {
+		return err
+	}
+	mb.wal, err = os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	return err
+}
+
+func (mb *MemDatabase) upsert(namespace string, key string, value []byte) {
+	ns, ok := mb.namespaces[namespace]
+	if !ok {
+		ns = newNamespace()
+		mb.namespaces[namespace] = ns
+	}
+	ns.data[key] = value
+}
+
+func (mb *MemDatabase) loadSnapshot() error {
+	content, err := os.ReadFile(filepath.Join(mb.SnapshotDir, mem_snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	snapshot := make(map[string]map[string][]byte)
+	err = json.Unmarshal(content, &snapshot)
+	if err != nil {
+		return err
+	}
+	for name, data := range snapshot {
+		mb.namespaces[name] = namespace{data: data}
+	}
+	return nil
+}
+
+func (mb *MemDatabase) replay(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), mem_maxLogRecordSize)
+	for scanner.Scan() {
+		var record memLogRecord
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			// a torn write at the end of the log, the write was never acknowledged
+			log.Printf("skipping corrupted write log record in %v: %v\n", path, err)
+			continue
+		}
+		switch record.Op {
+		case mem_opUpsert:
+			mb.upsert(record.Namespace, record.Key, record.Value)
+		case mem_opDelete:
+			if ns, ok := mb.namespaces[record.Namespace]; ok {
+				delete(ns.data, record.Key)
+			}
+		case mem_opDeleteAll:
+			delete(mb.namespaces, record.Namespace)
+		}
+	}
+	return scanner.Err()
+}
+
+// terminateLog ends a torn last record with a newline, so the next record starts on its own line
+func terminateLog(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	_, err = file.ReadAt(last, info.Size()-1)
+	if err != nil || last[0] == '\n' {
+		return err
+	}
+	_, err = file.Write([]byte{'\n'})
+	return err
+}
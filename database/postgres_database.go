@@ -1,48 +1,121 @@
 package database
 
 import (
+	"crypto/sha1"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 const (
-	pg_dbName             = "caffeine"
-	pg_insertQuery        = "INSERT INTO %v (id, data) VALUES($1, $2) ON CONFLICT (id) DO UPDATE SET data = $2"
-	pg_tablesQuery        = "SELECT table_name FROM information_schema.tables WHERE table_schema = 'public'"
-	pg_getQuery           = "SELECT data FROM %v WHERE id = $1"
-	pg_getAllQuery        = "SELECT id, data FROM %v ORDER BY id"
-	pg_deleteQuery        = "DELETE FROM %v WHERE id = $1"
-	pg_dropNamespaceQuery = "DROP TABLE %v"
+	pg_maintenanceDb       = "postgres"
+	pg_insertQuery         = "INSERT INTO %v (id, data) VALUES($1, $2) ON CONFLICT (id) DO UPDATE SET data = $2"
+	pg_createTableQuery    = "CREATE TABLE IF NOT EXISTS %v ( id text PRIMARY KEY, data jsonb NOT NULL)"
+	pg_catalogExistsQuery  = "SELECT to_regclass('" + catalog_table + "') IS NOT NULL"
+	pg_legacyTablesQuery   = "SELECT table_name FROM information_schema.columns WHERE table_schema = 'public' AND table_name ~ '^[a-z0-9]+(_schema)?$' GROUP BY table_name HAVING count(*) = 2 AND count(*) FILTER (WHERE (column_name = 'id' AND data_type = 'text') OR (column_name = 'data' AND data_type = 'json')) = 2"
+	pg_getQuery            = "SELECT data FROM %v WHERE id = $1"
+	pg_getAllQuery         = "SELECT id, data FROM %v ORDER BY id"
+	pg_getRangeQuery       = "SELECT id, data FROM %v WHERE id >= $1 ORDER BY id LIMIT $2"
+	pg_deleteQuery         = "DELETE FROM %v WHERE id = $1"
+	pg_dropNamespaceQuery  = "DROP TABLE %v"
+	pg_ginIndexQuery       = "CREATE INDEX IF NOT EXISTS %v ON %v USING GIN (data)"
+	pg_jsonTablesQuery     = "SELECT c.table_name FROM information_schema.columns c JOIN " + catalog_table + " n ON n.table_name = c.table_name WHERE c.table_schema = 'public' AND c.column_name = 'data' AND c.data_type = 'json'"
+	pg_databaseExistsQuery = "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)"
+	pg_migrationsLockQuery = "SELECT pg_advisory_xact_lock(7283451)"
+	pg_toJsonbQuery        = "ALTER TABLE %v ALTER COLUMN data TYPE jsonb USING data::jsonb"
+	pg_uniqueIndexQuery    = "CREATE UNIQUE INDEX IF NOT EXISTS %v ON %v (%v)"
+	pg_indexesQuery        = "SELECT indexname FROM pg_indexes WHERE schemaname = 'public'"
+	pg_dropIndexQuery      = "DROP INDEX IF EXISTS %v"
+	pg_uniqueViolation     = "23505"
+	pg_defaultPort         = 5432
 )
 
 type PGDatabase struct {
 	Host string
+	Port int
 	User string
 	Pass string
+	// DbName is the database to connect to, if empty the postgres default (the user name) is used
+	DbName string
 
-	db *sql.DB
+	// SSLMode is one of the libpq modes: disable | require | verify-ca | verify-full
+	SSLMode     string
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+
+	ConnectTimeout  time.Duration
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// GinIndex adds a GIN index on the data of every namespace, to speed up containment queries
+	GinIndex bool
+
+	db      *sql.DB
+	catalog sqlCatalog
+}
+
+var pg_migrations = []sqlMigration{
+	{
+		version:     1,
+		description: "namespaces catalog",
+		up:          createCatalog(pg_catalogExistsQuery, pg_legacyTablesQuery),
+	},
+	{
+		version:     2,
+		description: "jsonb data",
+		up:          pg_migrateToJsonb,
+	},
 }
 
 func (p *PGDatabase) Init() {
-	connInfo := fmt.Sprintf("user=%v password=%v host=%v sslmode=disable", p.User, p.Pass, p.Host)
-	db, err := sql.Open("postgres", connInfo)
+	if p.DbName != "" {
+		err := p.ensureDatabase()
+		if err != nil {
+			log.Fatalf("error creating database %v: %v", p.DbName, err)
+		}
+	}
+
+	db, err := sql.Open("postgres", p.dsn(p.DbName))
 
 	if err != nil {
 		log.Fatalf("error connecting to postgres: %v", err)
 	}
+	db.SetMaxOpenConns(p.MaxOpenConns)
+	db.SetMaxIdleConns(p.MaxIdleConns)
+	db.SetConnMaxLifetime(p.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(p.ConnMaxIdleTime)
+	p.db = db
 
-	_, err = db.Exec("create database " + pg_dbName)
+	err = runMigrations(db, pg_migrations, pg_migrationsLockQuery)
 	if err != nil {
-		log.Println(err)
+		log.Fatalf("error on postgres storage migrations: %v", err)
+	}
+	err = p.catalog.init(db, func(statements ...sqlStatement) error {
+		return execInTx(db, statements...)
+	})
+	if err != nil {
+		log.Fatalf("error on namespaces catalog: %v", err)
+	}
+	if p.GinIndex {
+		for _, table := range p.catalog.rawTables() {
+			err = p.ensureGinIndex(table)
+			if err != nil {
+				log.Fatalf("error creating GIN index: %v", err)
+			}
+		}
 	}
-	p.db = db
 }
 
-func (p PGDatabase) Upsert(namespace string, key string, value []byte) *DbError {
-	err := p.ensureNamespace(namespace)
+func (p *PGDatabase) Upsert(namespace string, key string, value []byte) *DbError {
+	table, err := p.ensureNamespace(namespace)
 
 	if err != nil {
 		return &DbError{
@@ -50,7 +123,14 @@ func (p PGDatabase) Upsert(namespace string, key string, value []byte) *DbError
 			Message:   fmt.Sprintf("namespace %v does not exist", namespace),
 		}
 	}
-	_, dbErr := p.db.Exec(fmt.Sprintf(pg_insertQuery, namespace), key, string(value))
+	_, dbErr := p.db.Exec(fmt.Sprintf(pg_insertQuery, table), key, string(value))
+	var pqErr *pq.Error
+	if errors.As(dbErr, &pqErr) && pqErr.Code == pg_uniqueViolation {
+		return &DbError{
+			ErrorCode: UNIQUE_VIOLATION,
+			Message:   fmt.Sprintf("error on Upsert: %v", dbErr),
+		}
+	}
 	if dbErr != nil {
 		return &DbError{
 			ErrorCode: INTERNAL_ERROR,
@@ -60,8 +140,12 @@ func (p PGDatabase) Upsert(namespace string, key string, value []byte) *DbError
 	return nil
 }
 
-func (p PGDatabase) Get(namespace string, key string) ([]byte, *DbError) {
-	rows, dbErr := p.db.Query(fmt.Sprintf(pg_getQuery, namespace), key)
+func (p *PGDatabase) Get(namespace string, key string) ([]byte, *DbError) {
+	table, nsErr := p.catalog.table(namespace)
+	if nsErr != nil {
+		return nil, nsErr
+	}
+	rows, dbErr := p.db.Query(fmt.Sprintf(pg_getQuery, table), key)
 	if dbErr != nil {
 		return nil, &DbError{
 			ErrorCode: INTERNAL_ERROR,
@@ -86,9 +170,25 @@ func (p PGDatabase) Get(namespace string, key string) ([]byte, *DbError) {
 	}
 }
 
-func (p PGDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
-	sqlStatement := fmt.Sprintf(pg_getAllQuery, namespace)
-	rows, dbErr := p.db.Query(sqlStatement)
+func (p *PGDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
+	table, nsErr := p.catalog.table(namespace)
+	if nsErr != nil {
+		return nil, nsErr
+	}
+	return p.query(fmt.Sprintf(pg_getAllQuery, table))
+}
+
+func (p *PGDatabase) GetRange(namespace string, from string, limit int) ([]Document, *DbError) {
+	table, nsErr := p.catalog.table(namespace)
+	if nsErr != nil {
+		return nil, nsErr
+	}
+	return queryDocuments(p.db, fmt.Sprintf(pg_getRangeQuery, table), from, limit)
+}
+
+// query reads the documents returned by a query of ids and data
+func (p *PGDatabase) query(sqlStatement string, args ...interface{}) (map[string][]byte, *DbError) {
+	rows, dbErr := p.db.Query(sqlStatement, args...)
 	if dbErr != nil {
 		return nil, &DbError{
 			ErrorCode: INTERNAL_ERROR,
@@ -113,8 +213,12 @@ func (p PGDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
 	return ret, nil
 }
 
-func (p PGDatabase) Delete(namespace string, key string) *DbError {
-	_, err := p.db.Exec(fmt.Sprintf(pg_deleteQuery, namespace), key)
+func (p *PGDatabase) Delete(namespace string, key string) *DbError {
+	table, nsErr := p.catalog.table(namespace)
+	if nsErr != nil {
+		return nsErr
+	}
+	_, err := p.db.Exec(fmt.Sprintf(pg_deleteQuery, table), key)
 	if err != nil {
 		message := fmt.Sprintf("error on Delete: %v", err)
 		return &DbError{
@@ -125,9 +229,12 @@ func (p PGDatabase) Delete(namespace string, key string) *DbError {
 	return nil
 }
 
-func (p PGDatabase) DeleteAll(namespace string) *DbError {
-	sqlStatement := fmt.Sprintf(pg_dropNamespaceQuery, namespace)
-	_, err := p.db.Exec(sqlStatement)
+func (p *PGDatabase) DeleteAll(namespace string) *DbError {
+	table, nsErr := p.catalog.table(namespace)
+	if nsErr != nil {
+		return nsErr
+	}
+	err := p.catalog.drop(namespace, table, pg_dropNamespaceQuery)
 	if err != nil {
 		message := fmt.Sprintf("error on DeleteAll: %v", err)
 		return &DbError{
@@ -138,32 +245,158 @@ func (p PGDatabase) DeleteAll(namespace string) *DbError {
 	return nil
 }
 
-func (p PGDatabase) GetNamespaces() []string {
-	rows, err := p.db.Query(pg_tablesQuery)
+// EnsureUnique makes the unique indexes of a namespace match its constraints, each
+// one a list of fields whose values, together, can't be the same in two documents
+func (p *PGDatabase) EnsureUnique(namespace string, constraints [][]string) *DbError {
+	if len(constraints) == 0 {
+		if _, nsErr := p.catalog.table(namespace); nsErr != nil {
+			return nil
+		}
+	}
+	table, err := p.ensureNamespace(namespace)
+	if err == nil {
+		var existing []string
+		existing, err = queryStrings(p.db, pg_indexesQuery)
+		if err == nil {
+			err = syncUniqueIndexes(namespace, constraints, existing, func(name string, fields []string) error {
+				expressions := make([]string, len(fields))
+				for i, field := range fields {
+					expressions[i] = fmt.Sprintf("(data->>%v)", quoteLiteral(field))
+				}
+				_, err := p.db.Exec(fmt.Sprintf(pg_uniqueIndexQuery, quoteIdentifier(name), table, strings.Join(expressions, ", ")))
+				return err
+			}, func(name string) error {
+				_, err := p.db.Exec(fmt.Sprintf(pg_dropIndexQuery, quoteIdentifier(name)))
+				return err
+			})
+		}
+	}
 	if err != nil {
-		log.Printf("error on GetNamespaces: %v\n", err)
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on unique indexes: %v", err),
+		}
 	}
-	defer rows.Close()
+	return nil
+}
 
-	ret := make([]string, 0)
-	for rows.Next() {
-		var tableName string
-		err = rows.Scan(&tableName)
-		if err != nil {
-			log.Printf("error on Scan: %v\n", err)
+func (p *PGDatabase) GetNamespaces() []string {
+	return p.catalog.namespaces()
+}
+
+// Invalidate looks a namespace up again in the catalog, or all of them if namespace is empty
+func (p *PGDatabase) Invalidate(namespace string) {
+	p.catalog.forget(namespace)
+}
+
+func (p *PGDatabase) ensureNamespace(namespace string) (string, error) {
+	table, err := p.catalog.ensure(namespace, func(table string) error {
+		_, err := p.db.Exec(fmt.Sprintf(pg_createTableQuery, quoteIdentifier(table)))
+		if err == nil && p.GinIndex {
+			err = p.ensureGinIndex(table)
 		}
-		ret = append(ret, tableName)
+		return err
+	})
+	if err != nil {
+		log.Printf("error creating table: %v\n", err)
+	}
+	return table, err
+}
+
+// ensureGinIndex takes the unquoted table name
+func (p *PGDatabase) ensureGinIndex(table string) (err error) {
+	_, err = p.db.Exec(fmt.Sprintf(pg_ginIndexQuery, quoteIdentifier(ginIndexName(table)), quoteIdentifier(table)))
+	if err != nil {
+		log.Printf("error creating GIN index: %v\n", err)
 	}
-	return ret
+	return err
 }
 
-func (p PGDatabase) ensureNamespace(namespace string) (err error) {
-	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v ( id text PRIMARY KEY, data json NOT NULL)", namespace)
-	_, err = p.db.Exec(query)
+// ginIndexName names the GIN index of a table, hashing the names postgres would truncate
+func ginIndexName(table string) string {
+	name := table + "_data_gin"
+	if len(name) <= catalog_maxIdentifier {
+		return name
+	}
+	return fmt.Sprintf("gin_%x", sha1.Sum([]byte(table)))
+}
 
+// ensureDatabase creates the configured database, connecting to the default maintenance one
+func (p *PGDatabase) ensureDatabase() error {
+	db, err := sql.Open("postgres", p.dsn(pg_maintenanceDb))
 	if err != nil {
-		log.Printf("error creating table: %v\n", err)
+		return err
 	}
+	defer db.Close()
 
+	var exists bool
+	err = db.QueryRow(pg_databaseExistsQuery, p.DbName).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+	log.Printf("creating database %v\n", p.DbName)
+	_, err = db.Exec("CREATE DATABASE " + quoteIdentifier(p.DbName))
 	return err
 }
+
+// pg_migrateToJsonb converts the tables created with a json column by previous versions
+func pg_migrateToJsonb(tx *sql.Tx) error {
+	tables, err := queryStrings(tx, pg_jsonTablesQuery)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		log.Printf("migrating table %v to jsonb\n", table)
+		_, err = tx.Exec(fmt.Sprintf(pg_toJsonbQuery, quoteIdentifier(table)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DSN returns the connection string of the configured database, e.g. to share it with an event bus
+func (p *PGDatabase) DSN() string {
+	return p.dsn(p.DbName)
+}
+
+func (p *PGDatabase) dsn(dbName string) string {
+	port := p.Port
+	if port == 0 {
+		port = pg_defaultPort
+	}
+	sslMode := p.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+
+	params := []string{
+		"user=" + pgQuoteParam(p.User),
+		"password=" + pgQuoteParam(p.Pass),
+		"host=" + pgQuoteParam(p.Host),
+		fmt.Sprintf("port=%v", port),
+		"sslmode=" + pgQuoteParam(sslMode),
+	}
+	optional := [][2]string{
+		{"dbname", dbName},
+		{"sslrootcert", p.SSLRootCert},
+		{"sslcert", p.SSLCert},
+		{"sslkey", p.SSLKey},
+	}
+	for _, param := range optional {
+		if param[1] != "" {
+			params = append(params, param[0]+"="+pgQuoteParam(param[1]))
+		}
+	}
+	if p.ConnectTimeout > 0 {
+		params = append(params, fmt.Sprintf("connect_timeout=%v", int(p.ConnectTimeout.Seconds())))
+	}
+	return strings.Join(params, " ")
+}
+
+// pgQuoteParam quotes a connection string value, see https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-CONNSTRING
+func pgQuoteParam(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
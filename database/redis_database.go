@@ -0,0 +1,197 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	redis_defaultPrefix = "caffeine"
+	redis_nsInfix       = ":ns:"
+	redis_scanCount     = 1000
+)
+
+// RedisDatabase stores every namespace as a hash, <Prefix>:ns:<namespace>, with a field per key
+type RedisDatabase struct {
+	Addr     string
+	Password string
+	DB       int
+	// Prefix namespaces the keys used by caffeine, so the redis db can be shared
+	Prefix string
+
+	client *redis.Client
+}
+
+func (r *RedisDatabase) Init() {
+	if r.Prefix == "" {
+		r.Prefix = redis_defaultPrefix
+	}
+	r.client = redis.NewClient(&redis.Options{
+		Addr:     r.Addr,
+		Password: r.Password,
+		DB:       r.DB,
+	})
+	err := r.client.Ping(context.Background()).Err()
+	if err != nil {
+		log.Fatalf("error connecting to redis: %v", err)
+	}
+}
+
+// Client returns the connection, e.g. to share it with a pub/sub event bus
+func (r *RedisDatabase) Client() *redis.Client {
+	return r.client
+}
+
+func (r *RedisDatabase) Close() error {
+	if r.client == nil {
+		return nil
+	}
+	return r.client.Close()
+}
+
+func (r *RedisDatabase) Upsert(namespace string, key string, value []byte) *DbError {
+	return r.UpsertBatch(namespace, map[string][]byte{key: value})
+}
+
+// UpsertBatch writes all the values with a single, atomic, HSET
+func (r *RedisDatabase) UpsertBatch(namespace string, values map[string][]byte) *DbError {
+	// HSET needs at least a field
+	if len(values) == 0 {
+		return nil
+	}
+	fields := make([]interface{}, 0, 2*len(values))
+	for key, value := range values {
+		fields = append(fields, key, value)
+	}
+	err := r.client.HSet(context.Background(), r.hashKey(namespace), fields...).Err()
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Upsert: %v", err),
+		}
+	}
+	return nil
+}
+
+func (r *RedisDatabase) Get(namespace string, key string) ([]byte, *DbError) {
+	value, err := r.client.HGet(context.Background(), r.hashKey(namespace), key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, r.notFound(namespace, key)
+	}
+	if err != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Get: %v", err),
+		}
+	}
+	return value, nil
+}
+
+// GetAll reads the hash in chunks with HSCAN, not to block redis on big namespaces
+func (r *RedisDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
+	ctx := context.Background()
+	ret := make(map[string][]byte)
+	var cursor uint64
+	for {
+		fields, next, err := r.client.HScan(ctx, r.hashKey(namespace), cursor, "", redis_scanCount).Result()
+		if err != nil {
+			return nil, &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("error on GetAll: %v", err),
+			}
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			ret[fields[i]] = []byte(fields[i+1])
+		}
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+	// redis removes empty hashes, so an empty namespace does not exist
+	if len(ret) == 0 {
+		return nil, namespaceNotFound(namespace)
+	}
+	return ret, nil
+}
+
+func (r *RedisDatabase) Delete(namespace string, key string) *DbError {
+	deleted, err := r.client.HDel(context.Background(), r.hashKey(namespace), key).Result()
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Delete: %v", err),
+		}
+	}
+	if deleted == 0 {
+		return r.notFound(namespace, key)
+	}
+	return nil
+}
+
+func (r *RedisDatabase) DeleteAll(namespace string) *DbError {
+	deleted, err := r.client.Del(context.Background(), r.hashKey(namespace)).Result()
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on DeleteAll: %v", err),
+		}
+	}
+	if deleted == 0 {
+		return namespaceNotFound(namespace)
+	}
+	return nil
+}
+
+func (r *RedisDatabase) GetNamespaces() []string {
+	ctx := context.Background()
+	prefix := r.Prefix + redis_nsInfix
+	// SCAN can return a key more than once
+	set := make(map[string]bool)
+	iter := r.client.Scan(ctx, 0, escapeGlob(prefix)+"*", redis_scanCount).Iterator()
+	for iter.Next(ctx) {
+		set[strings.TrimPrefix(iter.Val(), prefix)] = true
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("error listing namespaces: %v\n", err)
+	}
+	ret := make([]string, 0, len(set))
+	for namespace := range set {
+		ret = append(ret, namespace)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (r *RedisDatabase) hashKey(namespace string) string {
+	return r.Prefix + redis_nsInfix + namespace
+}
+
+func (r *RedisDatabase) notFound(namespace string, key string) *DbError {
+	exists, err := r.client.Exists(context.Background(), r.hashKey(namespace)).Result()
+	if err == nil && exists == 0 {
+		return namespaceNotFound(namespace)
+	}
+	return &DbError{
+		ErrorCode: ID_NOT_FOUND,
+		Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+	}
+}
+
+// escapeGlob escapes the characters special to the redis MATCH patterns
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]^\`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
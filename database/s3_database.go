@@ -0,0 +1,291 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	s3_contentType        = "application/json"
+	s3_noSuchKey          = "NoSuchKey"
+	s3_preconditionFailed = "PreconditionFailed"
+	// concurrent GETs of GetAll
+	s3_getAllWorkers = 16
+)
+
+// S3Database stores every document as an object of an S3 compatible bucket, with the
+// same layout as StorageDatabase: <Prefix>/<namespace>/<encoded key>.json
+type S3Database struct {
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	Region    string
+	Secure    bool
+	// Prefix, if set, is the "directory" of the bucket holding the namespaces
+	Prefix string
+	// Transport replaces the default HTTP transport, e.g. to trust a custom CA
+	Transport http.RoundTripper
+
+	client *minio.Client
+}
+
+func (s *S3Database) Init() {
+	var err error
+	s.client, err = minio.New(s.Endpoint, &minio.Options{
+		Creds:     credentials.NewStaticV4(s.AccessKey, s.SecretKey, ""),
+		Secure:    s.Secure,
+		Region:    s.Region,
+		Transport: s.Transport,
+	})
+	if err != nil {
+		log.Fatalf("error connecting to s3: %v", err)
+	}
+
+	ctx := context.Background()
+	exists, err := s.client.BucketExists(ctx, s.Bucket)
+	if err != nil {
+		log.Fatalf("error checking bucket %v: %v", s.Bucket, err)
+	}
+	if !exists {
+		err = s.client.MakeBucket(ctx, s.Bucket, minio.MakeBucketOptions{Region: s.Region})
+		if err != nil {
+			log.Fatalf("error creating bucket %v: %v", s.Bucket, err)
+		}
+	}
+}
+
+func (s *S3Database) Upsert(namespace string, key string, value []byte) *DbError {
+	return s.UpsertIfMatch(namespace, key, value, "")
+}
+
+// UpsertIfMatch only writes the document if its current ETag is version, so
+// concurrent writers can't silently overwrite each other. An empty version writes unconditionally.
+func (s *S3Database) UpsertIfMatch(namespace string, key string, value []byte, version string) *DbError {
+	opts := minio.PutObjectOptions{ContentType: s3_contentType}
+	if version != "" {
+		opts.SetMatchETag(version)
+	}
+	_, err := s.client.PutObject(context.Background(), s.Bucket, s.objectName(namespace, key), bytes.NewReader(value), int64(len(value)), opts)
+	if err != nil {
+		code := minio.ToErrorResponse(err).Code
+		if code == s3_preconditionFailed || (version != "" && code == s3_noSuchKey) {
+			return &DbError{
+				ErrorCode: VERSION_CONFLICT,
+				Message:   fmt.Sprintf("version '%v' of key '%v' in namespace '%v' is not the current one", version, key, namespace),
+			}
+		}
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Upsert: %v", err),
+		}
+	}
+	return nil
+}
+
+func (s *S3Database) Get(namespace string, key string) ([]byte, *DbError) {
+	value, _, dbErr := s.GetVersion(namespace, key)
+	return value, dbErr
+}
+
+// GetVersion returns a document together with its ETag, to be used with UpsertIfMatch
+func (s *S3Database) GetVersion(namespace string, key string) ([]byte, string, *DbError) {
+	object, err := s.client.GetObject(context.Background(), s.Bucket, s.objectName(namespace, key), minio.GetObjectOptions{})
+	if err == nil {
+		defer object.Close()
+		var info minio.ObjectInfo
+		info, err = object.Stat()
+		if err == nil {
+			var value []byte
+			value, err = ioutil.ReadAll(object)
+			if err == nil {
+				return value, info.ETag, nil
+			}
+		}
+	}
+	if minio.ToErrorResponse(err).Code == s3_noSuchKey {
+		if !s.namespaceExists(namespace) {
+			return nil, "", namespaceNotFound(namespace)
+		}
+		return nil, "", &DbError{
+			ErrorCode: ID_NOT_FOUND,
+			Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+		}
+	}
+	return nil, "", &DbError{
+		ErrorCode: INTERNAL_ERROR,
+		Message:   fmt.Sprintf("error on Get: %v", err),
+	}
+}
+
+// GetAll lists the objects of a namespace, then gets them with s3_getAllWorkers
+// concurrent requests: it costs a request per document.
+func (s *S3Database) GetAll(namespace string) (map[string][]byte, *DbError) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var failure *DbError
+	fail := func(dbErr *DbError) {
+		mu.Lock()
+		if failure == nil {
+			failure = dbErr
+		}
+		mu.Unlock()
+		// stops the listing
+		cancel()
+	}
+	ret := make(map[string][]byte)
+	keys := make(chan string)
+	for i := 0; i < s3_getAllWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				value, dbErr := s.Get(namespace, key)
+				if dbErr != nil {
+					if dbErr.ErrorCode != ID_NOT_FOUND {
+						fail(dbErr)
+					}
+					// otherwise deleted while listing
+					continue
+				}
+				mu.Lock()
+				ret[key] = value
+				mu.Unlock()
+			}
+		}()
+	}
+	for object := range s.client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{Prefix: s.namespacePrefix(namespace), Recursive: true}) {
+		if object.Err != nil {
+			if ctx.Err() == nil {
+				fail(&DbError{
+					ErrorCode: INTERNAL_ERROR,
+					Message:   fmt.Sprintf("error on GetAll: %v", object.Err),
+				})
+			}
+			break
+		}
+		key, ok := s.keyOf(namespace, object.Key)
+		if !ok {
+			continue
+		}
+		keys <- key
+	}
+	close(keys)
+	wg.Wait()
+
+	if failure != nil {
+		return nil, failure
+	}
+	if len(ret) == 0 {
+		return nil, namespaceNotFound(namespace)
+	}
+	return ret, nil
+}
+
+func (s *S3Database) Delete(namespace string, key string) *DbError {
+	ctx := context.Background()
+	objectName := s.objectName(namespace, key)
+	// deletes always succeed on S3, even for missing objects
+	_, err := s.client.StatObject(ctx, s.Bucket, objectName, minio.StatObjectOptions{})
+	if minio.ToErrorResponse(err).Code == s3_noSuchKey {
+		if !s.namespaceExists(namespace) {
+			return namespaceNotFound(namespace)
+		}
+		return &DbError{
+			ErrorCode: ID_NOT_FOUND,
+			Message:   fmt.Sprintf("value not found in namespace '%v' for key '%v'", namespace, key),
+		}
+	}
+	if err == nil {
+		err = s.client.RemoveObject(ctx, s.Bucket, objectName, minio.RemoveObjectOptions{})
+	}
+	if err != nil {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on Delete: %v", err),
+		}
+	}
+	return nil
+}
+
+func (s *S3Database) DeleteAll(namespace string) *DbError {
+	if !s.namespaceExists(namespace) {
+		return namespaceNotFound(namespace)
+	}
+	// cancelled on the first error, so the listing and the removal don't block forever
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	objects := s.client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{Prefix: s.namespacePrefix(namespace), Recursive: true})
+	for removeErr := range s.client.RemoveObjects(ctx, s.Bucket, objects, minio.RemoveObjectsOptions{}) {
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on DeleteAll: %v", removeErr.Err),
+		}
+	}
+	return nil
+}
+
+func (s *S3Database) GetNamespaces() []string {
+	ret := make([]string, 0)
+	for object := range s.client.ListObjects(context.Background(), s.Bucket, minio.ListObjectsOptions{Prefix: s.rootPrefix()}) {
+		if object.Err != nil {
+			log.Printf("error listing namespaces: %v\n", object.Err)
+			break
+		}
+		// namespaces are the common prefixes, i.e. the "directories"
+		if strings.HasSuffix(object.Key, "/") {
+			ret = append(ret, strings.TrimSuffix(strings.TrimPrefix(object.Key, s.rootPrefix()), "/"))
+		}
+	}
+	return ret
+}
+
+func (s *S3Database) namespaceExists(namespace string) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for object := range s.client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{Prefix: s.namespacePrefix(namespace), Recursive: true, MaxKeys: 1}) {
+		return object.Err == nil
+	}
+	return false
+}
+
+func (s *S3Database) rootPrefix() string {
+	if s.Prefix == "" {
+		return ""
+	}
+	return strings.Trim(s.Prefix, "/") + "/"
+}
+
+func (s *S3Database) namespacePrefix(namespace string) string {
+	return s.rootPrefix() + namespace + "/"
+}
+
+func (s *S3Database) objectName(namespace string, key string) string {
+	return s.namespacePrefix(namespace) + encodeKey(key) + fs_extension
+}
+
+func (s *S3Database) keyOf(namespace string, objectName string) (string, bool) {
+	name := strings.TrimPrefix(objectName, s.namespacePrefix(namespace))
+	if path.Ext(name) != fs_extension || strings.Contains(name, "/") {
+		return "", false
+	}
+	key, err := decodeKey(strings.TrimSuffix(name, fs_extension))
+	if err != nil {
+		log.Printf("skipping object %v: %v\n", objectName, err)
+		return "", false
+	}
+	return key, true
+}
@@ -0,0 +1,269 @@
+package database
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	catalog_table         = "caffeine_namespaces"
+	catalog_createQuery   = "CREATE TABLE IF NOT EXISTS " + catalog_table + " (namespace text PRIMARY KEY, table_name text NOT NULL UNIQUE)"
+	catalog_selectQuery   = "SELECT namespace, table_name FROM " + catalog_table
+	catalog_insertQuery   = "INSERT INTO " + catalog_table + " (namespace, table_name) VALUES ($1, $2) ON CONFLICT (namespace) DO NOTHING"
+	catalog_deleteQuery   = "DELETE FROM " + catalog_table + " WHERE namespace = $1"
+	catalog_tablePrefix   = "ns_"
+	catalog_maxIdentifier = 63
+)
+
+// sqlCatalog maps namespaces to the tables holding them. Caffeine only ever touches
+// the tables listed in the catalog, and table names are always quoted in queries,
+// so namespaces are isolated from other tables living in the same database.
+type sqlCatalog struct {
+	db *sql.DB
+	// exec runs the writes to the catalog, all of them in a single transaction
+	exec   func(statements ...sqlStatement) error
+	mu     sync.RWMutex
+	tables map[string]string
+	// missing are the namespaces found in no table, not looked up again until forgotten
+	missing map[string]struct{}
+}
+
+// sqlStatement is a query with its arguments
+type sqlStatement struct {
+	query string
+	args  []interface{}
+}
+
+// init loads the catalog, which is created by the first storage migration
+func (c *sqlCatalog) init(db *sql.DB, exec func(statements ...sqlStatement) error) error {
+	c.db = db
+	c.exec = exec
+	return c.load()
+}
+
+func (c *sqlCatalog) load() error {
+	rows, err := c.db.Query(catalog_selectQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tables := make(map[string]string)
+	for rows.Next() {
+		var namespace, table string
+		err = rows.Scan(&namespace, &table)
+		if err != nil {
+			return err
+		}
+		tables[namespace] = table
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.tables = tables
+	c.mu.Unlock()
+	return nil
+}
+
+// table returns the quoted table name of a namespace
+func (c *sqlCatalog) table(namespace string) (string, *DbError) {
+	c.mu.RLock()
+	table, ok := c.tables[namespace]
+	_, missing := c.missing[namespace]
+	c.mu.RUnlock()
+	if !ok && !missing {
+		// it could have been created by another instance sharing the database
+		err := c.load()
+		if err != nil {
+			return "", &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("error on catalog: %v", err),
+			}
+		}
+		c.mu.Lock()
+		table, ok = c.tables[namespace]
+		if !ok {
+			if c.missing == nil {
+				c.missing = make(map[string]struct{})
+			}
+			c.missing[namespace] = struct{}{}
+		}
+		c.mu.Unlock()
+	}
+	if !ok {
+		return "", &DbError{
+			ErrorCode: NAMESPACE_NOT_FOUND,
+			Message:   fmt.Sprintf("namespace '%v' does not exist.", namespace),
+		}
+	}
+	return quoteIdentifier(table), nil
+}
+
+// ensure returns the quoted table name of a namespace, registering it if needed:
+// create is called with the unquoted name of the new table
+func (c *sqlCatalog) ensure(namespace string, create func(table string) error) (string, error) {
+	c.mu.RLock()
+	table, ok := c.tables[namespace]
+	c.mu.RUnlock()
+	if ok {
+		return quoteIdentifier(table), nil
+	}
+
+	table = tableName(namespace)
+	err := create(table)
+	if err != nil {
+		return "", err
+	}
+	err = c.exec(sqlStatement{catalog_insertQuery, []interface{}{namespace, table}})
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.tables[namespace] = table
+	delete(c.missing, namespace)
+	c.mu.Unlock()
+	return quoteIdentifier(table), nil
+}
+
+// forget drops a namespace from the missing ones, or all of them if namespace is empty,
+// e.g. when another instance sharing the database announces a change to it
+func (c *sqlCatalog) forget(namespace string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if namespace == "" {
+		c.missing = nil
+		return
+	}
+	delete(c.missing, namespace)
+}
+
+// drop removes a namespace, running dropQuery on its quoted table name
+// in the same transaction as the removal from the catalog
+func (c *sqlCatalog) drop(namespace string, table string, dropQuery string) error {
+	err := c.exec(
+		sqlStatement{fmt.Sprintf(dropQuery, table), nil},
+		sqlStatement{catalog_deleteQuery, []interface{}{namespace}},
+	)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	delete(c.tables, namespace)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *sqlCatalog) namespaces() []string {
+	err := c.load()
+	if err != nil {
+		log.Printf("error on catalog: %v\n", err)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ret := make([]string, 0, len(c.tables))
+	for namespace := range c.tables {
+		ret = append(ret, namespace)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// rawTables returns the unquoted names of all the namespace tables
+func (c *sqlCatalog) rawTables() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ret := make([]string, 0, len(c.tables))
+	for _, table := range c.tables {
+		ret = append(ret, table)
+	}
+	return ret
+}
+
+// tableName derives a table name from a namespace, hashing the ones too long for an identifier
+func tableName(namespace string) string {
+	name := catalog_tablePrefix + namespace
+	if len(name) <= catalog_maxIdentifier {
+		return name
+	}
+	return fmt.Sprintf("%v%x", catalog_tablePrefix, sha1.Sum([]byte(namespace)))
+}
+
+// quoteIdentifier quotes a table or index name, the same way for postgres and sqlite
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func queryStrings(db queryer, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]string, 0)
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&value)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, value)
+	}
+	return ret, rows.Err()
+}
+
+// queryDocuments reads the documents returned by a query of ids and data, in the order of the query
+func queryDocuments(db queryer, query string, args ...interface{}) ([]Document, *DbError) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on GetRange: %v", err),
+		}
+	}
+	defer rows.Close()
+
+	ret := make([]Document, 0)
+	for rows.Next() {
+		var id, data string
+		err = rows.Scan(&id, &data)
+		if err != nil {
+			return nil, &DbError{
+				ErrorCode: INTERNAL_ERROR,
+				Message:   fmt.Sprintf("scan %v", err),
+			}
+		}
+		ret = append(ret, Document{Key: id, Value: []byte(data)})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on GetRange: %v", err),
+		}
+	}
+	return ret, nil
+}
+
+// execInTx runs some statements in a single transaction
+func execInTx(db *sql.DB, statements ...sqlStatement) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range statements {
+		_, err = tx.Exec(statement.query, statement.args...)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,26 @@
+package database
+
+import "testing"
+
+func Test_UnitTest_CatalogMissing(t *testing.T) {
+	dir := t.TempDir()
+	first, second := &SQLiteDatabase{DirPath: dir}, &SQLiteDatabase{DirPath: dir}
+	first.Init()
+	defer first.Close()
+	second.Init()
+	defer second.Close()
+
+	if _, err := first.Get("notes", "1"); err == nil || err.ErrorCode != NAMESPACE_NOT_FOUND {
+		t.Fatalf("expected namespace not found, got %v", err)
+	}
+	if err := second.Upsert("notes", "1", []byte(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Get("notes", "1"); err == nil || err.ErrorCode != NAMESPACE_NOT_FOUND {
+		t.Fatalf("a missing namespace should not be looked up again, got %v", err)
+	}
+	first.Invalidate("notes")
+	if _, err := first.Get("notes", "1"); err != nil {
+		t.Fatalf("a forgotten namespace should be looked up again: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	migrations_table        = "caffeine_migrations"
+	migrations_createQuery  = "CREATE TABLE IF NOT EXISTS " + migrations_table + " (version integer PRIMARY KEY, description text NOT NULL, applied_at text NOT NULL)"
+	migrations_versionQuery = "SELECT COALESCE(MAX(version), 0) FROM " + migrations_table
+	migrations_insertQuery  = "INSERT INTO " + migrations_table + " (version, description, applied_at) VALUES ($1, $2, $3)"
+)
+
+// sqlMigration is a step of the storage schema of a SQL backend.
+// Migrations are append-only: once released, a migration is never changed, a new one is added instead.
+type sqlMigration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// runMigrations applies the pending migrations, each one in its own transaction.
+// lockQuery, if set, is run first in every transaction to serialize instances migrating the same database.
+// It refuses to run against a database migrated by a newer version.
+func runMigrations(db *sql.DB, migrations []sqlMigration, lockQuery string) error {
+	_, err := db.Exec(migrations_createQuery)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = db.QueryRow(migrations_versionQuery).Scan(&current)
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("storage schema version %v is newer than the latest known (%v), please upgrade caffeine", current, latest)
+	}
+
+	for _, migration := range migrations {
+		if migration.version <= current {
+			continue
+		}
+		err = applyMigration(db, migration, lockQuery)
+		if err != nil {
+			return fmt.Errorf("migration %v (%v): %v", migration.version, migration.description, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, migration sqlMigration, lockQuery string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if lockQuery != "" {
+		_, err = tx.Exec(lockQuery)
+		if err != nil {
+			return err
+		}
+	}
+	// another instance may have applied it while we were waiting
+	var current int
+	err = tx.QueryRow(migrations_versionQuery).Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current >= migration.version {
+		return nil
+	}
+
+	log.Printf("applying storage migration %v: %v\n", migration.version, migration.description)
+	err = migration.up(tx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(migrations_insertQuery, migration.version, migration.description, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// createCatalog is the first migration of every SQL backend: tables created before the catalog
+// existed are adopted as namespaces. legacyTablesQuery must only return the tables named and
+// shaped as those versions created them (a namespace, or its schema, with just id and data).
+func createCatalog(existsQuery string, legacyTablesQuery string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRow(existsQuery).Scan(&exists)
+		if err != nil || exists {
+			return err
+		}
+		_, err = tx.Exec(catalog_createQuery)
+		if err != nil {
+			return err
+		}
+		legacyTables, err := queryStrings(tx, legacyTablesQuery)
+		if err != nil {
+			return err
+		}
+		for _, table := range legacyTables {
+			log.Printf("adopting table '%v' as namespace\n", table)
+			_, err = tx.Exec(catalog_insertQuery, table, table)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
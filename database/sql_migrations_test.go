@@ -0,0 +1,113 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func Test_UnitTest_MigrationsOrder(t *testing.T) {
+	for name, migrations := range map[string][]sqlMigration{"postgres": pg_migrations, "sqlite": sqlite_migrations} {
+		for i := 1; i < len(migrations); i++ {
+			if migrations[i].version <= migrations[i-1].version {
+				t.Errorf("%v: migration %v follows %v", name, migrations[i].version, migrations[i-1].version)
+			}
+		}
+	}
+}
+
+func Test_UnitTest_RunMigrations(t *testing.T) {
+	db, err := sql.Open("sqlite3", t.TempDir()+"/migrations.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var applied []int
+	step := func(version int) sqlMigration {
+		return sqlMigration{version: version, description: "step", up: func(tx *sql.Tx) error {
+			applied = append(applied, version)
+			_, err := tx.Exec("CREATE TABLE step_" + strings.Repeat("x", version) + " (id text)")
+			return err
+		}}
+	}
+	expect := func(label string, want ...int) {
+		t.Helper()
+		if len(applied) != len(want) {
+			t.Fatalf("%v: applied %v, want %v", label, applied, want)
+		}
+		for i := range want {
+			if applied[i] != want[i] {
+				t.Fatalf("%v: applied %v, want %v", label, applied, want)
+			}
+		}
+		applied = nil
+	}
+
+	migrations := []sqlMigration{step(1), step(2)}
+	if err := runMigrations(db, migrations, ""); err != nil {
+		t.Fatal(err)
+	}
+	expect("first run", 1, 2)
+
+	if err := runMigrations(db, migrations, ""); err != nil {
+		t.Fatal(err)
+	}
+	expect("rerun")
+
+	failing := sqlMigration{version: 4, description: "failing", up: func(tx *sql.Tx) error {
+		applied = append(applied, 4)
+		_, err := tx.Exec("CREATE TABLE failed (id text)")
+		if err != nil {
+			return err
+		}
+		return errors.New("boom")
+	}}
+	migrations = append(migrations, step(3), failing, step(5))
+	if err := runMigrations(db, migrations, ""); err == nil {
+		t.Fatal("a failing migration should stop the run")
+	}
+	expect("failing run", 3, 4)
+	var tables int
+	db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'failed'").Scan(&tables)
+	if tables != 0 {
+		t.Fatal("the failed migration was not rolled back")
+	}
+
+	migrations[3] = step(4)
+	if err := runMigrations(db, migrations, ""); err != nil {
+		t.Fatal(err)
+	}
+	expect("resumed run", 4, 5)
+
+	if err := runMigrations(db, migrations[:2], ""); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("a newer storage schema should be refused, got %v", err)
+	}
+}
+
+func Test_UnitTest_GinIndexName(t *testing.T) {
+	if name := ginIndexName("notes"); name != "notes_data_gin" {
+		t.Fatalf("unexpected name %v", name)
+	}
+	long := strings.Repeat("a", catalog_maxIdentifier-len("_data_gin"))
+	if name := ginIndexName(long); name != long+"_data_gin" {
+		t.Fatalf("a name that fits should not be hashed: %v", name)
+	}
+
+	first := ginIndexName(long + "a_one")
+	second := ginIndexName(long + "a_two")
+	if first == second {
+		t.Fatal("names sharing a truncated prefix should not collide")
+	}
+	for _, name := range []string{first, second} {
+		if len(name) > catalog_maxIdentifier || !strings.HasPrefix(name, "gin_") {
+			t.Fatalf("unexpected hashed name %v", name)
+		}
+	}
+	if ginIndexName(long+"a_one") != first {
+		t.Fatal("hashed names should be stable")
+	}
+}
@@ -0,0 +1,48 @@
+package database
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strings"
+)
+
+// uniqueIndexName names the unique index of some fields of a namespace. It's derived
+// from hashes, to fit in an identifier, and starts with uniqueIndexPrefix(namespace).
+func uniqueIndexName(namespace string, fields []string) string {
+	hash := sha1.Sum([]byte(strings.Join(fields, "\x00")))
+	return fmt.Sprintf("%v%x", uniqueIndexPrefix(namespace), hash[:8])
+}
+
+func uniqueIndexPrefix(namespace string) string {
+	hash := sha1.Sum([]byte(namespace))
+	return fmt.Sprintf("u_%x_", hash[:8])
+}
+
+// syncUniqueIndexes creates the indexes of the constraints missing from existing,
+// and drops the ones of the namespace no longer needed
+func syncUniqueIndexes(namespace string, constraints [][]string, existing []string, create func(name string, fields []string) error, drop func(name string) error) error {
+	wanted := make(map[string]bool)
+	for _, fields := range constraints {
+		name := uniqueIndexName(namespace, fields)
+		wanted[name] = true
+		err := create(name, fields)
+		if err != nil {
+			return err
+		}
+	}
+	prefix := uniqueIndexPrefix(namespace)
+	for _, name := range existing {
+		if strings.HasPrefix(name, prefix) && !wanted[name] {
+			err := drop(name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// quoteLiteral quotes a string literal, the same way for postgres and sqlite
+func quoteLiteral(value string) string {
+	return `'` + strings.ReplaceAll(value, `'`, `''`) + `'`
+}
@@ -2,38 +2,129 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	_ "github.com/lib/pq"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 const (
 	sqlite_dbName             = "caffeine"
 	sqlite_insertQuery        = "INSERT INTO %v (id, data) VALUES($1, $2) ON CONFLICT (id) DO UPDATE SET data = $2"
-	sqlite_tablesQuery        = "SELECT  `name` FROM sqlite_master WHERE `type`='table'  ORDER BY name"
+	sqlite_createTableQuery   = "CREATE TABLE IF NOT EXISTS %v ( id string PRIMARY KEY, data string NOT NULL)"
+	sqlite_catalogExistsQuery = "SELECT count(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = '" + catalog_table + "'"
+	sqlite_legacyTablesQuery  = "SELECT m.name FROM sqlite_master m JOIN pragma_table_info(m.name) c WHERE m.type = 'table' AND m.name != '' AND (m.name NOT GLOB '*[^a-zA-Z0-9]*' OR (m.name GLOB '?*_schema' AND substr(m.name, 1, length(m.name) - 7) NOT GLOB '*[^a-zA-Z0-9]*')) GROUP BY m.name HAVING count(*) = 2 AND sum(c.name IN ('id', 'data') AND c.type = 'string') = 2"
 	sqlite_getQuery           = "SELECT data FROM %v WHERE id = $1"
 	sqlite_getAllQuery        = "SELECT id, data FROM %v ORDER BY id"
+	sqlite_getRangeQuery      = "SELECT id, data FROM %v WHERE id >= $1 ORDER BY id LIMIT $2"
 	sqlite_deleteQuery        = "DELETE FROM %v WHERE id = $1"
 	sqlite_dropNamespaceQuery = "DROP TABLE %v"
+	sqlite_uniqueIndexQuery   = "CREATE UNIQUE INDEX IF NOT EXISTS %v ON %v (%v)"
+	sqlite_indexesQuery       = "SELECT name FROM sqlite_master WHERE type = 'index'"
+	sqlite_dropIndexQuery     = "DROP INDEX IF EXISTS %v"
+	// a field compared as text, with the booleans as in postgres, not as 1 and 0
+	sqlite_uniqueTextExpression = "(CASE json_type(data, %v) WHEN 'true' THEN 'true' WHEN 'false' THEN 'false' ELSE CAST(json_extract(data, %v) AS TEXT) END)"
+
+	sqlite_defaultJournalMode = "WAL"
+	sqlite_defaultBusyTimeout = 5 * time.Second
+	sqlite_defaultSynchronous = "NORMAL"
+	sqlite_defaultWriteBatch  = 64
 )
 
+var errSQLiteClosed = errors.New("sqlite database is closed")
+
+var sqlite_migrations = []sqlMigration{
+	{
+		version:     1,
+		description: "namespaces catalog",
+		up:          createCatalog(sqlite_catalogExistsQuery, sqlite_legacyTablesQuery),
+	},
+}
+
 type SQLiteDatabase struct {
 	DirPath string
+
+	// JournalMode is the sqlite journal_mode, WAL lets readers run concurrently with the writer
+	JournalMode string
+	// BusyTimeout is how long a connection waits for a lock before failing with "database is locked"
+	BusyTimeout time.Duration
+	// Synchronous is the sqlite synchronous setting: OFF | NORMAL | FULL | EXTRA
+	Synchronous  string
+	MaxOpenConns int
+	// WriteBatch is the max number of writes committed in a single transaction by the writer
+	WriteBatch int
+
 	db      *sql.DB
+	catalog sqlCatalog
+
+	// writes are serialized through a single goroutine, sqlite allows one writer at a time
+	writes     chan sqliteWrite
+	writerDone chan struct{}
+	writesMu   sync.RWMutex
+	closed     bool
+}
+
+// sqliteWrite is committed atomically, all its statements or none
+type sqliteWrite struct {
+	statements []sqlStatement
+	done       chan error
 }
 
 func (p *SQLiteDatabase) Init() {
-	db, err := sql.Open("sqlite3", fmt.Sprintf("%v/%v", p.DirPath, sqlite_dbName))
+	err := os.MkdirAll(p.DirPath, 0755)
 	if err != nil {
-		log.Fatalf("error connecting to postgres: %v", err)
+		log.Fatalf("error creating sqlite directory: %v", err)
 	}
+	db, err := sql.Open("sqlite3", p.dsn())
+	if err != nil {
+		log.Fatalf("error connecting to sqlite: %v", err)
+	}
+	db.SetMaxOpenConns(p.MaxOpenConns)
 	p.db = db
+
+	err = runMigrations(db, sqlite_migrations, "")
+	if err != nil {
+		log.Fatalf("error on sqlite storage migrations: %v", err)
+	}
+	// the catalog writes go through the writer too
+	err = p.catalog.init(db, p.execAll)
+	if err != nil {
+		log.Fatalf("error on namespaces catalog: %v", err)
+	}
+
+	if p.WriteBatch <= 0 {
+		p.WriteBatch = sqlite_defaultWriteBatch
+	}
+	p.writes = make(chan sqliteWrite, p.WriteBatch)
+	p.writerDone = make(chan struct{})
+	go p.writer()
+}
+
+// Close waits for the queued writes and closes the database
+func (p *SQLiteDatabase) Close() error {
+	p.writesMu.Lock()
+	if p.closed || p.writes == nil {
+		p.writesMu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.writes)
+	p.writesMu.Unlock()
+
+	<-p.writerDone
+	return p.db.Close()
 }
 
-func (p SQLiteDatabase) Upsert(namespace string, key string, value []byte) *DbError {
-	err := p.ensureNamespace(namespace)
+func (p *SQLiteDatabase) Upsert(namespace string, key string, value []byte) *DbError {
+	table, err := p.ensureNamespace(namespace)
 
 	if err != nil {
 		return &DbError{
@@ -41,7 +132,14 @@ func (p SQLiteDatabase) Upsert(namespace string, key string, value []byte) *DbEr
 			Message:   fmt.Sprintf("namespace %v does not exist", namespace),
 		}
 	}
-	_, dbErr := p.db.Exec(fmt.Sprintf(sqlite_insertQuery, namespace), key, string(value))
+	dbErr := p.exec(fmt.Sprintf(sqlite_insertQuery, table), key, string(value))
+	var sqliteErr sqlite3.Error
+	if errors.As(dbErr, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return &DbError{
+			ErrorCode: UNIQUE_VIOLATION,
+			Message:   fmt.Sprintf("error on Upsert: %v", dbErr),
+		}
+	}
 	if dbErr != nil {
 		return &DbError{
 			ErrorCode: INTERNAL_ERROR,
@@ -51,8 +149,12 @@ func (p SQLiteDatabase) Upsert(namespace string, key string, value []byte) *DbEr
 	return nil
 }
 
-func (p SQLiteDatabase) Get(namespace string, key string) ([]byte, *DbError) {
-	rows, dbErr := p.db.Query(fmt.Sprintf(sqlite_getQuery, namespace), key)
+func (p *SQLiteDatabase) Get(namespace string, key string) ([]byte, *DbError) {
+	table, nsErr := p.catalog.table(namespace)
+	if nsErr != nil {
+		return nil, nsErr
+	}
+	rows, dbErr := p.db.Query(fmt.Sprintf(sqlite_getQuery, table), key)
 	if dbErr != nil {
 		return nil, &DbError{
 			ErrorCode: INTERNAL_ERROR,
@@ -77,9 +179,25 @@ func (p SQLiteDatabase) Get(namespace string, key string) ([]byte, *DbError) {
 	}
 }
 
-func (p SQLiteDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
-	sqlStatement := fmt.Sprintf(sqlite_getAllQuery, namespace)
-	rows, dbErr := p.db.Query(sqlStatement)
+func (p *SQLiteDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
+	table, nsErr := p.catalog.table(namespace)
+	if nsErr != nil {
+		return nil, nsErr
+	}
+	return p.query(fmt.Sprintf(sqlite_getAllQuery, table))
+}
+
+func (p *SQLiteDatabase) GetRange(namespace string, from string, limit int) ([]Document, *DbError) {
+	table, nsErr := p.catalog.table(namespace)
+	if nsErr != nil {
+		return nil, nsErr
+	}
+	return queryDocuments(p.db, fmt.Sprintf(sqlite_getRangeQuery, table), from, limit)
+}
+
+// query reads the documents returned by a query of ids and data
+func (p *SQLiteDatabase) query(sqlStatement string, args ...interface{}) (map[string][]byte, *DbError) {
+	rows, dbErr := p.db.Query(sqlStatement, args...)
 	if dbErr != nil {
 		return nil, &DbError{
 			ErrorCode: INTERNAL_ERROR,
@@ -104,8 +222,12 @@ func (p SQLiteDatabase) GetAll(namespace string) (map[string][]byte, *DbError) {
 	return ret, nil
 }
 
-func (p SQLiteDatabase) Delete(namespace string, key string) *DbError {
-	_, err := p.db.Exec(fmt.Sprintf(sqlite_deleteQuery, namespace), key)
+func (p *SQLiteDatabase) Delete(namespace string, key string) *DbError {
+	table, nsErr := p.catalog.table(namespace)
+	if nsErr != nil {
+		return nsErr
+	}
+	err := p.exec(fmt.Sprintf(sqlite_deleteQuery, table), key)
 	if err != nil {
 		message := fmt.Sprintf("error on Delete: %v", err)
 		return &DbError{
@@ -116,9 +238,12 @@ func (p SQLiteDatabase) Delete(namespace string, key string) *DbError {
 	return nil
 }
 
-func (p SQLiteDatabase) DeleteAll(namespace string) *DbError {
-	sqlStatement := fmt.Sprintf(sqlite_dropNamespaceQuery, namespace)
-	_, err := p.db.Exec(sqlStatement)
+func (p *SQLiteDatabase) DeleteAll(namespace string) *DbError {
+	table, nsErr := p.catalog.table(namespace)
+	if nsErr != nil {
+		return nsErr
+	}
+	err := p.catalog.drop(namespace, table, sqlite_dropNamespaceQuery)
 	if err != nil {
 		message := fmt.Sprintf("error on DeleteAll: %v", err)
 		return &DbError{
@@ -129,32 +254,152 @@ func (p SQLiteDatabase) DeleteAll(namespace string) *DbError {
 	return nil
 }
 
-func (p SQLiteDatabase) GetNamespaces() []string {
-	rows, err := p.db.Query(sqlite_tablesQuery)
+// EnsureUnique makes the unique indexes of a namespace match its constraints, each
+// one a list of fields whose values, together, can't be the same in two documents
+func (p *SQLiteDatabase) EnsureUnique(namespace string, constraints [][]string) *DbError {
+	if len(constraints) == 0 {
+		if _, nsErr := p.catalog.table(namespace); nsErr != nil {
+			return nil
+		}
+	}
+	table, err := p.ensureNamespace(namespace)
+	if err == nil {
+		var existing []string
+		existing, err = queryStrings(p.db, sqlite_indexesQuery)
+		if err == nil {
+			err = syncUniqueIndexes(namespace, constraints, existing, func(name string, fields []string) error {
+				expressions := make([]string, len(fields))
+				for i, field := range fields {
+					path := quoteLiteral(`$."` + strings.ReplaceAll(field, `"`, `\"`) + `"`)
+					expressions[i] = fmt.Sprintf(sqlite_uniqueTextExpression, path, path)
+				}
+				return p.exec(fmt.Sprintf(sqlite_uniqueIndexQuery, quoteIdentifier(name), table, strings.Join(expressions, ", ")))
+			}, func(name string) error {
+				return p.exec(fmt.Sprintf(sqlite_dropIndexQuery, quoteIdentifier(name)))
+			})
+		}
+	}
 	if err != nil {
-		log.Printf("error on GetNamespaces: %v\n", err)
+		return &DbError{
+			ErrorCode: INTERNAL_ERROR,
+			Message:   fmt.Sprintf("error on unique indexes: %v", err),
+		}
 	}
-	defer rows.Close()
+	return nil
+}
 
-	ret := make([]string, 0)
-	for rows.Next() {
-		var tableName string
-		err = rows.Scan(&tableName)
-		if err != nil {
-			log.Printf("error on Scan: %v\n", err)
+func (p *SQLiteDatabase) GetNamespaces() []string {
+	return p.catalog.namespaces()
+}
+
+// Invalidate looks a namespace up again in the catalog, or all of them if namespace is empty
+func (p *SQLiteDatabase) Invalidate(namespace string) {
+	p.catalog.forget(namespace)
+}
+
+func (p *SQLiteDatabase) ensureNamespace(namespace string) (string, error) {
+	table, err := p.catalog.ensure(namespace, func(table string) error {
+		return p.exec(fmt.Sprintf(sqlite_createTableQuery, quoteIdentifier(table)))
+	})
+	if err != nil {
+		log.Printf("error creating table: %v\n", err)
+	}
+	return table, err
+}
+
+// exec queues a write and waits for its outcome
+func (p *SQLiteDatabase) exec(query string, args ...interface{}) error {
+	return p.execAll(sqlStatement{query, args})
+}
+
+// execAll queues some statements, committed in the same transaction, and waits for their outcome
+func (p *SQLiteDatabase) execAll(statements ...sqlStatement) error {
+	write := sqliteWrite{statements: statements, done: make(chan error, 1)}
+	p.writesMu.RLock()
+	if p.closed {
+		p.writesMu.RUnlock()
+		return errSQLiteClosed
+	}
+	p.writes <- write
+	p.writesMu.RUnlock()
+	return <-write.done
+}
+
+// writer commits the queued writes in batches: a write waiting in the queue is
+// committed together with the ones already there, up to WriteBatch per transaction
+func (p *SQLiteDatabase) writer() {
+	defer close(p.writerDone)
+	for write := range p.writes {
+		batch := []sqliteWrite{write}
+	collect:
+		for len(batch) < p.WriteBatch {
+			select {
+			case next, ok := <-p.writes:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, next)
+			default:
+				break collect
+			}
 		}
-		ret = append(ret, tableName)
+		p.commit(batch)
 	}
-	return ret
 }
 
-func (p SQLiteDatabase) ensureNamespace(namespace string) (err error) {
-	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v ( id string PRIMARY KEY, data string NOT NULL)", namespace)
-	_, err = p.db.Exec(query)
+func (p *SQLiteDatabase) commit(batch []sqliteWrite) {
+	if len(batch) > 1 {
+		err := p.commitBatch(batch)
+		if err == nil {
+			for _, write := range batch {
+				write.done <- nil
+			}
+			return
+		}
+		// one failing write must not fail the others: retry them one by one
+		log.Printf("error on sqlite write batch, retrying writes individually: %v\n", err)
+	}
+	for _, write := range batch {
+		write.done <- execInTx(p.db, write.statements...)
+	}
+}
 
+func (p *SQLiteDatabase) commitBatch(batch []sqliteWrite) error {
+	tx, err := p.db.Begin()
 	if err != nil {
-		log.Printf("error creating table: %v\n", err)
+		return err
+	}
+	for _, write := range batch {
+		for _, statement := range write.statements {
+			_, err = tx.Exec(statement.query, statement.args...)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *SQLiteDatabase) dsn() string {
+	journalMode := p.JournalMode
+	if journalMode == "" {
+		journalMode = sqlite_defaultJournalMode
+	}
+	busyTimeout := p.BusyTimeout
+	if busyTimeout <= 0 {
+		busyTimeout = sqlite_defaultBusyTimeout
+	}
+	synchronous := p.Synchronous
+	if synchronous == "" {
+		synchronous = sqlite_defaultSynchronous
 	}
 
-	return err
+	params := url.Values{}
+	params.Set("_journal_mode", journalMode)
+	params.Set("_busy_timeout", fmt.Sprintf("%v", busyTimeout.Milliseconds()))
+	params.Set("_synchronous", synchronous)
+	// take the write lock when the transaction starts, instead of failing to upgrade a read lock
+	params.Set("_txlock", "immediate")
+	return "file:" + filepath.Join(p.DirPath, sqlite_dbName) + "?" + params.Encode()
 }
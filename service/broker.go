@@ -21,6 +21,7 @@
 package service
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -46,6 +47,10 @@ type BrokerEvent struct {
 	Namespace string      `json:"namespace"`
 	Key       string      `json:"key,omitempty"`
 	Value     interface{} `json:"value,omitempty"`
+	// Raw are the stored bytes of Value, replicated as they are
+	Raw json.RawMessage `json:"-"`
+	// Truncated tells that Value was dropped, being too large for the event bus
+	Truncated bool `json:"truncated,omitempty"`
 }
 
 func NewServer() (broker *Broker) {
@@ -0,0 +1,342 @@
+package service
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rehacktive/caffeine/database"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// allKeys is the cache slot of GetAll, it can't clash with a document key
+const allKeys = "\x00all"
+
+type CacheOptions struct {
+	// MaxEntries bounds the number of cached results (documents or whole namespaces)
+	MaxEntries int
+	// MaxBytes bounds the total size of the cached values, 0 is unlimited
+	MaxBytes int64
+	// TTL expires the entries, so changes made by other instances are eventually seen. 0 never expires.
+	TTL time.Duration
+}
+
+// CachedDatabase is a read-through LRU cache in front of a Database.
+// Get and GetAll results, including "not found" ones, are cached until the
+// namespace is written through the cache, evicted or expired.
+type CachedDatabase struct {
+	Database
+	options CacheOptions
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]map[string]*list.Element
+	size    int64
+	// every write bumps the generation of its namespace, so a read
+	// started before a write doesn't store its possibly stale result
+	counter     uint64
+	floor       uint64
+	generations map[string]uint64
+}
+
+type cacheEntry struct {
+	namespace string
+	key       string
+	value     []byte
+	all       map[string][]byte
+	dbErr     *database.DbError
+	size      int64
+	expires   time.Time
+}
+
+// the optional capabilities of the cached database, forwarded by the cache
+type cachedVersioning struct{ c *CachedDatabase }
+type cachedBatching struct{ c *CachedDatabase }
+type cachedUniqueness struct{ c *CachedDatabase }
+
+// NewCachedDatabase wraps db with a cache, keeping the optional capabilities of db
+func NewCachedDatabase(db Database, options CacheOptions) Database {
+	c := &CachedDatabase{
+		Database: db,
+		options:  options,
+	}
+	c.Invalidate("")
+
+	_, versioned := db.(VersionedDatabase)
+	_, batch := db.(BatchDatabase)
+	_, unique := db.(UniqueDatabase)
+	v, b, u := cachedVersioning{c}, cachedBatching{c}, cachedUniqueness{c}
+	switch {
+	case versioned && batch && unique:
+		return &struct {
+			*CachedDatabase
+			cachedVersioning
+			cachedBatching
+			cachedUniqueness
+		}{c, v, b, u}
+	case versioned && batch:
+		return &struct {
+			*CachedDatabase
+			cachedVersioning
+			cachedBatching
+		}{c, v, b}
+	case versioned && unique:
+		return &struct {
+			*CachedDatabase
+			cachedVersioning
+			cachedUniqueness
+		}{c, v, u}
+	case batch && unique:
+		return &struct {
+			*CachedDatabase
+			cachedBatching
+			cachedUniqueness
+		}{c, b, u}
+	case versioned:
+		return &struct {
+			*CachedDatabase
+			cachedVersioning
+		}{c, v}
+	case batch:
+		return &struct {
+			*CachedDatabase
+			cachedBatching
+		}{c, b}
+	case unique:
+		return &struct {
+			*CachedDatabase
+			cachedUniqueness
+		}{c, u}
+	}
+	return c
+}
+
+func (c *CachedDatabase) Upsert(namespace string, key string, value []byte) *database.DbError {
+	defer c.invalidate(namespace, key)
+	return c.Database.Upsert(namespace, key, value)
+}
+
+func (c *CachedDatabase) Get(namespace string, key string) ([]byte, *database.DbError) {
+	entry, generation, ok := c.lookup(namespace, key)
+	if ok {
+		return entry.value, entry.dbErr
+	}
+	value, dbErr := c.Database.Get(namespace, key)
+	if dbErr == nil || dbErr.ErrorCode == database.ID_NOT_FOUND || dbErr.ErrorCode == database.NAMESPACE_NOT_FOUND {
+		c.store(&cacheEntry{namespace: namespace, key: key, value: value, dbErr: dbErr, size: int64(len(value))}, generation)
+	}
+	return value, dbErr
+}
+
+func (c *CachedDatabase) GetAll(namespace string) (map[string][]byte, *database.DbError) {
+	entry, generation, ok := c.lookup(namespace, allKeys)
+	if ok {
+		return copyValues(entry.all), entry.dbErr
+	}
+	all, dbErr := c.Database.GetAll(namespace)
+	if dbErr == nil || dbErr.ErrorCode == database.NAMESPACE_NOT_FOUND {
+		// some databases return their internal map, never share it
+		all = copyValues(all)
+		var size int64
+		for key, value := range all {
+			size += int64(len(key) + len(value))
+		}
+		c.store(&cacheEntry{namespace: namespace, key: allKeys, all: all, dbErr: dbErr, size: size}, generation)
+		return copyValues(all), dbErr
+	}
+	return all, dbErr
+}
+
+// uncached returns the cached database, e.g. for the reads never cached, see rangeDatabase
+func (c *CachedDatabase) uncached() Database {
+	return c.Database
+}
+
+func (c *CachedDatabase) Delete(namespace string, key string) *database.DbError {
+	defer c.invalidate(namespace, key)
+	return c.Database.Delete(namespace, key)
+}
+
+func (c *CachedDatabase) DeleteAll(namespace string) *database.DbError {
+	defer c.Invalidate(namespace)
+	return c.Database.DeleteAll(namespace)
+}
+
+func (c *CachedDatabase) Close() error {
+	if closer, ok := c.Database.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Invalidate drops the cached entries of a namespace, or all of them if namespace is empty
+func (c *CachedDatabase) Invalidate(namespace string) {
+	if inner, ok := c.Database.(interface{ Invalidate(namespace string) }); ok {
+		inner.Invalidate(namespace)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.counter++
+	if namespace == "" {
+		c.lru = list.New()
+		c.entries = make(map[string]map[string]*list.Element)
+		c.size = 0
+		c.floor = c.counter
+		c.generations = make(map[string]uint64)
+		return
+	}
+	c.generations[namespace] = c.counter
+	for _, element := range c.entries[namespace] {
+		c.remove(element)
+	}
+}
+
+func (v cachedVersioning) GetVersion(namespace string, key string) ([]byte, string, *database.DbError) {
+	return v.c.Database.(VersionedDatabase).GetVersion(namespace, key)
+}
+
+func (v cachedVersioning) UpsertIfMatch(namespace string, key string, value []byte, version string) *database.DbError {
+	defer v.c.invalidate(namespace, key)
+	return v.c.Database.(VersionedDatabase).UpsertIfMatch(namespace, key, value, version)
+}
+
+func (b cachedBatching) UpsertBatch(namespace string, values map[string][]byte) *database.DbError {
+	defer b.c.Invalidate(namespace)
+	return b.c.Database.(BatchDatabase).UpsertBatch(namespace, values)
+}
+
+func (u cachedUniqueness) EnsureUnique(namespace string, constraints [][]string) *database.DbError {
+	return u.c.Database.(UniqueDatabase).EnsureUnique(namespace, constraints)
+}
+
+// invalidate drops a document, the namespace listing containing it and the
+// "namespace not found" results of the namespace, the write may have created it
+func (c *CachedDatabase) invalidate(namespace string, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.counter++
+	c.generations[namespace] = c.counter
+	for slot, element := range c.entries[namespace] {
+		dbErr := element.Value.(*cacheEntry).dbErr
+		if slot == key || slot == allKeys || (dbErr != nil && dbErr.ErrorCode == database.NAMESPACE_NOT_FOUND) {
+			c.remove(element)
+		}
+	}
+}
+
+// generation must be called with the lock held
+func (c *CachedDatabase) generation(namespace string) uint64 {
+	if generation, ok := c.generations[namespace]; ok && generation > c.floor {
+		return generation
+	}
+	return c.floor
+}
+
+// lookup returns a cached entry or, on a miss, the generation to store the result with
+func (c *CachedDatabase) lookup(namespace string, key string) (*cacheEntry, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	generation := c.generation(namespace)
+	element, ok := c.entries[namespace][key]
+	if !ok {
+		return nil, generation, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.remove(element)
+		return nil, generation, false
+	}
+	c.lru.MoveToFront(element)
+	return entry, generation, true
+}
+
+// store caches an entry read at generation, unless the namespace has been written since
+func (c *CachedDatabase) store(entry *cacheEntry, generation uint64) {
+	if c.options.MaxBytes > 0 && entry.size > c.options.MaxBytes {
+		return
+	}
+	if c.options.TTL > 0 {
+		entry.expires = time.Now().Add(c.options.TTL)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generation(entry.namespace) != generation {
+		return
+	}
+	if element, ok := c.entries[entry.namespace][entry.key]; ok {
+		c.remove(element)
+	}
+	keys, ok := c.entries[entry.namespace]
+	if !ok {
+		keys = make(map[string]*list.Element)
+		c.entries[entry.namespace] = keys
+	}
+	keys[entry.key] = c.lru.PushFront(entry)
+	c.size += entry.size
+
+	for c.lru.Len() > 0 && (c.lru.Len() > c.options.MaxEntries || (c.options.MaxBytes > 0 && c.size > c.options.MaxBytes)) {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove must be called with the lock held
+func (c *CachedDatabase) remove(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	c.lru.Remove(element)
+	c.size -= entry.size
+	delete(c.entries[entry.namespace], entry.key)
+	if len(c.entries[entry.namespace]) == 0 {
+		delete(c.entries, entry.namespace)
+	}
+}
+
+func copyValues(values map[string][]byte) map[string][]byte {
+	if values == nil {
+		return nil
+	}
+	ret := make(map[string][]byte, len(values))
+	for key, value := range values {
+		ret[key] = value
+	}
+	return ret
+}
+
+// schemaCache keeps the compiled JSON schema of every namespace, recompiled when the schema changes
+type schemaCache struct {
+	mu      sync.Mutex
+	schemas map[string]compiledSchema
+}
+
+type compiledSchema struct {
+	hash   [sha256.Size]byte
+	schema *gojsonschema.Schema
+}
+
+func (c *schemaCache) get(namespace string, schemaJson []byte) (*gojsonschema.Schema, error) {
+	hash := sha256.Sum256(schemaJson)
+	c.mu.Lock()
+	cached, ok := c.schemas[namespace]
+	c.mu.Unlock()
+	if ok && cached.hash == hash {
+		return cached.schema, nil
+	}
+
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schemaJson))
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.schemas == nil {
+		c.schemas = make(map[string]compiledSchema)
+	}
+	c.schemas[namespace] = compiledSchema{hash: hash, schema: schema}
+	return schema, nil
+}
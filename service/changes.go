@@ -0,0 +1,411 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rehacktive/caffeine/database"
+)
+
+const (
+	ChangesPattern          = "/changes"
+	NamespaceChangesPattern = "/ns/{namespace:[a-zA-Z0-9]+}/_changes"
+	// ChangesNamespace holds the change feed, internal namespaces start with an underscore
+	ChangesNamespace = "_changes"
+
+	DefaultChangesLimit    = 1000
+	changesCompactInterval = time.Minute
+	changesKeyFormat       = "%020d"
+)
+
+// Change is an entry of the change feed
+type Change struct {
+	Seq       uint64          `json:"seq"`
+	Event     string          `json:"event"`
+	Namespace string          `json:"namespace"`
+	Key       string          `json:"key,omitempty"`
+	User      string          `json:"user_id,omitempty"`
+	Time      time.Time       `json:"time"`
+	Doc       json.RawMessage `json:"doc,omitempty"`
+}
+
+// ChangeFeed records every change in the database itself, in the ChangesNamespace, so
+// clients can poll for what changed since the last sequence number they saw.
+// Sequence numbers are assigned by this instance: it can't share its storage with other
+// instances, so the feed can't be enabled with an event bus.
+type ChangeFeed struct {
+	// Retention drops the changes older than it, 0 keeps them forever
+	Retention time.Duration
+	// MaxChanges bounds the number of changes kept, 0 is unlimited
+	MaxChanges int
+
+	mu     sync.Mutex
+	loaded bool
+	// the changes kept have the keys from oldest to seq, without gaps
+	oldest uint64
+	seq    uint64
+}
+
+// record appends an event to the feed, under the next sequence number
+func (f *ChangeFeed) record(db Database, event BrokerEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.load(db)
+	if err != nil {
+		log.Printf("error loading the change feed, change not recorded: %v\n", err)
+		return
+	}
+
+	change := Change{
+		Seq:       f.seq + 1,
+		Event:     event.Event,
+		Namespace: event.Namespace,
+		Key:       event.Key,
+		User:      event.User,
+		Time:      time.Now().UTC(),
+	}
+	data, _ := json.Marshal(change)
+	dbErr := db.Upsert(ChangesNamespace, changeKey(change.Seq), data)
+	if dbErr != nil {
+		log.Printf("error recording change: %v\n", dbErr)
+		return
+	}
+	f.seq = change.Seq
+}
+
+// load finds the first and last sequence numbers at the first use, it must be called with the lock held
+func (f *ChangeFeed) load(db Database) error {
+	if f.loaded {
+		return nil
+	}
+	oldest, last, err := seqBounds(db, ChangesNamespace)
+	if err != nil {
+		return err
+	}
+	f.oldest, f.seq = oldest, last
+	f.loaded = true
+	return nil
+}
+
+// read returns at most limit changes after since, of a namespace or of all of them, and how many are left.
+// It reads the feed from since onwards, a page at a time, only to the end for a namespace.
+func (f *ChangeFeed) read(db Database, since uint64, namespace string, limit int) ([]Change, int, error) {
+	f.mu.Lock()
+	err := f.load(db)
+	oldest, last := f.oldest, f.seq
+	f.mu.Unlock()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	results := make([]Change, 0)
+	pending := 0
+	from := since + 1
+	if from < oldest {
+		from = oldest
+	}
+	for from <= last {
+		page, err := readChanges(db, from, last, limit)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, change := range page {
+			if change.Seq > last || (namespace != "" && change.Namespace != namespace) {
+				continue
+			}
+			if len(results) == limit {
+				pending++
+				continue
+			}
+			results = append(results, change)
+		}
+		if namespace == "" && len(results) == limit {
+			// no gaps, what's left is counted
+			pending = int(last - results[len(results)-1].Seq)
+			break
+		}
+		from = page[len(page)-1].Seq + 1
+	}
+	return results, pending, nil
+}
+
+// compact applies the retention policy, from the oldest change. The last change is
+// always kept, so the sequence numbers keep growing after a restart.
+func (f *ChangeFeed) compact(db Database) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.load(db)
+	if err != nil {
+		return 0, err
+	}
+	limit := time.Now().Add(-f.Retention)
+	removed := 0
+	for {
+		page, err := readChanges(db, f.oldest, f.seq, DefaultChangesLimit)
+		if err != nil || len(page) == 0 {
+			return removed, err
+		}
+		for _, change := range page {
+			expired := f.Retention > 0 && change.Time.Before(limit)
+			exceeding := f.MaxChanges > 0 && f.seq-change.Seq+1 > uint64(f.MaxChanges)
+			if change.Seq >= f.seq || (!expired && !exceeding) {
+				return removed, nil
+			}
+			dbErr := db.Delete(ChangesNamespace, changeKey(change.Seq))
+			if dbErr != nil && dbErr.ErrorCode != database.ID_NOT_FOUND {
+				return removed, dbErr
+			}
+			f.oldest = change.Seq + 1
+			removed++
+		}
+	}
+}
+
+// seqBounds finds the first and last keys of a namespace with zero padded sequence numbers as
+// keys and no gaps. It's the only read of a whole namespace without a RangeDatabase, at startup:
+// then the pages are read a key at a time. An empty namespace starts from 1.
+func seqBounds(db Database, namespace string) (uint64, uint64, error) {
+	first, dbErr := getRange(db, namespace, changeKey(0), 1)
+	if dbErr != nil && dbErr.ErrorCode != database.NAMESPACE_NOT_FOUND {
+		return 0, 0, dbErr
+	}
+	if len(first) == 0 {
+		return 1, 0, nil
+	}
+	oldest, err := strconv.ParseUint(first[0].Key, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid key '%v' in %v", first[0].Key, namespace)
+	}
+	last, err := lastSeq(db, namespace, oldest)
+	if err != nil {
+		return 0, 0, err
+	}
+	return oldest, last, nil
+}
+
+// lastSeq finds the last key of a namespace with zero padded sequence numbers as keys and no gaps,
+// from the oldest key to the last one: a few reads, looking for the first missing key
+func lastSeq(db Database, namespace string, oldest uint64) (uint64, error) {
+	exists := func(seq uint64) (bool, error) {
+		_, dbErr := db.Get(namespace, changeKey(seq))
+		if dbErr != nil && dbErr.ErrorCode != database.ID_NOT_FOUND {
+			return false, dbErr
+		}
+		return dbErr == nil, nil
+	}
+	// lo exists, hi doesn't
+	lo, step := oldest, uint64(1)
+	hi := lo + step
+	for {
+		ok, err := exists(hi)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+		lo, step = hi, step*2
+		hi = lo + step
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		ok, err := exists(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// readChanges returns at most limit changes from the from sequence number up to last, in order
+func readChanges(db Database, from uint64, last uint64, limit int) ([]Change, error) {
+	values, dbErr := readSeqs(db, ChangesNamespace, from, last, limit)
+	if dbErr != nil {
+		if dbErr.ErrorCode == database.NAMESPACE_NOT_FOUND {
+			return nil, nil
+		}
+		return nil, dbErr
+	}
+	changes := make([]Change, 0, len(values))
+	for _, value := range values {
+		var change Change
+		err := json.Unmarshal(value.Value, &change)
+		if err != nil {
+			log.Printf("skipping invalid change %v: %v\n", value.Key, err)
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// readSeqs reads at most limit documents of a namespace with zero padded sequence numbers as keys,
+// from "from" up to last: with a RangeDatabase in a single read, otherwise a key at a time
+func readSeqs(db Database, namespace string, from uint64, last uint64, limit int) ([]database.Document, *database.DbError) {
+	if ranged, ok := rangeDatabase(db); ok {
+		values, dbErr := ranged.GetRange(namespace, changeKey(from), limit)
+		for i, value := range values {
+			// compared as numbers, sqlite returns them without padding
+			if seq, err := strconv.ParseUint(value.Key, 10, 64); err == nil && seq > last {
+				return values[:i], dbErr
+			}
+		}
+		return values, dbErr
+	}
+	ret := make([]database.Document, 0)
+	for seq := from; seq <= last && len(ret) < limit; seq++ {
+		value, dbErr := db.Get(namespace, changeKey(seq))
+		if dbErr != nil {
+			// e.g. removed in the meantime
+			if dbErr.ErrorCode == database.ID_NOT_FOUND {
+				continue
+			}
+			return nil, dbErr
+		}
+		ret = append(ret, database.Document{Key: changeKey(seq), Value: value})
+	}
+	return ret, nil
+}
+
+// rangeDatabase returns the RangeDatabase behind db, if any: ranges are never cached
+func rangeDatabase(db Database) (RangeDatabase, bool) {
+	if cached, ok := db.(interface{ uncached() Database }); ok {
+		db = cached.uncached()
+	}
+	ranged, ok := db.(RangeDatabase)
+	return ranged, ok
+}
+
+// getRange reads the keys of a namespace from "from" onwards, with a RangeDatabase,
+// otherwise reading the whole namespace
+func getRange(db Database, namespace string, from string, limit int) ([]database.Document, *database.DbError) {
+	if ranged, ok := rangeDatabase(db); ok {
+		return ranged.GetRange(namespace, from, limit)
+	}
+	all, dbErr := db.GetAll(namespace)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	ret := make([]database.Document, 0)
+	for _, key := range sortedKeys(all) {
+		if len(ret) == limit {
+			break
+		}
+		if key >= from {
+			ret = append(ret, database.Document{Key: key, Value: all[key]})
+		}
+	}
+	return ret, nil
+}
+
+// compactEvery runs the compaction periodically, forever
+func (f *ChangeFeed) compactEvery(db Database, interval time.Duration) {
+	for range time.Tick(interval) {
+		removed, err := f.compact(db)
+		if err != nil {
+			log.Printf("error compacting the change feed: %v\n", err)
+		} else if removed > 0 {
+			log.Printf("change feed compacted, %v changes removed\n", removed)
+		}
+	}
+}
+
+// changesHandler lists the changes after the "since" sequence number, of all the
+// namespaces or of one. With include_docs=true every change has the current document.
+func (s *Server) changesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if s.Feed == nil {
+		respondWithError(w, http.StatusNotFound, "the change feed is disabled")
+		return
+	}
+
+	query := r.URL.Query()
+	var since uint64
+	var err error
+	if value := query.Get("since"); value != "" {
+		since, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid since '%v'", value))
+			return
+		}
+	}
+	limit := DefaultChangesLimit
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit '%v'", value))
+			return
+		}
+	}
+	namespace := mux.Vars(r)["namespace"]
+
+	results, pending, err := s.Feed.read(s.db, since, namespace, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if query.Get("include_docs") == "true" {
+		for i, change := range results {
+			if change.Event != EVENT_ITEM_ADDED {
+				continue
+			}
+			// the current document, it may have changed again or be gone
+			doc, dbErr := s.db.Get(change.Namespace, change.Key)
+			if dbErr != nil {
+				continue
+			}
+			doc, err = s.transformRead(change.Namespace, change.Key, doc)
+			if err != nil {
+				log.Printf("error on the read transform of %v/%v, change without document: %v\n", change.Namespace, change.Key, err)
+				continue
+			}
+			results[i].Doc = doc
+		}
+	}
+
+	lastSeq := since
+	if len(results) > 0 {
+		lastSeq = results[len(results)-1].Seq
+	}
+	content, err := json.Marshal(struct {
+		Results []Change `json:"results"`
+		LastSeq uint64   `json:"last_seq"`
+		Pending int      `json:"pending"`
+	}{results, lastSeq, pending})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, string(content))
+}
+
+func changeKey(seq uint64) string {
+	// zero padded, so the keys sort as the sequence numbers
+	return fmt.Sprintf(changesKeyFormat, seq)
+}
+
+// internalNamespace tells the namespaces used by caffeine itself, user namespaces can't start with an underscore
+func internalNamespace(namespace string) bool {
+	return strings.HasPrefix(namespace, "_")
+}
@@ -0,0 +1,250 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	DefaultBusChannel = "caffeine:events"
+
+	// postgres refuses NOTIFY payloads of 8000 bytes or more
+	pgMaxPayload    = 7999
+	pgMinReconnect  = time.Second
+	pgMaxReconnect  = time.Minute
+	busDedupeWindow = 4096
+)
+
+// EventBus fans out the events of a server to all the instances sharing the same storage,
+// so that every instance can notify its own SSE clients
+type EventBus interface {
+	Publish(event []byte) error
+	// Subscribe calls fn for every published event, including the ones published by this instance
+	Subscribe(fn func(event []byte)) error
+}
+
+// sizedBus is implemented by the buses limiting the size of a message
+type sizedBus interface {
+	MaxMessageSize() int
+}
+
+// busMessage is what travels on the bus: the event for the SSE clients, plus what
+// the other instances need to deliver it exactly once and to invalidate their caches
+type busMessage struct {
+	Id        string          `json:"id"`
+	Origin    string          `json:"origin"`
+	Namespace string          `json:"namespace"`
+	Event     json.RawMessage `json:"event,omitempty"`
+}
+
+// busState tracks the messages of a server: the ids it generates and the recent ones it delivered
+type busState struct {
+	instanceId string
+	seq        uint64
+
+	mu     sync.Mutex
+	seen   map[string]struct{}
+	recent []string
+}
+
+// subscribe delivers the events published on the bus by any instance to the local broker
+func (s *Server) subscribe() error {
+	if s.bus.instanceId == "" {
+		s.bus.instanceId = uuid.NewString()
+	}
+	if s.Bus == nil {
+		return nil
+	}
+	return s.Bus.Subscribe(s.dispatch)
+}
+
+// publish sends an event, or a cache invalidation only if event is nil, to every instance.
+// Without a bus, or if the bus fails, only the local clients are notified.
+func (s *Server) publish(namespace string, event *BrokerEvent) {
+	var eventJson []byte
+	if event != nil {
+		eventJson, _ = json.Marshal(event)
+	}
+	if s.Bus == nil {
+		if eventJson != nil {
+			s.broker.Notifier <- eventJson
+		}
+		return
+	}
+
+	message := busMessage{
+		Id:        fmt.Sprintf("%v:%v", s.bus.instanceId, atomic.AddUint64(&s.bus.seq, 1)),
+		Origin:    s.bus.instanceId,
+		Namespace: namespace,
+		Event:     eventJson,
+	}
+	data, _ := json.Marshal(message)
+	if sized, ok := s.Bus.(sizedBus); ok && event != nil && len(data) > sized.MaxMessageSize() {
+		// clients get the event without the document, and can fetch it
+		stripped := *event
+		stripped.Value = nil
+		stripped.Truncated = true
+		message.Event, _ = json.Marshal(stripped)
+		data, _ = json.Marshal(message)
+	}
+	err := s.Bus.Publish(data)
+	if err != nil {
+		log.Printf("error publishing event, notifying local clients only: %v\n", err)
+		if eventJson != nil {
+			s.broker.Notifier <- eventJson
+		}
+	}
+}
+
+// dispatch handles a message received from the bus
+func (s *Server) dispatch(data []byte) {
+	var message busMessage
+	err := json.Unmarshal(data, &message)
+	if err != nil {
+		log.Printf("skipping invalid bus message: %v\n", err)
+		return
+	}
+	if !s.bus.firstDelivery(message.Id) {
+		return
+	}
+	if message.Origin != s.bus.instanceId {
+		// the writing instance already invalidated its own cache
+		if cached, ok := s.db.(interface{ Invalidate(namespace string) }); ok {
+			for _, namespace := range []string{message.Namespace, message.Namespace + MetaId, message.Namespace + SchemaId, message.Namespace + TransformId, message.Namespace + HooksId} {
+				cached.Invalidate(namespace)
+			}
+		}
+		s.uniques.invalidate(message.Namespace)
+		s.refs.invalidate(message.Namespace)
+	}
+	if len(message.Event) > 0 && s.broker != nil {
+		s.broker.Notifier <- message.Event
+	}
+}
+
+func (b *busState) firstDelivery(id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.seen == nil {
+		b.seen = make(map[string]struct{}, busDedupeWindow)
+	}
+	if _, ok := b.seen[id]; ok {
+		return false
+	}
+	if len(b.recent) == busDedupeWindow {
+		delete(b.seen, b.recent[0])
+		b.recent = b.recent[1:]
+	}
+	b.seen[id] = struct{}{}
+	b.recent = append(b.recent, id)
+	return true
+}
+
+// RedisBus is an EventBus on redis pub/sub
+type RedisBus struct {
+	Client  *redis.Client
+	Channel string
+}
+
+func (b *RedisBus) Publish(event []byte) error {
+	return b.Client.Publish(context.Background(), b.channel(), event).Err()
+}
+
+func (b *RedisBus) Subscribe(fn func(event []byte)) error {
+	ctx := context.Background()
+	pubsub := b.Client.Subscribe(ctx, b.channel())
+	// wait for the confirmation, so no event published after Subscribe returns is lost
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		pubsub.Close()
+		return err
+	}
+	go func() {
+		for message := range pubsub.Channel() {
+			fn([]byte(message.Payload))
+		}
+		log.Println("event bus subscription closed")
+	}()
+	return nil
+}
+
+func (b *RedisBus) channel() string {
+	if b.Channel == "" {
+		return DefaultBusChannel
+	}
+	return b.Channel
+}
+
+// PgBus is an EventBus on postgres LISTEN/NOTIFY, for instances sharing a postgres database
+type PgBus struct {
+	DSN     string
+	Channel string
+
+	once sync.Once
+	db   *sql.DB
+	err  error
+}
+
+func (b *PgBus) Publish(event []byte) error {
+	db, err := b.open()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("SELECT pg_notify($1, $2)", b.channel(), string(event))
+	return err
+}
+
+func (b *PgBus) Subscribe(fn func(event []byte)) error {
+	listener := pq.NewListener(b.DSN, pgMinReconnect, pgMaxReconnect, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected:
+			log.Printf("event bus disconnected: %v\n", err)
+		case pq.ListenerEventReconnected:
+			log.Println("event bus reconnected, events published meanwhile were lost")
+		}
+	})
+	err := listener.Listen(b.channel())
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	go func() {
+		for notification := range listener.Notify {
+			// nil after a reconnection
+			if notification != nil {
+				fn([]byte(notification.Extra))
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *PgBus) MaxMessageSize() int {
+	return pgMaxPayload
+}
+
+func (b *PgBus) open() (*sql.DB, error) {
+	b.once.Do(func() {
+		b.db, b.err = sql.Open("postgres", b.DSN)
+	})
+	return b.db, b.err
+}
+
+func (b *PgBus) channel() string {
+	if b.Channel == "" {
+		// a postgres identifier, no colon allowed
+		return "caffeine_events"
+	}
+	return b.Channel
+}
@@ -0,0 +1,242 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rehacktive/caffeine/database"
+)
+
+const (
+	// OutboxNamespace holds the events not yet published to the sink
+	OutboxNamespace = "_outbox"
+
+	DefaultSinkSubject = "caffeine.{namespace}.{event}"
+	natsFlushTimeout   = 5 * time.Second
+	outboxPageSize     = 100
+)
+
+// EventSink publishes the events to an external message bus
+type EventSink interface {
+	// Publish must only return once the bus has the event
+	Publish(subject string, event []byte) error
+}
+
+// Outbox publishes every event to a sink, at least once: the events are first saved in
+// the OutboxNamespace, and only removed once published. If the sink is down they
+// are kept, and published in order when it's back.
+// An event is saved after its write, not in the same transaction: if the instance stops
+// in between, or the event can't be saved, it's never published.
+// Keys are assigned by this instance: several instances sharing the same storage
+// need different databases for their outboxes, or only one of them with a sink.
+type Outbox struct {
+	Sink EventSink
+	// Subject is the subject, or topic, of the events. {namespace} and {event} are replaced by the ones of the event.
+	Subject string
+	// RetryInterval is the wait before publishing again after a failure
+	RetryInterval time.Duration
+
+	once sync.Once
+	db   Database
+	wake chan struct{}
+
+	mu sync.Mutex
+	// the events saved have the keys from oldest to seq, without gaps
+	oldest uint64
+	seq    uint64
+}
+
+type outboxEntry struct {
+	Subject string          `json:"subject"`
+	Event   json.RawMessage `json:"event"`
+}
+
+func (o *Outbox) start(db Database) {
+	o.once.Do(func() {
+		if o.Subject == "" {
+			o.Subject = DefaultSinkSubject
+		}
+		if o.RetryInterval <= 0 {
+			o.RetryInterval = 5 * time.Second
+		}
+		o.db = db
+		o.wake = make(chan struct{}, 1)
+		err := o.load()
+		if err != nil {
+			log.Printf("error loading the outbox: %v\n", err)
+		}
+		go o.relay()
+	})
+}
+
+// add saves an event in the outbox and wakes up the relay
+func (o *Outbox) add(db Database, event BrokerEvent) {
+	o.start(db)
+
+	eventJson, _ := json.Marshal(event)
+	data, _ := json.Marshal(outboxEntry{
+		Subject: o.subject(event),
+		Event:   eventJson,
+	})
+	o.mu.Lock()
+	// keys have no gaps, see lastSeq
+	dbErr := o.db.Upsert(OutboxNamespace, changeKey(o.seq+1), data)
+	if dbErr == nil {
+		o.seq++
+	}
+	o.mu.Unlock()
+	if dbErr != nil {
+		log.Printf("error saving event in the outbox, not published: %v\n", dbErr)
+		return
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// relay publishes the saved events, forever
+func (o *Outbox) relay() {
+	for {
+		err := o.flush()
+		if err != nil {
+			log.Printf("error publishing events, retrying in %v: %v\n", o.RetryInterval, err)
+			time.Sleep(o.RetryInterval)
+			continue
+		}
+		select {
+		case <-o.wake:
+		case <-time.After(o.RetryInterval):
+		}
+	}
+}
+
+// flush publishes the events of the outbox in order, a page at a time, stopping at the first failure
+func (o *Outbox) flush() error {
+	for {
+		seqs, entries, err := o.page()
+		if err != nil || len(seqs) == 0 {
+			return err
+		}
+		for _, seq := range seqs {
+			entry, ok := entries[seq]
+			if ok {
+				err = o.Sink.Publish(entry.Subject, entry.Event)
+				if err != nil {
+					return err
+				}
+			}
+			dbErr := o.db.Delete(OutboxNamespace, changeKey(seq))
+			if dbErr != nil && dbErr.ErrorCode != database.ID_NOT_FOUND {
+				return dbErr
+			}
+			o.mu.Lock()
+			o.oldest = seq + 1
+			o.mu.Unlock()
+		}
+	}
+}
+
+// load finds the first and last keys of the outbox, new events are saved after the last one
+func (o *Outbox) load() error {
+	oldest, last, err := seqBounds(o.db, OutboxNamespace)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	o.oldest, o.seq = oldest, last
+	o.mu.Unlock()
+	return nil
+}
+
+// page returns the sequence numbers of the next events of the outbox, oldest first,
+// and their entries. Invalid entries have a sequence number without entry.
+func (o *Outbox) page() ([]uint64, map[uint64]outboxEntry, error) {
+	o.mu.Lock()
+	oldest, last := o.oldest, o.seq
+	o.mu.Unlock()
+	values, dbErr := readSeqs(o.db, OutboxNamespace, oldest, last, outboxPageSize)
+	if dbErr != nil {
+		if dbErr.ErrorCode == database.NAMESPACE_NOT_FOUND {
+			return nil, nil, nil
+		}
+		return nil, nil, dbErr
+	}
+	seqs := make([]uint64, 0, len(values))
+	entries := make(map[uint64]outboxEntry, len(values))
+	for _, value := range values {
+		// keys are compared as numbers, whatever their padding
+		seq, err := strconv.ParseUint(value.Key, 10, 64)
+		if err != nil {
+			log.Printf("skipping invalid outbox key %v\n", value.Key)
+			continue
+		}
+		seqs = append(seqs, seq)
+		var entry outboxEntry
+		err = json.Unmarshal(value.Value, &entry)
+		if err != nil {
+			log.Printf("dropping invalid outbox entry %v: %v\n", value.Key, err)
+			continue
+		}
+		entries[seq] = entry
+	}
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] < seqs[j]
+	})
+	return seqs, entries, nil
+}
+
+func (o *Outbox) subject(event BrokerEvent) string {
+	return strings.NewReplacer("{namespace}", event.Namespace, "{event}", event.Event).Replace(o.Subject)
+}
+
+// NatsSink publishes the events on NATS
+type NatsSink struct {
+	URL string
+
+	mu   sync.Mutex
+	conn *nats.Conn
+}
+
+func (n *NatsSink) Publish(subject string, event []byte) error {
+	conn, err := n.connect()
+	if err != nil {
+		return err
+	}
+	err = conn.Publish(subject, event)
+	if err != nil {
+		return err
+	}
+	// the server got the event once it answers the flush
+	return conn.FlushTimeout(natsFlushTimeout)
+}
+
+func (n *NatsSink) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn != nil {
+		n.conn.Close()
+	}
+	return nil
+}
+
+func (n *NatsSink) connect() (*nats.Conn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn != nil && !n.conn.IsClosed() {
+		return n.conn, nil
+	}
+	// no buffering while reconnecting: the publish fails, and the event stays in the outbox
+	conn, err := nats.Connect(n.URL, nats.MaxReconnects(-1), nats.ReconnectBufSize(-1))
+	if err != nil {
+		return nil, err
+	}
+	n.conn = conn
+	return conn, nil
+}
@@ -0,0 +1,199 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// ExpandParam lists the references to embed, comma separated, or * for all of them
+	ExpandParam = "expand"
+	// DepthParam is how many levels of references are embedded, 1 if not set
+	DepthParam     = "depth"
+	MaxExpandDepth = 5
+
+	// concurrent Gets of the referenced documents
+	expandWorkers = 8
+)
+
+// expansion is what a request asks to embed
+type expansion struct {
+	fields map[string]bool // nil means all
+	depth  int
+}
+
+// parseExpansion returns the expansion asked by a request, nil if none
+func parseExpansion(r *http.Request) (*expansion, error) {
+	query := r.URL.Query()
+	value := query.Get(ExpandParam)
+	if value == "" {
+		return nil, nil
+	}
+	e := &expansion{depth: 1}
+	if value != "*" {
+		e.fields = make(map[string]bool)
+		for _, field := range strings.Split(value, ",") {
+			e.fields[strings.TrimSpace(field)] = true
+		}
+	}
+	if depth := query.Get(DepthParam); depth != "" {
+		var err error
+		e.depth, err = strconv.Atoi(depth)
+		if err != nil || e.depth < 1 || e.depth > MaxExpandDepth {
+			return nil, fmt.Errorf("invalid depth '%v', it must be between 1 and %v", depth, MaxExpandDepth)
+		}
+	}
+	return e, nil
+}
+
+func (e *expansion) wants(field string) bool {
+	return e.fields == nil || e.fields[field]
+}
+
+type docId struct {
+	namespace string
+	key       string
+}
+
+// expandNode is a document whose references can be expanded
+type expandNode struct {
+	namespace string
+	doc       map[string]interface{}
+	root      string // the key of the document, for the first level only
+}
+
+// expandSlot is a reference to replace with the referenced document
+type expandSlot struct {
+	root   string
+	doc    map[string]interface{}
+	field  string
+	target docId
+}
+
+// expand replaces, in the documents of a namespace, the references declared with
+// RefKeyword by the referenced documents, as returned by GET. The documents
+// referenced at the same level are fetched together, once each; the missing
+// ones are left as keys.
+func (s *Server) expand(namespace string, docs map[string][]byte, e *expansion) error {
+	roots := make(map[string]map[string]interface{})
+	level := make([]expandNode, 0, len(docs))
+	for key, data := range docs {
+		var doc map[string]interface{}
+		if json.Unmarshal(data, &doc) != nil {
+			continue
+		}
+		roots[key] = doc
+		level = append(level, expandNode{namespace: namespace, doc: doc, root: key})
+	}
+
+	refs := make(map[string][]reference)
+	raw := make(map[docId][]byte)
+	changed := make(map[string]bool)
+	for depth := 0; depth < e.depth && len(level) > 0; depth++ {
+		slots := make([]expandSlot, 0)
+		wanted := make(map[docId]bool)
+		for _, node := range level {
+			nodeRefs, ok := refs[node.namespace]
+			if !ok {
+				nodeRefs = s.schemaRefs(node.namespace)
+				refs[node.namespace] = nodeRefs
+			}
+			for _, ref := range nodeRefs {
+				key, ok := node.doc[ref.Field].(string)
+				if !ok || !e.wants(ref.Field) {
+					continue
+				}
+				slot := expandSlot{root: node.root, doc: node.doc, field: ref.Field, target: docId{ref.Ref.Namespace, key}}
+				slots = append(slots, slot)
+				if _, fetched := raw[slot.target]; !fetched {
+					wanted[slot.target] = true
+				}
+			}
+		}
+		s.fetchAll(wanted, raw)
+
+		// every level gets its own copies, so a reference cycle doesn't make a cyclic document
+		fetched := make(map[docId]interface{})
+		level = make([]expandNode, 0)
+		for _, slot := range slots {
+			data, ok := raw[slot.target]
+			if !ok || data == nil {
+				continue
+			}
+			doc, ok := fetched[slot.target]
+			if !ok {
+				if json.Unmarshal(data, &doc) != nil {
+					continue
+				}
+				fetched[slot.target] = doc
+				if object, isObject := doc.(map[string]interface{}); isObject {
+					level = append(level, expandNode{namespace: slot.target.namespace, doc: object})
+				}
+			}
+			slot.doc[slot.field] = doc
+			if slot.root != "" {
+				changed[slot.root] = true
+			}
+		}
+	}
+
+	for key := range changed {
+		data, err := json.Marshal(roots[key])
+		if err != nil {
+			return err
+		}
+		docs[key] = data
+	}
+	return nil
+}
+
+// schemaRefs returns the references declared by the schema of a namespace, if any
+func (s *Server) schemaRefs(namespace string) []reference {
+	schemaJson, dbErr := s.db.Get(namespace+SchemaId, SchemaId)
+	if dbErr != nil {
+		return nil
+	}
+	refs, err := parseRefs(namespace, schemaJson)
+	if err != nil {
+		return nil
+	}
+	return refs
+}
+
+// fetchAll gets the wanted documents concurrently, with the read transforms applied,
+// storing nil for the missing ones
+func (s *Server) fetchAll(wanted map[docId]bool, raw map[docId][]byte) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ids := make(chan docId)
+	for i := 0; i < expandWorkers && i < len(wanted); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				data, dbErr := s.db.Get(id.namespace, id.key)
+				if dbErr == nil {
+					var err error
+					data, err = s.transformRead(id.namespace, id.key, data)
+					if err != nil {
+						data = nil
+					}
+				} else {
+					data = nil
+				}
+				mu.Lock()
+				raw[id] = data
+				mu.Unlock()
+			}
+		}()
+	}
+	for id := range wanted {
+		ids <- id
+	}
+	close(ids)
+	wg.Wait()
+}
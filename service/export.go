@@ -0,0 +1,384 @@
+package service
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rehacktive/caffeine/database"
+)
+
+const (
+	exportExtension  = ".ndjson"
+	maxImportLineLen = 16 * 1048576
+	maxImportSize    = 1024 * 1048576
+)
+
+var identifierRegexp = regexp.MustCompile("^[a-zA-Z0-9]+$")
+
+// ExportRecord is a single NDJSON line of a namespace export.
+// The first line carries the schema of the namespace (if any), the following ones the documents.
+type ExportRecord struct {
+	Key    string          `json:"key,omitempty"`
+	Value  json.RawMessage `json:"value,omitempty"`
+	User   string          `json:"user_id,omitempty"`
+	Schema json.RawMessage `json:"schema,omitempty"`
+	// Transform holds the jq transforms of the namespace, see Transform
+	Transform json.RawMessage `json:"transform,omitempty"`
+	// Hooks holds the scripts of the namespace, see Hooks
+	Hooks json.RawMessage `json:"hooks,omitempty"`
+}
+
+func (s *Server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+
+	records, err := s.exportRecords(namespace)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", namespace+exportExtension))
+	w.WriteHeader(http.StatusOK)
+	err = writeRecords(w, records)
+	if err != nil {
+		log.Println("error sending export: ", err)
+	}
+}
+
+func (s *Server) importHandler(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+	userId := r.Header.Get(USER_HEADER)
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	count, err := s.importNamespace(namespace, r.Body, userId)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, fmt.Sprintf(`{"imported":%v}`, count))
+}
+
+func (s *Server) dumpHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="caffeine.tar"`)
+	w.WriteHeader(http.StatusOK)
+
+	err := s.dump(w)
+	if err != nil {
+		// headers are gone already, the client will get a truncated archive
+		log.Println("error on export: ", err)
+	}
+}
+
+func (s *Server) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	userId := r.Header.Get(USER_HEADER)
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	namespaces, count, err := s.restore(r.Body, func(namespace string, r io.Reader) (int, error) {
+		return s.importNamespace(namespace, r, userId)
+	})
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, fmt.Sprintf(`{"namespaces":%v,"imported":%v}`, namespaces, count))
+}
+
+// exportRecords returns the records of a namespace export: its settings, then its documents sorted by key
+func (s *Server) exportRecords(namespace string) ([]ExportRecord, error) {
+	records := make([]ExportRecord, 0)
+
+	schema, dbErr := s.db.Get(namespace+SchemaId, SchemaId)
+	if dbErr == nil {
+		records = append(records, ExportRecord{Schema: schema})
+	}
+	transform, dbErr := s.db.Get(namespace+TransformId, TransformId)
+	if dbErr == nil {
+		records = append(records, ExportRecord{Transform: transform})
+	}
+	hooks, dbErr := s.db.Get(namespace+HooksId, HooksId)
+	if dbErr == nil {
+		records = append(records, ExportRecord{Hooks: hooks})
+	}
+
+	data, dbErr := s.db.GetAll(namespace)
+	if dbErr != nil {
+		// a schema, a transform or hooks can be defined before any document is stored
+		if len(records) > 0 {
+			return records, nil
+		}
+		return nil, dbErr
+	}
+	meta, _ := s.db.GetAll(namespace + MetaId)
+
+	for _, key := range sortedKeys(data) {
+		record := ExportRecord{
+			Key:   key,
+			Value: data[key],
+		}
+		if metadataJson, ok := meta[key]; ok {
+			var metadata Metadata
+			if json.Unmarshal(metadataJson, &metadata) == nil {
+				record.User = metadata.User
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// writeRecords encodes records as NDJSON, one at a time
+func writeRecords(w io.Writer, records []ExportRecord) error {
+	encoder := json.NewEncoder(w)
+	for _, record := range records {
+		err := encoder.Encode(record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// scanRecords reads an NDJSON export, calling read for every record with its line number
+func scanRecords(r io.Reader, read func(line int, record ExportRecord) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLineLen)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record ExportRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return fmt.Errorf("line %v: %v", line, err)
+		}
+		err = read(line, record)
+		if err != nil {
+			return fmt.Errorf("line %v: %v", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// importNamespace reads an NDJSON export, storing its schema and validating every document against it.
+// The documents are owned by the importing user, whatever the export says.
+// Lines before a failing one are kept: the import is not transactional.
+func (s *Server) importNamespace(namespace string, r io.Reader, userId string) (int, error) {
+	count := 0
+	err := scanRecords(r, func(line int, record ExportRecord) error {
+		if record.Schema != nil {
+			// as POST /schema, the documents already stored must satisfy its unique constraints
+			return s.installSchema(namespace, record.Schema, false)
+		}
+
+		if record.Transform != nil {
+			_, err := compileTransform(record.Transform)
+			if err != nil {
+				return err
+			}
+			dbErr := s.db.Upsert(namespace+TransformId, TransformId, record.Transform)
+			if dbErr != nil {
+				return dbErr
+			}
+			s.Notify(BrokerEvent{
+				Event:     EVENT_TRANSFORM_UPDATED,
+				Namespace: namespace,
+				Value:     record.Transform,
+			})
+			return nil
+		}
+
+		if record.Hooks != nil {
+			_, err := compileHooks(record.Hooks)
+			if err != nil {
+				return err
+			}
+			dbErr := s.db.Upsert(namespace+HooksId, HooksId, record.Hooks)
+			if dbErr != nil {
+				return dbErr
+			}
+			s.Notify(BrokerEvent{
+				Event:     EVENT_HOOKS_UPDATED,
+				Namespace: namespace,
+				Value:     record.Hooks,
+			})
+			return nil
+		}
+
+		if !identifierRegexp.MatchString(record.Key) || record.Value == nil {
+			return errors.New("invalid key or missing value")
+		}
+		gate := s.uniques.gate(namespace)
+		gate.RLock()
+		defer gate.RUnlock()
+		// the referenced namespaces may be imported later, e.g. when restoring a dump
+		parsedData, err := s.validateDocument(namespace, record.Value, false)
+		if err != nil {
+			return err
+		}
+		err = s.writeUnique(namespace, record.Key, parsedData, func() *database.DbError {
+			return s.upsert(namespace, record.Key, record.Value, userId)
+		}, BrokerEvent{
+			Event:     EVENT_ITEM_ADDED,
+			User:      userId,
+			Namespace: namespace,
+			Key:       record.Key,
+			Value:     parsedData,
+			Raw:       record.Value,
+		})
+		if err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// loadNamespace stores an NDJSON export as it is, with its owners: no validation, hooks or
+// transforms, and only the local clients are notified. It's the trusted path of the
+// replication snapshots, whose documents were accepted by the leader, maybe under an older schema.
+func (s *Server) loadNamespace(namespace string, r io.Reader) (int, error) {
+	count := 0
+	err := scanRecords(r, func(line int, record ExportRecord) error {
+		var dbErr *database.DbError
+		event := BrokerEvent{Namespace: namespace}
+		switch {
+		case record.Schema != nil:
+			dbErr = s.db.Upsert(namespace+SchemaId, SchemaId, record.Schema)
+			event.Event, event.Value = EVENT_SCHEMA_UPDATED, record.Schema
+		case record.Transform != nil:
+			dbErr = s.db.Upsert(namespace+TransformId, TransformId, record.Transform)
+			event.Event, event.Value = EVENT_TRANSFORM_UPDATED, record.Transform
+		case record.Hooks != nil:
+			dbErr = s.db.Upsert(namespace+HooksId, HooksId, record.Hooks)
+			event.Event, event.Value = EVENT_HOOKS_UPDATED, record.Hooks
+		default:
+			if !identifierRegexp.MatchString(record.Key) || record.Value == nil {
+				return errors.New("invalid key or missing value")
+			}
+			dbErr = s.upsert(namespace, record.Key, record.Value, record.User)
+			event.Event, event.Key, event.User, event.Value = EVENT_ITEM_ADDED, record.Key, record.User, record.Value
+			count++
+		}
+		if dbErr != nil {
+			return dbErr
+		}
+		s.notifyLocal(event)
+		return nil
+	})
+	return count, err
+}
+
+// dump writes a tar archive with one NDJSON export per namespace. The size of every
+// entry goes in its header, so a namespace is encoded twice: to count, then to write.
+func (s *Server) dump(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, namespace := range s.userNamespaces() {
+		records, err := s.exportRecords(namespace)
+		if err != nil {
+			return err
+		}
+		var size countingWriter
+		err = writeRecords(&size, records)
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:    namespace + exportExtension,
+			Mode:    0644,
+			Size:    size.n,
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		err = writeRecords(tw, records)
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// restore reads every namespace found in a tar archive created by dump, with importer
+func (s *Server) restore(r io.Reader, importer func(namespace string, r io.Reader) (int, error)) (int, int, error) {
+	tr := tar.NewReader(r)
+	namespaces, count := 0, 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return namespaces, count, nil
+		}
+		if err != nil {
+			return namespaces, count, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Base(header.Name)
+		namespace := strings.TrimSuffix(name, exportExtension)
+		if namespace == name || !identifierRegexp.MatchString(namespace) {
+			return namespaces, count, fmt.Errorf("unexpected archive entry '%v'", header.Name)
+		}
+		imported, err := importer(namespace, tr)
+		count += imported
+		if err != nil {
+			return namespaces, count, fmt.Errorf("%v: %v", header.Name, err)
+		}
+		namespaces++
+	}
+}
+
+// userNamespaces lists the namespaces holding documents or a schema, without the internal ones
+func (s *Server) userNamespaces() []string {
+	set := make(map[string]bool)
+	for _, namespace := range s.db.GetNamespaces() {
+		switch {
+		case strings.HasSuffix(namespace, MetaId), internalNamespace(namespace):
+			continue
+		case strings.HasSuffix(namespace, SchemaId):
+			set[strings.TrimSuffix(namespace, SchemaId)] = true
+		case strings.HasSuffix(namespace, TransformId):
+			set[strings.TrimSuffix(namespace, TransformId)] = true
+		case strings.HasSuffix(namespace, HooksId):
+			set[strings.TrimSuffix(namespace, HooksId)] = true
+		default:
+			set[namespace] = true
+		}
+	}
+	namespaces := make([]string, 0, len(set))
+	for namespace := range set {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
@@ -0,0 +1,350 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/gorilla/mux"
+	"github.com/rehacktive/caffeine/database"
+)
+
+const (
+	HooksPattern = "/hooks/{namespace:[a-zA-Z0-9]+}"
+	HooksId      = "_hooks"
+
+	HOOK_BEFORE_WRITE  = "beforeWrite"
+	HOOK_AFTER_WRITE   = "afterWrite"
+	HOOK_BEFORE_DELETE = "beforeDelete"
+	HOOK_AFTER_DELETE  = "afterDelete"
+
+	DefaultHookTimeout = time.Second
+)
+
+var (
+	// ErrHookRejected is returned when a hook throws, i.e. refuses the change
+	ErrHookRejected = errors.New("rejected by hook")
+	// ErrHookTimeout is returned when a hook is interrupted after the HookTimeout
+	ErrHookTimeout = errors.New("hook timed out")
+)
+
+// Hooks is the JavaScript of a namespace. It can define the functions beforeWrite,
+// afterWrite, beforeDelete and afterDelete, called with a context holding namespace, key, user,
+// old (the stored document, null if missing) and new (the document being written).
+// beforeWrite can return the document to store instead of new; throwing rejects the change.
+// Deleting a namespace calls the delete hooks for each of its documents.
+type Hooks struct {
+	Script string `json:"script"`
+}
+
+type compiledHooks struct {
+	hash    [sha256.Size]byte
+	program *goja.Program
+}
+
+// hooksCache keeps the compiled scripts of every namespace, recompiled when they change
+type hooksCache struct {
+	mu    sync.Mutex
+	hooks map[string]*compiledHooks
+}
+
+func (c *hooksCache) get(namespace string, definition []byte) (*compiledHooks, error) {
+	hash := sha256.Sum256(definition)
+	c.mu.Lock()
+	cached, ok := c.hooks[namespace]
+	c.mu.Unlock()
+	if ok && cached.hash == hash {
+		return cached, nil
+	}
+
+	compiled, err := compileHooks(definition)
+	if err != nil {
+		return nil, err
+	}
+	compiled.hash = hash
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hooks == nil {
+		c.hooks = make(map[string]*compiledHooks)
+	}
+	c.hooks[namespace] = compiled
+	return compiled, nil
+}
+
+func compileHooks(definition []byte) (*compiledHooks, error) {
+	var hooks Hooks
+	err := json.Unmarshal(definition, &hooks)
+	if err != nil {
+		return nil, err
+	}
+	program, err := goja.Compile(HooksId, hooks.Script, true)
+	if err != nil {
+		return nil, err
+	}
+	return &compiledHooks{program: program}, nil
+}
+
+// hasHooks tells if a namespace has hooks, to skip reading the old documents when it has none
+func (s *Server) hasHooks(namespace string) bool {
+	_, dbErr := s.db.Get(namespace+HooksId, HooksId)
+	return dbErr == nil
+}
+
+// respondWithHookError answers 400 to the changes refused by a hook, 504 if it timed out
+func respondWithHookError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrHookRejected):
+		respondWithError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrHookTimeout):
+		respondWithError(w, http.StatusGatewayTimeout, err.Error())
+	default:
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// beforeDeleteAll calls beforeDelete for every document of a namespace, any of them can refuse
+// the deletion. It returns the documents, for afterDelete, or nil if the namespace has no hooks.
+func (s *Server) beforeDeleteAll(namespace string, userId string) (map[string][]byte, error) {
+	if !s.hasHooks(namespace) {
+		return nil, nil
+	}
+	docs, dbErr := s.db.GetAll(namespace)
+	if dbErr != nil {
+		// nothing to delete, the deletion reports it
+		return nil, nil
+	}
+	for _, key := range sortedKeys(docs) {
+		_, err := s.runHook(HOOK_BEFORE_DELETE, hookContext{Namespace: namespace, Key: key, User: userId, Old: docs[key]})
+		if err != nil {
+			return nil, fmt.Errorf("key '%v': %w", key, err)
+		}
+	}
+	return docs, nil
+}
+
+// afterDelete calls afterDelete for the deleted documents. They are gone already, so its errors are only logged.
+func (s *Server) afterDelete(namespace string, userId string, docs map[string][]byte) {
+	for _, key := range sortedKeys(docs) {
+		_, err := s.runHook(HOOK_AFTER_DELETE, hookContext{Namespace: namespace, Key: key, User: userId, Old: docs[key]})
+		if err != nil {
+			log.Printf("error on %v hook of namespace '%v': %v\n", HOOK_AFTER_DELETE, namespace, err)
+		}
+	}
+}
+
+// hookContext is what a hook gets as argument
+type hookContext struct {
+	Namespace string
+	Key       string
+	User      string
+	Old       []byte
+	New       []byte
+}
+
+// runHook calls a hook of the namespace, if defined. It returns the document returned by
+// the hook, or ctx.New as modified by it; nil if the hook returned nothing and there is no new document.
+func (s *Server) runHook(hook string, ctx hookContext) ([]byte, error) {
+	definition, dbErr := s.db.Get(ctx.Namespace+HooksId, HooksId)
+	if dbErr != nil {
+		// as for the schemas, not every database tells a missing document apart
+		return ctx.New, nil
+	}
+	compiled, err := s.hooks.get(ctx.Namespace, definition)
+	if err != nil {
+		return nil, fmt.Errorf("hooks of namespace '%v': %v", ctx.Namespace, err)
+	}
+
+	vm := goja.New()
+	timeout := s.HookTimeout
+	if timeout <= 0 {
+		timeout = DefaultHookTimeout
+	}
+	timer := time.AfterFunc(timeout, func() {
+		vm.Interrupt(fmt.Sprintf("%v timed out after %v", hook, timeout))
+	})
+	defer timer.Stop()
+
+	var ret []byte
+	err = s.callHook(vm, compiled.program, hook, ctx, &ret)
+	if err == nil {
+		return ret, nil
+	}
+	var exception *goja.Exception
+	if errors.As(err, &exception) {
+		return nil, fmt.Errorf("%w: %v", ErrHookRejected, exception.Value())
+	}
+	var interrupted *goja.InterruptedError
+	if errors.As(err, &interrupted) {
+		return nil, fmt.Errorf("%w: %v", ErrHookTimeout, interrupted.Value())
+	}
+	return nil, err
+}
+
+func (s *Server) callHook(vm *goja.Runtime, program *goja.Program, hook string, ctx hookContext, ret *[]byte) error {
+	err := vm.Set("caffeine", s.hookHelpers(ctx.User))
+	if err != nil {
+		return err
+	}
+	_, err = vm.RunProgram(program)
+	if err != nil {
+		return err
+	}
+	fn, ok := goja.AssertFunction(vm.Get(hook))
+	if !ok {
+		// not defined, nothing to do
+		*ret = ctx.New
+		return nil
+	}
+
+	parse, _ := goja.AssertFunction(vm.Get("JSON").ToObject(vm).Get("parse"))
+	stringify, _ := goja.AssertFunction(vm.Get("JSON").ToObject(vm).Get("stringify"))
+	toJs := func(data []byte) (goja.Value, error) {
+		if data == nil {
+			return goja.Null(), nil
+		}
+		return parse(goja.Undefined(), vm.ToValue(string(data)))
+	}
+	arg := vm.NewObject()
+	arg.Set("namespace", ctx.Namespace)
+	arg.Set("key", ctx.Key)
+	arg.Set("user", ctx.User)
+	for name, data := range map[string][]byte{"old": ctx.Old, "new": ctx.New} {
+		value, err := toJs(data)
+		if err != nil {
+			return err
+		}
+		arg.Set(name, value)
+	}
+
+	result, err := fn(goja.Undefined(), arg)
+	if err != nil {
+		return err
+	}
+	if goja.IsUndefined(result) || goja.IsNull(result) {
+		result = arg.Get("new")
+		if goja.IsNull(result) {
+			return nil
+		}
+	}
+	data, err := stringify(goja.Undefined(), result)
+	if err != nil {
+		return err
+	}
+	*ret = []byte(data.String())
+	return nil
+}
+
+// hookHelpers gives the hooks access to the database: caffeine.get(namespace, key),
+// caffeine.put(namespace, key, document) and caffeine.delete(namespace, key).
+// Their writes skip the hooks and the transforms, but not the schema validation.
+func (s *Server) hookHelpers(userId string) map[string]interface{} {
+	// an error returned to goja is thrown in the script
+	return map[string]interface{}{
+		"get": func(namespace string, key string) (interface{}, error) {
+			data, dbErr := s.db.Get(namespace, key)
+			if dbErr != nil {
+				return nil, nil
+			}
+			var parsed interface{}
+			err := json.Unmarshal(data, &parsed)
+			return parsed, err
+		},
+		"put": func(namespace string, key string, document interface{}) error {
+			if !identifierRegexp.MatchString(namespace) || !identifierRegexp.MatchString(key) {
+				return fmt.Errorf("invalid namespace '%v' or key '%v'", namespace, key)
+			}
+			data, err := json.Marshal(document)
+			if err != nil {
+				return err
+			}
+			gate := s.uniques.gate(namespace)
+			gate.RLock()
+			defer gate.RUnlock()
+			parsed, err := s.validate(namespace, data)
+			if err != nil {
+				return err
+			}
+			return s.writeUnique(namespace, key, parsed, func() *database.DbError {
+				return s.upsert(namespace, key, data, userId)
+			}, BrokerEvent{
+				Event:     EVENT_ITEM_ADDED,
+				User:      userId,
+				Namespace: namespace,
+				Key:       key,
+				Value:     parsed,
+				Raw:       data,
+			})
+		},
+		"delete": func(namespace string, key string) (bool, error) {
+			err := s.deleteDocument(namespace, key, userId)
+			var dbErr *database.DbError
+			if errors.As(err, &dbErr) && (dbErr.ErrorCode == database.ID_NOT_FOUND || dbErr.ErrorCode == database.NAMESPACE_NOT_FOUND) {
+				return false, nil
+			}
+			return err == nil, err
+		},
+		"log": func(message string) {
+			log.Println("hook:", message)
+		},
+	}
+}
+
+// hooksHandler stores the script sent as body, GET returns it wrapped in Hooks
+func (s *Server) hooksHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"] + HooksId
+
+	switch r.Method {
+	case http.MethodPost:
+		defer r.Body.Close()
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		script, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		data, _ := json.Marshal(Hooks{Script: string(script)})
+		_, err = compileHooks(data)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		dbErr := s.db.Upsert(namespace, HooksId, data)
+		if dbErr != nil {
+			respondWithError(w, http.StatusInternalServerError, dbErr.Error())
+			return
+		}
+		log.Printf("added hooks for namespace '%s'\n", vars["namespace"])
+		s.Notify(BrokerEvent{
+			Event:     EVENT_HOOKS_UPDATED,
+			Namespace: vars["namespace"],
+			Value:     json.RawMessage(data),
+		})
+		respondWithJSON(w, http.StatusCreated, string(data))
+	case http.MethodGet:
+		data, dbErr := s.db.Get(namespace, HooksId)
+		if dbErr != nil {
+			respondWithError(w, http.StatusNotFound, dbErr.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, string(data))
+	case http.MethodDelete:
+		dbErr := s.db.Delete(namespace, HooksId)
+		if dbErr != nil {
+			respondWithError(w, http.StatusNotFound, dbErr.Error())
+			return
+		}
+		s.Notify(BrokerEvent{
+			Event:     EVENT_HOOKS_DELETED,
+			Namespace: vars["namespace"],
+		})
+		respondWithJSON(w, http.StatusAccepted, "{}")
+	}
+}
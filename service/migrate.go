@@ -0,0 +1,170 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+const migrationProgressEvery = 1000
+
+// Migration copies every namespace, including schemas and metadata, from a Database to another one
+type Migration struct {
+	From Database
+	To   Database
+	// DryRun only reports what would be copied
+	DryRun bool
+	// StatePath, if set, records the namespaces already copied so an interrupted migration can be resumed
+	StatePath string
+}
+
+type MigrationReport struct {
+	Namespaces int
+	Keys       int
+	Skipped    int
+}
+
+func (m *Migration) Run() (*MigrationReport, error) {
+	report := &MigrationReport{}
+
+	completed, err := m.loadState()
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := m.From.GetNamespaces()
+	sort.Strings(namespaces)
+
+	for i, namespace := range namespaces {
+		if completed[namespace] {
+			log.Printf("[%v/%v] namespace '%v' already migrated, skipping\n", i+1, len(namespaces), namespace)
+			report.Skipped++
+			continue
+		}
+		data, dbErr := m.From.GetAll(namespace)
+		if dbErr != nil {
+			return report, fmt.Errorf("reading namespace '%v': %v", namespace, dbErr)
+		}
+		if m.DryRun {
+			log.Printf("[%v/%v] namespace '%v': would copy %v keys\n", i+1, len(namespaces), namespace, len(data))
+			report.Namespaces++
+			report.Keys += len(data)
+			continue
+		}
+
+		keys := make([]string, 0, len(data))
+		for key := range data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		if batcher, ok := m.To.(BatchDatabase); ok {
+			for start := 0; start < len(keys); start += migrationProgressEvery {
+				end := start + migrationProgressEvery
+				if end > len(keys) {
+					end = len(keys)
+				}
+				batch := make(map[string][]byte, end-start)
+				for _, key := range keys[start:end] {
+					batch[key] = data[key]
+				}
+				dbErr = batcher.UpsertBatch(namespace, batch)
+				if dbErr != nil {
+					return report, fmt.Errorf("writing '%v' keys %v-%v: %v", namespace, start+1, end, dbErr)
+				}
+				if end < len(keys) {
+					log.Printf("[%v/%v] namespace '%v': %v/%v keys\n", i+1, len(namespaces), namespace, end, len(keys))
+				}
+			}
+		} else {
+			for j, key := range keys {
+				dbErr = m.To.Upsert(namespace, key, data[key])
+				if dbErr != nil {
+					return report, fmt.Errorf("writing '%v/%v': %v", namespace, key, dbErr)
+				}
+				if (j+1)%migrationProgressEvery == 0 {
+					log.Printf("[%v/%v] namespace '%v': %v/%v keys\n", i+1, len(namespaces), namespace, j+1, len(keys))
+				}
+			}
+		}
+		log.Printf("[%v/%v] namespace '%v': copied %v keys\n", i+1, len(namespaces), namespace, len(keys))
+
+		err = m.saveState(namespace)
+		if err != nil {
+			return report, err
+		}
+		report.Namespaces++
+		report.Keys += len(keys)
+	}
+
+	if m.DryRun {
+		return report, nil
+	}
+	return report, m.Verify(namespaces)
+}
+
+// Verify compares the number of keys of every namespace in both databases
+func (m *Migration) Verify(namespaces []string) error {
+	mismatches := make([]string, 0)
+	for _, namespace := range namespaces {
+		from, dbErr := m.From.GetAll(namespace)
+		if dbErr != nil {
+			return fmt.Errorf("verifying namespace '%v': %v", namespace, dbErr)
+		}
+		to, dbErr := m.To.GetAll(namespace)
+		if dbErr != nil {
+			return fmt.Errorf("verifying namespace '%v': %v", namespace, dbErr)
+		}
+		if len(from) != len(to) {
+			mismatches = append(mismatches, fmt.Sprintf("'%v' (%v != %v)", namespace, len(from), len(to)))
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("key count mismatch for namespaces: %v", strings.Join(mismatches, ", "))
+	}
+	log.Printf("verified %v namespaces\n", len(namespaces))
+	return nil
+}
+
+func (m *Migration) loadState() (map[string]bool, error) {
+	completed := make(map[string]bool)
+	if m.StatePath == "" {
+		return completed, nil
+	}
+	file, err := os.Open(m.StatePath)
+	if os.IsNotExist(err) {
+		return completed, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			completed[line] = true
+		}
+	}
+	return completed, scanner.Err()
+}
+
+func (m *Migration) saveState(namespace string) error {
+	if m.StatePath == "" {
+		return nil
+	}
+	file, err := os.OpenFile(m.StatePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintln(file, namespace)
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -30,7 +30,7 @@ func (s *Server) generateOpenAPIMap(namespaces []string) (map[string]interface{}
 	}
 
 	for _, namespace := range namespaces {
-		if strings.HasSuffix(namespace, SchemaId) {
+		if strings.HasSuffix(namespace, SchemaId) || storageNamespace(namespace) {
 			continue
 		}
 
@@ -1,15 +1,24 @@
 package service
 
 import (
+	"database/sql"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os/exec"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/testcontainers/testcontainers-go"
+
+	"github.com/rehacktive/caffeine/database"
+)
+
+const (
+	pgTestDSN     = "user=caffeine password=password host=localhost port=5432 sslmode=disable"
+	pgJsonbTestDb = "caffeine_jsonb"
 )
 
 var httpClient http.Client
@@ -43,22 +52,34 @@ func stopContainers(identifier string) error {
 	return nil
 }
 
+// dockerAvailable tells if docker compose can run the containers of the integration tests
+func dockerAvailable() error {
+	if _, err := exec.LookPath("docker-compose"); err != nil {
+		return err
+	}
+	return exec.Command("docker", "info").Run()
+}
+
 func TestPgIntegration(t *testing.T) {
+	if err := dockerAvailable(); err != nil {
+		t.Skipf("docker is not available: %v", err)
+	}
 	httpClient = http.Client{Timeout: time.Duration(5) * time.Second}
 
 	id, err := setupContainers()
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
 
 	time.Sleep(5 * time.Second)
 
 	// do tests
 	doTests(t)
+	doJsonbTests(t)
 
 	err = stopContainers(id)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
 }
 
@@ -125,3 +146,55 @@ func call(method string, URL string, payload string) (code int, response string,
 	}
 	return resp.StatusCode, string(body), nil
 }
+
+// doJsonbTests runs the storage migrations against tables created by older versions, on the compose database
+func doJsonbTests(t *testing.T) {
+	maintenance, err := sql.Open("postgres", pgTestDSN+" dbname=postgres")
+	checkErr(t, err)
+	defer maintenance.Close()
+	_, err = maintenance.Exec("CREATE DATABASE " + pgJsonbTestDb)
+	checkErr(t, err)
+
+	legacy, err := sql.Open("postgres", pgTestDSN+" dbname="+pgJsonbTestDb)
+	checkErr(t, err)
+	defer legacy.Close()
+	for _, query := range []string{
+		// as created before the catalog
+		"CREATE TABLE IF NOT EXISTS users ( id text PRIMARY KEY, data json NOT NULL)",
+		`INSERT INTO users (id, data) VALUES ('1', '{"name": "jack",  "age": 25}')`,
+		// not created by caffeine, never adopted
+		"CREATE TABLE IF NOT EXISTS app_sessions ( id text PRIMARY KEY, data json NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS orders ( id text PRIMARY KEY, data json, total integer)",
+	} {
+		_, err = legacy.Exec(query)
+		checkErr(t, err)
+	}
+
+	db := &database.PGDatabase{Host: "localhost", User: "caffeine", Pass: "password", DbName: pgJsonbTestDb, GinIndex: true}
+	db.Init()
+
+	checkResponse(t, "adopted namespaces", strings.Join(db.GetNamespaces(), ","), "users")
+
+	var dataType string
+	checkErr(t, legacy.QueryRow("SELECT data_type FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'data'").Scan(&dataType))
+	checkResponse(t, "migrated column", dataType, "jsonb")
+	// jsonb normalizes the documents
+	data, dbErr := db.Get("users", "1")
+	if dbErr != nil {
+		t.Fatalf("error reading a migrated document: %v", dbErr)
+	}
+	checkResponse(t, "migrated document", string(data), `{"age": 25, "name": "jack"}`)
+
+	// namespaces long enough for postgres to truncate "<table>_data_gin" to the same name
+	long := strings.Repeat("a", 58)
+	for _, namespace := range []string{long + "1", long + "2"} {
+		if dbErr := db.Upsert(namespace, "1", []byte(jsonPayload)); dbErr != nil {
+			t.Fatalf("error writing to %v: %v", namespace, dbErr)
+		}
+	}
+	var indexes int
+	checkErr(t, legacy.QueryRow("SELECT count(*) FROM pg_indexes WHERE indexdef LIKE '%USING gin%'").Scan(&indexes))
+	if indexes != 3 {
+		t.Errorf("expected a GIN index on each of the 3 namespaces, got %v", indexes)
+	}
+}
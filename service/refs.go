@@ -0,0 +1,541 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rehacktive/caffeine/database"
+)
+
+const (
+	// RefKeyword declares, in the schema of a namespace, a property holding the key of a document of another namespace
+	RefKeyword = "x-ref"
+
+	ON_DELETE_RESTRICT = "restrict"
+	ON_DELETE_CASCADE  = "cascade"
+	ON_DELETE_NULLIFY  = "nullify"
+)
+
+// Ref is the value of the RefKeyword: the referenced namespace, and what happens to
+// the referencing documents when the referenced one is deleted, restrict if not set
+type Ref struct {
+	Namespace string `json:"namespace"`
+	OnDelete  string `json:"onDelete,omitempty"`
+}
+
+// reference is a field of a namespace referencing another namespace
+type reference struct {
+	Namespace string
+	Field     string
+	Ref
+}
+
+// RestrictError is returned when deleting a document that is still referenced
+type RestrictError struct {
+	Namespace   string
+	Key         string
+	ByNamespace string
+	ByKey       string
+	// Reason is set when the reference can't be nullified
+	Reason string
+}
+
+func (e *RestrictError) Error() string {
+	message := fmt.Sprintf("'%v' of namespace '%v' is referenced by '%v' of namespace '%v'", e.Key, e.Namespace, e.ByKey, e.ByNamespace)
+	if e.Reason != "" {
+		message += ", that can't be nullified: " + e.Reason
+	}
+	return message
+}
+
+// parseRefs returns the references declared on the top level properties of a schema
+func parseRefs(namespace string, schemaJson []byte) ([]reference, error) {
+	var schema struct {
+		Properties map[string]struct {
+			Ref *Ref `json:"x-ref"`
+		} `json:"properties"`
+	}
+	err := json.Unmarshal(schemaJson, &schema)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]reference, 0)
+	for field, property := range schema.Properties {
+		if property.Ref == nil {
+			continue
+		}
+		if !identifierRegexp.MatchString(property.Ref.Namespace) {
+			return nil, fmt.Errorf("%v of '%v': invalid namespace '%v'", RefKeyword, field, property.Ref.Namespace)
+		}
+		switch property.Ref.OnDelete {
+		case "":
+			property.Ref.OnDelete = ON_DELETE_RESTRICT
+		case ON_DELETE_RESTRICT, ON_DELETE_CASCADE, ON_DELETE_NULLIFY:
+		default:
+			return nil, fmt.Errorf("%v of '%v': unknown onDelete '%v'", RefKeyword, field, property.Ref.OnDelete)
+		}
+		refs = append(refs, reference{Namespace: namespace, Field: field, Ref: *property.Ref})
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].Field < refs[j].Field
+	})
+	return refs, nil
+}
+
+// checkRefs verifies that the documents referenced by a document being written exist.
+// Missing or null fields are not checked, "required" makes them mandatory.
+func (s *Server) checkRefs(namespace string, schemaJson []byte, parsed interface{}) error {
+	doc, ok := parsed.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	refs, err := parseRefs(namespace, schemaJson)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		value, ok := doc[ref.Field]
+		if !ok || value == nil {
+			continue
+		}
+		key, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%v: must be a key of namespace '%v'", ref.Field, ref.Ref.Namespace)
+		}
+		if _, dbErr := s.db.Get(ref.Ref.Namespace, key); dbErr != nil {
+			return fmt.Errorf("%v: '%v' not found in namespace '%v'", ref.Field, key, ref.Ref.Namespace)
+		}
+	}
+	return nil
+}
+
+// referencing returns the fields of all the namespaces referencing a namespace
+func (s *Server) referencing(namespace string) ([]reference, error) {
+	ret := make([]reference, 0)
+	for _, schemaNamespace := range s.db.GetNamespaces() {
+		if !strings.HasSuffix(schemaNamespace, SchemaId) {
+			continue
+		}
+		schemaJson, dbErr := s.db.Get(schemaNamespace, SchemaId)
+		if dbErr != nil {
+			continue
+		}
+		refs, err := parseRefs(strings.TrimSuffix(schemaNamespace, SchemaId), schemaJson)
+		if err != nil {
+			return nil, fmt.Errorf("schema of '%v': %v", schemaNamespace, err)
+		}
+		for _, ref := range refs {
+			if ref.Ref.Namespace == namespace {
+				ret = append(ret, ref)
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Namespace+"/"+ret[i].Field < ret[j].Namespace+"/"+ret[j].Field
+	})
+	return ret, nil
+}
+
+// refAction is a change to a referencing document, caused by a delete: it's
+// deleted if Field is empty, otherwise Field is set to null
+type refAction struct {
+	Namespace string
+	Key       string
+	Field     string
+}
+
+// referencingNamespaces returns the namespaces a delete in namespace can change, following the
+// references: the ones referencing it, the ones referencing those, and so on
+func (s *Server) referencingNamespaces(namespace string) ([]string, error) {
+	found := make(map[string]bool)
+	for queue := []string{namespace}; len(queue) > 0; queue = queue[1:] {
+		refs, err := s.referencing(queue[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			if !found[ref.Namespace] {
+				found[ref.Namespace] = true
+				queue = append(queue, ref.Namespace)
+			}
+		}
+	}
+	namespaces := make([]string, 0, len(found))
+	for referencing := range found {
+		namespaces = append(namespaces, referencing)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// lockDelete takes the gates of a delete in namespace, until the returned function is called:
+// the referencing namespaces exclusively, so their references don't change between planDelete
+// and applyDelete, the namespace itself shared with its other writes
+func (s *Server) lockDelete(namespace string) (func(), error) {
+	for {
+		referencing, err := s.referencingNamespaces(namespace)
+		if err != nil {
+			return nil, err
+		}
+		unlock := s.uniques.lockGates(namespace, referencing)
+		// a schema may have added a reference in the meantime
+		current, err := s.referencingNamespaces(namespace)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		if strings.Join(current, ",") == strings.Join(referencing, ",") {
+			return unlock, nil
+		}
+		unlock()
+	}
+}
+
+// deleteDocument deletes a document and applies its references' onDelete, under lockDelete:
+// the referencing documents are changed first, so a failure leaves no dangling reference
+func (s *Server) deleteDocument(namespace string, key string, userId string) error {
+	unlock, err := s.lockDelete(namespace)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, dbErr := s.db.Get(namespace, key); dbErr != nil {
+		return dbErr
+	}
+	actions, err := s.planDelete(namespace, key)
+	if err != nil {
+		return err
+	}
+	err = s.applyDelete(actions, userId)
+	if err != nil {
+		return err
+	}
+	dbErr := s.db.Delete(namespace, key)
+	if dbErr != nil {
+		return dbErr
+	}
+	// metadata may not exist, e.g. when auth is disabled
+	s.db.Delete(namespace+MetaId, key)
+	s.Notify(BrokerEvent{
+		Event:     EVENT_ITEM_DELETED,
+		User:      userId,
+		Namespace: namespace,
+		Key:       key,
+	})
+	return nil
+}
+
+// deleteNamespace is deleteDocument for all the documents of a namespace
+func (s *Server) deleteNamespace(namespace string, userId string) error {
+	unlock, err := s.lockDelete(namespace)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	actions, err := s.planDeleteAll(namespace)
+	if err != nil {
+		return err
+	}
+	err = s.applyDelete(actions, userId)
+	if err != nil {
+		return err
+	}
+	dbErr := s.db.DeleteAll(namespace)
+	if dbErr != nil {
+		return dbErr
+	}
+	// metadata may not exist, e.g. when auth is disabled
+	s.db.DeleteAll(namespace + MetaId)
+	s.Notify(BrokerEvent{
+		Event:     EVENT_NAMESPACE_DELETED,
+		User:      userId,
+		Namespace: namespace,
+	})
+	return nil
+}
+
+// planDelete returns the changes to the referencing documents needed to delete a
+// document, following the cascades, or a RestrictError if the delete isn't allowed.
+// It only reads: with the gates of lockDelete held, a delete restricted anywhere in a
+// cascade leaves everything as it was.
+func (s *Server) planDelete(namespace string, key string) ([]refAction, error) {
+	actions := make([]refAction, 0)
+	visited := map[string]bool{namespace + "/" + key: true}
+	err := s.planReferences(namespace, key, visited, &actions)
+	return actions, err
+}
+
+// planDeleteAll is planDelete for all the documents of a namespace
+func (s *Server) planDeleteAll(namespace string) ([]refAction, error) {
+	actions := make([]refAction, 0)
+	refs, err := s.referencing(namespace)
+	if err != nil || len(refs) == 0 {
+		return actions, err
+	}
+	docs, err := s.namespaceDocuments(namespace)
+	if err != nil {
+		return nil, err
+	}
+	keys := sortedKeys(docs)
+	visited := make(map[string]bool)
+	for _, key := range keys {
+		visited[namespace+"/"+key] = true
+	}
+	for _, key := range keys {
+		err = s.planReferences(namespace, key, visited, &actions)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return actions, nil
+}
+
+func (s *Server) planReferences(namespace string, key string, visited map[string]bool, actions *[]refAction) error {
+	refs, err := s.referencing(namespace)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		keys, err := s.refs.lookup(s.db, ref.Namespace, ref.Field, key)
+		if err != nil {
+			return err
+		}
+		for _, docKey := range keys {
+			id := ref.Namespace + "/" + docKey
+			if visited[id] {
+				// deleted as well
+				continue
+			}
+			switch ref.Ref.OnDelete {
+			case ON_DELETE_CASCADE:
+				visited[id] = true
+				*actions = append(*actions, refAction{Namespace: ref.Namespace, Key: docKey})
+				err = s.planReferences(ref.Namespace, docKey, visited, actions)
+				if err != nil {
+					return err
+				}
+			case ON_DELETE_NULLIFY:
+				action := refAction{Namespace: ref.Namespace, Key: docKey, Field: ref.Field}
+				if _, _, err = s.nullified(action); err != nil {
+					return &RestrictError{Namespace: namespace, Key: key, ByNamespace: ref.Namespace, ByKey: docKey, Reason: err.Error()}
+				}
+				*actions = append(*actions, action)
+			default:
+				return &RestrictError{Namespace: namespace, Key: key, ByNamespace: ref.Namespace, ByKey: docKey}
+			}
+		}
+	}
+	return nil
+}
+
+// nullified returns a referencing document with the field of a nullify action set to null,
+// validated against the schema of its namespace
+func (s *Server) nullified(action refAction) ([]byte, interface{}, error) {
+	data, dbErr := s.db.Get(action.Namespace, action.Key)
+	if dbErr != nil {
+		return nil, nil, dbErr
+	}
+	var doc map[string]interface{}
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc[action.Field] = nil
+	data, _ = json.Marshal(doc)
+	// the other references may point to documents deleted by the same cascade
+	parsed, err := s.validateDocument(action.Namespace, data, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, parsed, nil
+}
+
+// applyDelete runs the changes returned by planDelete, with the gates of lockDelete held, without
+// running the hooks of the referencing namespaces. They run in reverse, the documents referencing
+// a cascaded one first, so a failure midway leaves no dangling reference.
+func (s *Server) applyDelete(actions []refAction, userId string) error {
+	for i := len(actions) - 1; i >= 0; i-- {
+		err := s.applyAction(actions[i], userId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) applyAction(action refAction, userId string) error {
+	if action.Field == "" {
+		dbErr := s.db.Delete(action.Namespace, action.Key)
+		if dbErr != nil {
+			return dbErr
+		}
+		s.db.Delete(action.Namespace+MetaId, action.Key)
+		s.Notify(BrokerEvent{
+			Event:     EVENT_ITEM_DELETED,
+			User:      userId,
+			Namespace: action.Namespace,
+			Key:       action.Key,
+		})
+		return nil
+	}
+	data, parsed, err := s.nullified(action)
+	if err != nil {
+		var dbErr *database.DbError
+		if errors.As(err, &dbErr) && dbErr.ErrorCode == database.ID_NOT_FOUND {
+			// deleted by a cascade
+			return nil
+		}
+		return err
+	}
+	// the document keeps its owner
+	owner := s.owner(action.Namespace, action.Key)
+	return s.writeUnique(action.Namespace, action.Key, parsed, func() *database.DbError {
+		return s.upsert(action.Namespace, action.Key, data, owner)
+	}, BrokerEvent{
+		Event:     EVENT_ITEM_ADDED,
+		User:      userId,
+		Namespace: action.Namespace,
+		Key:       action.Key,
+		Value:     parsed,
+		Raw:       data,
+	})
+}
+
+// refIndexes index the references to other namespaces: for every namespace and field, the keys
+// of the documents referencing each key. An index is built at the first delete needing it, then
+// kept up to date with the changes of this instance and dropped on the ones of other instances.
+type refIndexes struct {
+	mu sync.Mutex
+	// bumped on every change of a namespace, so an index built meanwhile isn't kept
+	versions map[string]uint64
+	indexes  map[string]map[string]*refIndex
+}
+
+type refIndex struct {
+	// for every referenced key, the referencing keys
+	values map[string]map[string]bool
+	// for every referencing key, the referenced key
+	keys map[string]string
+}
+
+func (index *refIndex) add(key string, field string, doc interface{}) {
+	object, ok := doc.(map[string]interface{})
+	if !ok {
+		return
+	}
+	value, ok := object[field].(string)
+	if !ok {
+		return
+	}
+	if index.values[value] == nil {
+		index.values[value] = make(map[string]bool)
+	}
+	index.values[value][key] = true
+	index.keys[key] = value
+}
+
+func (index *refIndex) remove(key string) {
+	value, ok := index.keys[key]
+	if !ok {
+		return
+	}
+	delete(index.values[value], key)
+	if len(index.values[value]) == 0 {
+		delete(index.values, value)
+	}
+	delete(index.keys, key)
+}
+
+// lookup returns the sorted keys of the documents of a namespace whose field references a key
+func (r *refIndexes) lookup(db Database, namespace string, field string, value string) ([]string, error) {
+	r.mu.Lock()
+	index, ok := r.indexes[namespace][field]
+	version := r.versions[namespace]
+	r.mu.Unlock()
+	if !ok {
+		var err error
+		index, err = loadRefIndex(db, namespace, field)
+		if err != nil {
+			return nil, err
+		}
+		r.mu.Lock()
+		if r.versions[namespace] == version {
+			if r.indexes == nil {
+				r.indexes = make(map[string]map[string]*refIndex)
+			}
+			if r.indexes[namespace] == nil {
+				r.indexes[namespace] = make(map[string]*refIndex)
+			}
+			r.indexes[namespace][field] = index
+		}
+		r.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := make([]string, 0, len(index.values[value]))
+	for key := range index.values[value] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func loadRefIndex(db Database, namespace string, field string) (*refIndex, error) {
+	index := &refIndex{values: make(map[string]map[string]bool), keys: make(map[string]string)}
+	all, dbErr := db.GetAll(namespace)
+	if dbErr != nil {
+		// a schema can be defined before any document is stored
+		if !namespaceExists(db, namespace) {
+			return index, nil
+		}
+		return nil, dbErr
+	}
+	for key, data := range all {
+		var doc interface{}
+		if json.Unmarshal(data, &doc) == nil {
+			index.add(key, field, doc)
+		}
+	}
+	return index, nil
+}
+
+// notify keeps the indexes up to date with the changes
+func (r *refIndexes) notify(event BrokerEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bump(event.Namespace)
+	switch event.Event {
+	case EVENT_ITEM_ADDED:
+		doc := eventDocument(event.Value)
+		for field, index := range r.indexes[event.Namespace] {
+			index.remove(event.Key)
+			index.add(event.Key, field, doc)
+		}
+	case EVENT_ITEM_DELETED:
+		for _, index := range r.indexes[event.Namespace] {
+			index.remove(event.Key)
+		}
+	case EVENT_NAMESPACE_DELETED:
+		delete(r.indexes, event.Namespace)
+	}
+}
+
+// invalidate forgets the indexes of a namespace, e.g. when it is changed by another instance
+func (r *refIndexes) invalidate(namespace string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bump(namespace)
+	delete(r.indexes, namespace)
+}
+
+func (r *refIndexes) bump(namespace string) {
+	if r.versions == nil {
+		r.versions = make(map[string]uint64)
+	}
+	r.versions[namespace]++
+}
@@ -0,0 +1,511 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ReplicationSnapshotPattern = "/_replication/snapshot"
+	ReplicationStreamPattern   = "/_replication/stream"
+	ReplicationStatusPattern   = "/_replication/status"
+	ReplicationOffsetHeader    = "X-Replication-Offset"
+	lastEventIdHeader          = "Last-Event-ID"
+
+	DefaultReplicationLogSize = 10000
+	replicationHeartbeat      = 10 * time.Second
+	replicationMaxBackoff     = 30 * time.Second
+	replicationGapEvent       = "gap"
+)
+
+var errReplicationGap = errors.New("the leader no longer has the changes after our offset")
+
+// replicationChange is a write of the leader, as streamed to the followers
+type replicationChange struct {
+	Seq       uint64          `json:"seq"`
+	Event     string          `json:"event"`
+	Namespace string          `json:"namespace"`
+	Key       string          `json:"key,omitempty"`
+	User      string          `json:"user_id,omitempty"`
+	Value     json.RawMessage `json:"value,omitempty"`
+}
+
+// changeLog keeps the last changes of this node in memory, for the followers to catch up from
+// their offset. Offsets are "epoch:seq", the epoch changes at every start so a follower
+// of a restarted leader knows it has to take a new snapshot.
+type changeLog struct {
+	Size int
+
+	mu      sync.Mutex
+	epoch   string
+	seq     uint64
+	changes []replicationChange
+	changed chan struct{}
+}
+
+func (l *changeLog) init() {
+	if l.epoch == "" {
+		l.epoch = uuid.NewString()
+		l.changed = make(chan struct{})
+		if l.Size <= 0 {
+			l.Size = DefaultReplicationLogSize
+		}
+	}
+}
+
+func (l *changeLog) append(event BrokerEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+
+	l.seq++
+	change := replicationChange{
+		Seq:       l.seq,
+		Event:     event.Event,
+		Namespace: event.Namespace,
+		Key:       event.Key,
+		User:      event.User,
+	}
+	change.Value = eventData(event)
+	l.changes = append(l.changes, change)
+	if len(l.changes) > l.Size {
+		l.changes = l.changes[len(l.changes)-l.Size:]
+	}
+	// wake up the streams
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// eventData returns the stored bytes of the value of an event, marshalled only when they aren't known
+func eventData(event BrokerEvent) json.RawMessage {
+	if len(event.Raw) > 0 {
+		return event.Raw
+	}
+	switch raw := event.Value.(type) {
+	case nil:
+		return nil
+	case json.RawMessage:
+		return raw
+	case []byte:
+		return raw
+	}
+	data, _ := json.Marshal(event.Value)
+	return data
+}
+
+func (l *changeLog) offset() (string, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	return l.epoch, l.seq
+}
+
+// since returns the changes after seq and a channel closed at the next change.
+// It fails if some of the changes were already dropped from the log.
+func (l *changeLog) since(seq uint64) ([]replicationChange, <-chan struct{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+
+	oldest := l.seq + 1
+	if len(l.changes) > 0 {
+		oldest = l.changes[0].Seq
+	}
+	if seq+1 < oldest || seq > l.seq {
+		return nil, nil, false
+	}
+	changes := make([]replicationChange, 0, l.seq-seq)
+	for _, change := range l.changes {
+		if change.Seq > seq {
+			changes = append(changes, change)
+		}
+	}
+	return changes, l.changed, true
+}
+
+type connContextKey struct{}
+
+// withConn keeps the connection of the requests in their context, see http.Server.ConnContext
+func withConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// clearDeadlines removes the read and write deadlines set by the server on the connection of a
+// request, that are restored for the next request of the connection (http.ResponseController needs go 1.20)
+func clearDeadlines(r *http.Request) {
+	if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+		conn.SetReadDeadline(time.Time{})
+		conn.SetWriteDeadline(time.Time{})
+	}
+}
+
+func formatOffset(epoch string, seq uint64) string {
+	return fmt.Sprintf("%v:%v", epoch, seq)
+}
+
+func parseOffset(offset string) (string, uint64, error) {
+	i := strings.LastIndex(offset, ":")
+	if i < 0 {
+		return "", 0, fmt.Errorf("invalid replication offset '%v'", offset)
+	}
+	seq, err := strconv.ParseUint(offset[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid replication offset '%v'", offset)
+	}
+	return offset[:i], seq, nil
+}
+
+// replicationSnapshotHandler sends a dump of the whole database, with the offset to stream the changes from.
+// The offset is taken before the dump: changes made meanwhile are streamed again, and applying them twice is harmless.
+func (s *Server) replicationSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	epoch, seq := s.changes.offset()
+	w.Header().Set(ReplicationOffsetHeader, formatOffset(epoch, seq))
+	s.dumpHandler(w, r)
+}
+
+// replicationStreamHandler streams the changes after the offset sent as Last-Event-ID, as server sent events
+func (s *Server) replicationStreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	epoch, seq, err := parseOffset(r.Header.Get(lastEventIdHeader))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error()+", start from a snapshot")
+		return
+	}
+	currentEpoch, _ := s.changes.offset()
+	if _, _, ok := s.changes.since(seq); !ok || epoch != currentEpoch {
+		respondWithError(w, http.StatusGone, errReplicationGap.Error()+", a new snapshot is needed")
+		return
+	}
+
+	// the stream outlives the timeouts of the server
+	clearDeadlines(r)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		changes, changed, ok := s.changes.since(seq)
+		if !ok {
+			// the follower is too slow, it has to start again from a snapshot
+			fmt.Fprintf(w, "event: %v\ndata: {}\n\n", replicationGapEvent)
+			flusher.Flush()
+			return
+		}
+		for _, change := range changes {
+			data, _ := json.Marshal(change)
+			fmt.Fprintf(w, "id: %v\ndata: %s\n\n", formatOffset(epoch, change.Seq), data)
+			seq = change.Seq
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) replicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status := struct {
+		Role      string `json:"role"`
+		Offset    string `json:"offset"`
+		Leader    string `json:"leader,omitempty"`
+		Connected *bool  `json:"connected,omitempty"`
+	}{
+		Role: "leader",
+	}
+	if s.Replica != nil {
+		connected := s.Replica.isConnected()
+		status.Role = "follower"
+		status.Leader = s.Replica.LeaderURL
+		status.Offset = s.Replica.offset()
+		status.Connected = &connected
+	} else {
+		status.Offset = formatOffset(s.changes.offset())
+	}
+	data, _ := json.Marshal(status)
+	respondWithJSON(w, http.StatusOK, string(data))
+}
+
+// readOnly rejects the writes on a follower: they must be sent to the leader
+func (s *Server) readOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+		default:
+			respondWithError(w, http.StatusForbidden, fmt.Sprintf("read-only replica, writes must be sent to the leader %v", s.Replica.LeaderURL))
+		}
+	})
+}
+
+// Replica makes a server follow a leader: it loads a snapshot, then applies the
+// stream of changes, tracking the offset of the last applied one in OffsetPath
+type Replica struct {
+	LeaderURL string
+	// OffsetPath is the file where the replication offset is saved, to resume after a restart
+	OffsetPath string
+	// Token is sent as bearer token, if the leader has auth enabled
+	Token  string
+	Client *http.Client
+
+	mu        sync.Mutex
+	current   string
+	connected bool
+}
+
+func (rp *Replica) run(s *Server) {
+	err := rp.loadOffset()
+	if err != nil {
+		log.Fatalf("error reading the replication offset: %v", err)
+	}
+	backoff := time.Second
+	for {
+		connected, err := rp.sync(s)
+		if errors.Is(err, errReplicationGap) {
+			log.Printf("replication: %v, taking a new snapshot\n", err)
+			rp.setOffset("")
+			continue
+		}
+		if connected {
+			// the leader was reachable, the stream just ended (e.g. it restarted)
+			backoff = time.Second
+		}
+		log.Printf("replication interrupted, retrying in %v: %v\n", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > replicationMaxBackoff {
+			backoff = replicationMaxBackoff
+		}
+	}
+}
+
+// sync brings the local database up to date and keeps it so, until the stream breaks.
+// It tells if the stream was established.
+func (rp *Replica) sync(s *Server) (bool, error) {
+	if rp.offset() == "" {
+		err := rp.snapshot(s)
+		if err != nil {
+			return false, err
+		}
+	}
+	return rp.stream(s)
+}
+
+// snapshot replaces the whole content of the local database with the one of the leader
+func (rp *Replica) snapshot(s *Server) error {
+	resp, err := rp.get(ReplicationSnapshotPattern, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("snapshot: unexpected status %v", resp.Status)
+	}
+	offset := resp.Header.Get(ReplicationOffsetHeader)
+	if _, _, err = parseOffset(offset); err != nil {
+		return err
+	}
+
+	for _, namespace := range s.db.GetNamespaces() {
+		// the internal namespaces, e.g. the change feed, belong to this node
+		if !internalNamespace(namespace) {
+			s.db.DeleteAll(namespace)
+			s.uniques.invalidate(namespace)
+			s.refs.invalidate(namespace)
+		}
+	}
+	namespaces, count, err := s.restore(resp.Body, s.loadNamespace)
+	if err != nil {
+		return fmt.Errorf("snapshot: %v", err)
+	}
+	log.Printf("replication: loaded snapshot of %v namespaces, %v documents, at offset %v\n", namespaces, count, offset)
+	return rp.setOffset(offset)
+}
+
+func (rp *Replica) stream(s *Server) (bool, error) {
+	resp, err := rp.get(ReplicationStreamPattern, rp.offset())
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return false, errReplicationGap
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("stream: unexpected status %v", resp.Status)
+	}
+	rp.setConnected(true)
+	defer rp.setConnected(false)
+
+	var id, event, data string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLineLen)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event == replicationGapEvent {
+				return true, errReplicationGap
+			}
+			if data != "" {
+				var change replicationChange
+				err = json.Unmarshal([]byte(data), &change)
+				if err != nil {
+					return true, err
+				}
+				s.apply(change)
+				err = rp.setOffset(id)
+				if err != nil {
+					return true, err
+				}
+			}
+			id, event, data = "", "", ""
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return true, err
+	}
+	return true, errors.New("stream closed by the leader")
+}
+
+func (rp *Replica) get(path string, offset string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(rp.LeaderURL, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset != "" {
+		req.Header.Set(lastEventIdHeader, offset)
+	}
+	if rp.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+rp.Token)
+	}
+	client := rp.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+func (rp *Replica) offset() string {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.current
+}
+
+func (rp *Replica) isConnected() bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.connected
+}
+
+func (rp *Replica) setConnected(connected bool) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.connected = connected
+}
+
+func (rp *Replica) loadOffset() error {
+	if rp.OffsetPath == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(rp.OffsetPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rp.current = strings.TrimSpace(string(content))
+	return nil
+}
+
+// setOffset records the offset of the last applied change, replacing the file atomically
+func (rp *Replica) setOffset(offset string) error {
+	rp.mu.Lock()
+	rp.current = offset
+	rp.mu.Unlock()
+	if rp.OffsetPath == "" {
+		return nil
+	}
+	tmp := filepath.Join(filepath.Dir(rp.OffsetPath), "."+filepath.Base(rp.OffsetPath)+".tmp")
+	err := ioutil.WriteFile(tmp, []byte(offset), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, rp.OffsetPath)
+}
+
+// apply writes a change of the leader, the same way the leader did, and notifies the local clients:
+// the leader already delivered it to its change feed, webhooks and outbox.
+// Changes can be applied more than once, e.g. the ones made while the snapshot was taken.
+func (s *Server) apply(change replicationChange) {
+	switch change.Event {
+	case EVENT_ITEM_ADDED:
+		s.upsert(change.Namespace, change.Key, change.Value, change.User)
+	case EVENT_ITEM_DELETED:
+		s.db.Delete(change.Namespace, change.Key)
+		s.db.Delete(change.Namespace+MetaId, change.Key)
+	case EVENT_NAMESPACE_DELETED:
+		s.db.DeleteAll(change.Namespace)
+		s.db.DeleteAll(change.Namespace + MetaId)
+	case EVENT_SCHEMA_UPDATED:
+		s.db.Upsert(change.Namespace+SchemaId, SchemaId, change.Value)
+	case EVENT_SCHEMA_DELETED:
+		s.db.Delete(change.Namespace+SchemaId, SchemaId)
+	case EVENT_TRANSFORM_UPDATED:
+		s.db.Upsert(change.Namespace+TransformId, TransformId, change.Value)
+	case EVENT_TRANSFORM_DELETED:
+		s.db.Delete(change.Namespace+TransformId, TransformId)
+	case EVENT_HOOKS_UPDATED:
+		s.db.Upsert(change.Namespace+HooksId, HooksId, change.Value)
+	case EVENT_HOOKS_DELETED:
+		s.db.Delete(change.Namespace+HooksId, HooksId)
+	default:
+		log.Printf("replication: skipping unknown event '%v'\n", change.Event)
+		return
+	}
+	event := BrokerEvent{
+		Event:     change.Event,
+		User:      change.User,
+		Namespace: change.Namespace,
+		Key:       change.Key,
+	}
+	if len(change.Value) > 0 {
+		event.Value = change.Value
+		event.Raw = change.Value
+	}
+	s.notifyLocal(event)
+}
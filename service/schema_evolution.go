@@ -0,0 +1,332 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rehacktive/caffeine/database"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+const (
+	SchemaCheckPattern   = "/schema/{namespace:[a-zA-Z0-9]+}/_check"
+	SchemaMigratePattern = "/schema/{namespace:[a-zA-Z0-9]+}/_migrate"
+	// StrictParam refuses a schema the stored documents don't comply with
+	StrictParam = "strict"
+)
+
+// SchemaReport lists the stored documents of a namespace not complying with a schema
+type SchemaReport struct {
+	Valid   bool              `json:"valid"`
+	Checked int               `json:"checked"`
+	Invalid []InvalidDocument `json:"invalid"`
+}
+
+type InvalidDocument struct {
+	Key    string   `json:"key"`
+	Errors []string `json:"errors"`
+}
+
+// SchemaMigration changes the schema of a namespace, rewriting its documents with the jq
+// program Transform first: it gets every document as input, and $namespace and $key
+type SchemaMigration struct {
+	Schema    json.RawMessage `json:"schema"`
+	Transform string          `json:"transform,omitempty"`
+}
+
+// namespaceDocuments returns all the documents of a namespace, none if it doesn't exist
+func (s *Server) namespaceDocuments(namespace string) (map[string][]byte, error) {
+	all, dbErr := s.db.GetAll(namespace)
+	if dbErr != nil {
+		// not every database tells a missing namespace apart
+		if !namespaceExists(s.db, namespace) {
+			return map[string][]byte{}, nil
+		}
+		return nil, dbErr
+	}
+	return all, nil
+}
+
+// checkSchema validates some documents against a candidate schema of their namespace,
+// with its references and unique constraints. It fails only if the schema itself is invalid.
+func (s *Server) checkSchema(namespace string, schemaJson []byte, docs map[string][]byte) (*SchemaReport, error) {
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schemaJson))
+	if err != nil {
+		return nil, err
+	}
+	_, err = parseRefs(namespace, schemaJson)
+	if err != nil {
+		return nil, err
+	}
+	constraints, err := parseUnique(schemaJson)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &SchemaReport{Valid: true, Invalid: make([]InvalidDocument, 0)}
+	index := newUniqueIndex(constraints)
+	for _, key := range sortedKeys(docs) {
+		report.Checked++
+		errs := make([]string, 0)
+		result, err := schema.Validate(gojsonschema.NewBytesLoader(docs[key]))
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			for _, desc := range result.Errors() {
+				errs = append(errs, desc.String())
+			}
+		}
+		var doc interface{}
+		if json.Unmarshal(docs[key], &doc) == nil {
+			if err := s.checkRefs(namespace, schemaJson, doc); err != nil {
+				errs = append(errs, err.Error())
+			}
+			if conflict := index.conflict(namespace, key, doc); conflict != nil {
+				errs = append(errs, conflict.Error())
+			}
+			index.add(key, doc)
+		}
+		if len(errs) > 0 {
+			report.Valid = false
+			report.Invalid = append(report.Invalid, InvalidDocument{Key: key, Errors: errs})
+		}
+	}
+	return report, nil
+}
+
+// SchemaConflictError is returned when installing strictly a schema the stored documents don't comply with
+type SchemaConflictError struct {
+	Report *SchemaReport
+}
+
+func (e *SchemaConflictError) Error() string {
+	return fmt.Sprintf("%v stored documents don't comply with the schema", len(e.Report.Invalid))
+}
+
+// installSchema checks and stores the schema of a namespace. The stored documents must satisfy its
+// unique constraints and, if strict, the whole schema: no write lands between the checks and the swap.
+// It returns a *UniqueError or a *SchemaConflictError if they don't.
+func (s *Server) installSchema(namespace string, data []byte, strict bool) error {
+	_, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(data))
+	if err != nil {
+		return err
+	}
+	_, err = parseRefs(namespace, data)
+	if err != nil {
+		return err
+	}
+	constraints, err := parseUnique(data)
+	if err != nil {
+		return err
+	}
+
+	gate := s.uniques.gate(namespace)
+	gate.Lock()
+	defer gate.Unlock()
+	if strict {
+		report, err := s.checkStored(namespace, data)
+		if err != nil {
+			return err
+		}
+		if !report.Valid {
+			return &SchemaConflictError{Report: report}
+		}
+	}
+	// the documents already stored must satisfy the new constraints
+	conflict, err := s.duplicates(namespace, constraints)
+	if err != nil {
+		return err
+	}
+	if conflict != nil {
+		return conflict
+	}
+
+	dbErr := s.db.Upsert(namespace+SchemaId, SchemaId, data)
+	if dbErr != nil {
+		return dbErr
+	}
+	log.Printf("added schema for namespace '%s'\n", namespace)
+	s.Notify(BrokerEvent{
+		Event:     EVENT_SCHEMA_UPDATED,
+		Namespace: namespace,
+		Value:     json.RawMessage(data),
+	})
+	return s.syncUnique(namespace)
+}
+
+// checkStored checks the stored documents of a namespace against a candidate schema
+func (s *Server) checkStored(namespace string, schemaJson []byte) (*SchemaReport, error) {
+	docs, err := s.namespaceDocuments(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return s.checkSchema(namespace, schemaJson, docs)
+}
+
+// schemaCheckHandler is a dry run of a schema change: it reports the stored documents
+// the schema sent as body would refuse, without changing anything
+func (s *Server) schemaCheckHandler(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	report, err := s.checkStored(namespace, data)
+	if err != nil {
+		respondWithSchemaError(w, err)
+		return
+	}
+	content, _ := json.Marshal(report)
+	respondWithJSON(w, http.StatusOK, string(content))
+}
+
+// schemaMigrateHandler rewrites the documents of a namespace and swaps its schema. All the
+// rewritten documents must comply with the new schema, otherwise nothing is changed and
+// the report of the invalid ones is returned. The writes to the namespace wait for it to finish,
+// and if a rewrite fails midway the documents already rewritten are restored.
+func (s *Server) schemaMigrateHandler(w http.ResponseWriter, r *http.Request) {
+	userId := r.Header.Get(USER_HEADER)
+	namespace := mux.Vars(r)["namespace"]
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+	var migration SchemaMigration
+	err := json.NewDecoder(r.Body).Decode(&migration)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(migration.Schema) == 0 {
+		respondWithError(w, http.StatusBadRequest, "a migration needs a schema")
+		return
+	}
+	code, err := compileProgram(migration.Transform)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("transform: %v", err))
+		return
+	}
+
+	gate := s.uniques.gate(namespace)
+	gate.Lock()
+	defer gate.Unlock()
+	originals, err := s.namespaceDocuments(namespace)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	docs := originals
+	migrated := 0
+	if code != nil {
+		migrated = len(originals)
+		docs = make(map[string][]byte, len(originals))
+		for key, data := range originals {
+			docs[key], err = runProgram(code, namespace, key, data)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, fmt.Sprintf("transform of '%v': %v", key, err))
+				return
+			}
+		}
+	}
+	report, err := s.checkSchema(namespace, migration.Schema, docs)
+	if err != nil {
+		respondWithSchemaError(w, err)
+		return
+	}
+	if !report.Valid {
+		content, _ := json.Marshal(report)
+		respondWithJSON(w, http.StatusConflict, string(content))
+		return
+	}
+
+	written := make([]string, 0, migrated)
+	if code != nil {
+		for _, key := range sortedKeys(docs) {
+			dbErr := s.rewrite(namespace, key, docs[key], userId)
+			if dbErr != nil {
+				s.restoreMigrated(namespace, written, originals, userId)
+				respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("migration stopped at '%v', the documents were restored: %v", key, dbErr))
+				return
+			}
+			written = append(written, key)
+		}
+	}
+	dbErr := s.db.Upsert(namespace+SchemaId, SchemaId, migration.Schema)
+	if dbErr != nil {
+		s.restoreMigrated(namespace, written, originals, userId)
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("schema not changed, the documents were restored: %v", dbErr))
+		return
+	}
+	log.Printf("migrated namespace '%s', %v documents rewritten\n", namespace, migrated)
+	s.Notify(BrokerEvent{
+		Event:     EVENT_SCHEMA_UPDATED,
+		Namespace: namespace,
+		Value:     migration.Schema,
+	})
+	err = s.syncUnique(namespace)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	content, _ := json.Marshal(struct {
+		Migrated int             `json:"migrated"`
+		Schema   json.RawMessage `json:"schema"`
+	}{migrated, migration.Schema})
+	respondWithJSON(w, http.StatusCreated, string(content))
+}
+
+// rewrite stores a document changed by a migration, keeping its owner
+func (s *Server) rewrite(namespace string, key string, data []byte, userId string) *database.DbError {
+	dbErr := s.db.Upsert(namespace, key, data)
+	if dbErr != nil {
+		return dbErr
+	}
+	var doc interface{}
+	json.Unmarshal(data, &doc)
+	s.Notify(BrokerEvent{
+		Event:     EVENT_ITEM_ADDED,
+		User:      userId,
+		Namespace: namespace,
+		Key:       key,
+		Value:     doc,
+		Raw:       data,
+	})
+	return nil
+}
+
+// restoreMigrated puts back the documents rewritten by a failed migration
+func (s *Server) restoreMigrated(namespace string, keys []string, originals map[string][]byte, userId string) {
+	for _, key := range keys {
+		dbErr := s.rewrite(namespace, key, originals[key], userId)
+		if dbErr != nil {
+			log.Printf("error restoring '%v' of namespace '%v' after a failed migration: %v\n", key, namespace, dbErr)
+		}
+	}
+}
+
+// respondWithSchemaError answers 400 to an invalid schema, 409 to the stored documents not complying
+// with it, 500 to the database failing
+func respondWithSchemaError(w http.ResponseWriter, err error) {
+	var dbErr *database.DbError
+	var conflictErr *SchemaConflictError
+	if uniqueErr, ok := asUniqueError(err); ok {
+		respondWithUniqueError(w, uniqueErr)
+		return
+	}
+	if errors.As(err, &conflictErr) {
+		content, _ := json.Marshal(conflictErr.Report)
+		respondWithJSON(w, http.StatusConflict, string(content))
+		return
+	}
+	if errors.As(err, &dbErr) {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithError(w, http.StatusBadRequest, err.Error())
+}
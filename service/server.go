@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -25,19 +26,55 @@ type Database interface {
 	GetNamespaces() []string
 }
 
+// VersionedDatabase is implemented by the databases supporting optimistic concurrency:
+// a write can be made conditional on the version (e.g. the ETag) of the stored document
+type VersionedDatabase interface {
+	GetVersion(namespace string, key string) ([]byte, string, *database.DbError)
+	UpsertIfMatch(namespace string, key string, value []byte, version string) *database.DbError
+}
+
+// BatchDatabase is implemented by the databases able to write many documents in a single transaction
+type BatchDatabase interface {
+	UpsertBatch(namespace string, values map[string][]byte) *database.DbError
+}
+
+// RangeDatabase is implemented by the databases able to read the keys of a namespace in order:
+// GetRange returns at most limit documents, with the keys from "from" onwards, sorted by key
+type RangeDatabase interface {
+	GetRange(namespace string, from string, limit int) ([]database.Document, *database.DbError)
+}
+
 const (
+	// MigrationsNamespace records the data migrations completed, that must not run again
+	MigrationsNamespace   = "_migrations"
+	unwrapLegacyMigration = "unwrap_legacy"
+
 	NamespacePattern = "/ns/{namespace:[a-zA-Z0-9]+}"
 	KeyValuePattern  = "/ns/{namespace:[a-zA-Z0-9]+}/{key:[a-zA-Z0-9]+}"
 	SearchPattern    = "/search/{namespace:[a-zA-Z0-9]+}"
+	ExportPattern    = "/ns/{namespace:[a-zA-Z0-9]+}/_export"
+	ImportPattern    = "/ns/{namespace:[a-zA-Z0-9]+}/_import"
+	DumpPattern      = "/_export"
+	RestorePattern   = "/_import"
 	SchemaPattern    = "/schema/{namespace:[a-zA-Z0-9]+}"
 	OpenAPIPattern   = "/{openapi|swagger}.json"
 	BrokerPattern    = "/broker"
 	SwaggerUIPattern = "/swaggerui/"
 	SchemaId         = "_schema"
+	MetaId           = "_meta"
+	EnvelopeParam    = "envelope"
+	ETagHeader       = "ETag"
+	IfMatchHeader    = "If-Match"
 
 	EVENT_ITEM_ADDED        = "ITEM_ADDED"
 	EVENT_ITEM_DELETED      = "ITEM_DELETED"
 	EVENT_NAMESPACE_DELETED = "NAMESPACE_DELETED"
+	EVENT_SCHEMA_UPDATED    = "SCHEMA_UPDATED"
+	EVENT_SCHEMA_DELETED    = "SCHEMA_DELETED"
+	EVENT_TRANSFORM_UPDATED = "TRANSFORM_UPDATED"
+	EVENT_TRANSFORM_DELETED = "TRANSFORM_DELETED"
+	EVENT_HOOKS_UPDATED     = "HOOKS_UPDATED"
+	EVENT_HOOKS_DELETED     = "HOOKS_DELETED"
 
 	certsPublicKey = "./certs/public-cert.pem"
 )
@@ -49,26 +86,83 @@ var (
 type Server struct {
 	Address     string
 	AuthEnabled bool
-	router      *mux.Router
-	db          Database
-	broker      *Broker
+	// Bus, if set, delivers the events to the SSE clients of every instance
+	Bus EventBus
+	// Replica, if set, makes this server a read-only follower of another one
+	Replica *Replica
+	// ReplicationLogSize is the number of changes kept for the followers to catch up
+	ReplicationLogSize int
+	// Feed, if set, records all the changes for the clients polling them
+	Feed *ChangeFeed
+	// Webhooks, if set, delivers the events to the registered webhooks
+	Webhooks *WebhookDispatcher
+	// Outbox, if set, publishes the events to a message bus
+	Outbox *Outbox
+	// HookTimeout bounds the execution of every hook, DefaultHookTimeout if 0
+	HookTimeout time.Duration
+	// UnwrapLegacy converts, once, the documents stored wrapped with their user by the versions before the metadata
+	UnwrapLegacy bool
+
+	router     *mux.Router
+	db         Database
+	broker     *Broker
+	schemas    schemaCache
+	transforms transformCache
+	hooks      hooksCache
+	uniques    uniqueIndexes
+	refs       refIndexes
+	bus        busState
+	changes    changeLog
 }
 
 func (s *Server) Init(db Database) {
 	s.db = db
 	s.db.Init()
 
+	if s.UnwrapLegacy {
+		count, err := s.unwrapLegacyOnce()
+		if err != nil {
+			log.Fatalf("error unwrapping the documents stored with their user: %v", err)
+		}
+		if count >= 0 {
+			log.Printf("unwrapped %v documents stored with their user\n", count)
+		}
+	}
+
 	s.broker = NewServer()
+	s.changes.Size = s.ReplicationLogSize
+	err := s.subscribe()
+	if err != nil {
+		log.Fatalf("error subscribing to the event bus: %v", err)
+	}
 
 	s.router = mux.NewRouter()
 	s.router.HandleFunc("/ns", s.homeHandler)
 	s.router.HandleFunc(NamespacePattern, s.namespaceHandler).Methods(http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions)
 	s.router.HandleFunc(KeyValuePattern, s.keyValueHandler).Methods(http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions)
 	s.router.HandleFunc(SearchPattern, s.searchHandler).Queries("filter", "{filter}")
+	s.router.HandleFunc(ExportPattern, s.exportHandler).Methods(http.MethodGet)
+	s.router.HandleFunc(ImportPattern, s.importHandler).Methods(http.MethodPost)
+	s.router.HandleFunc(DumpPattern, s.dumpHandler).Methods(http.MethodGet)
+	s.router.HandleFunc(RestorePattern, s.restoreHandler).Methods(http.MethodPost)
+	s.router.HandleFunc(SchemaCheckPattern, s.schemaCheckHandler).Methods(http.MethodPost)
+	s.router.HandleFunc(SchemaMigratePattern, s.schemaMigrateHandler).Methods(http.MethodPost)
 	s.router.HandleFunc(SchemaPattern, s.schemaHandler)
+	s.router.HandleFunc(TransformPattern, s.transformHandler).Methods(http.MethodGet, http.MethodPost, http.MethodDelete)
+	s.router.HandleFunc(HooksPattern, s.hooksHandler).Methods(http.MethodGet, http.MethodPost, http.MethodDelete)
 	s.router.HandleFunc(OpenAPIPattern, s.openAPIHandler)
 	s.router.PathPrefix(SwaggerUIPattern).Handler(http.StripPrefix(SwaggerUIPattern, http.FileServer(http.Dir("./swagger-ui/"))))
 	s.router.Handle(BrokerPattern, s.broker)
+	s.router.HandleFunc(ReplicationSnapshotPattern, s.replicationSnapshotHandler).Methods(http.MethodGet)
+	s.router.HandleFunc(ReplicationStreamPattern, s.replicationStreamHandler).Methods(http.MethodGet)
+	s.router.HandleFunc(ReplicationStatusPattern, s.replicationStatusHandler).Methods(http.MethodGet)
+	s.router.HandleFunc(ChangesPattern, s.changesHandler).Methods(http.MethodGet, http.MethodOptions)
+	s.router.HandleFunc(NamespaceChangesPattern, s.changesHandler).Methods(http.MethodGet, http.MethodOptions)
+	s.router.HandleFunc(WebhooksPattern, s.webhooksHandler).Methods(http.MethodGet, http.MethodPost)
+	s.router.HandleFunc(WebhookPattern, s.webhookHandler).Methods(http.MethodGet, http.MethodDelete)
+	s.router.HandleFunc(WebhookDeliveriesPattern, s.webhookDeliveriesHandler).Methods(http.MethodGet)
+	s.router.HandleFunc(WebhookDeadLettersPattern, s.webhookDeadLettersHandler).Methods(http.MethodGet)
+	s.router.HandleFunc(WebhookRetryPattern, s.webhookRetryHandler).Methods(http.MethodPost)
 	s.router.Use(mux.CORSMethodMiddleware(s.router))
 
 	if s.AuthEnabled {
@@ -83,23 +177,46 @@ func (s *Server) Init(db Database) {
 		log.Println("authentication middleware enabled")
 	}
 
+	if s.Feed != nil {
+		go s.Feed.compactEvery(s.db, changesCompactInterval)
+	}
+
+	if s.Replica != nil {
+		s.router.Use(s.readOnly)
+		go s.Replica.run(s)
+		log.Printf("replicating from %v, read-only\n", s.Replica.LeaderURL)
+	}
+
 	srv := &http.Server{
 		Handler:      s.router,
 		Addr:         s.Address,
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
+		// the replication streams clear the deadlines of their connection
+		ConnContext: withConn,
 	}
 
 	log.Fatal(srv.ListenAndServe())
 }
 
 func (s *Server) homeHandler(w http.ResponseWriter, r *http.Request) {
-	namespaces, err := jsonWrapper(s.db.GetNamespaces())
+	namespaces := make([]string, 0)
+	for _, namespace := range s.db.GetNamespaces() {
+		if !storageNamespace(namespace) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	content, err := jsonWrapper(namespaces)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	respondWithJSON(w, http.StatusOK, string(namespaces))
+	respondWithJSON(w, http.StatusOK, string(content))
+}
+
+// storageNamespace tells the metadata, transforms, hooks and internal namespaces, an implementation detail of the storage
+func storageNamespace(namespace string) bool {
+	return strings.HasSuffix(namespace, MetaId) || strings.HasSuffix(namespace, TransformId) || strings.HasSuffix(namespace, HooksId) || internalNamespace(namespace)
 }
 
 func (s *Server) namespaceHandler(w http.ResponseWriter, r *http.Request) {
@@ -118,6 +235,11 @@ func (s *Server) namespaceHandler(w http.ResponseWriter, r *http.Request) {
 	case http.MethodPost:
 		respondWithError(w, http.StatusNotImplemented, "cannot POST to this endpoint!")
 	case http.MethodGet:
+		expansion, err := parseExpansion(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 		data, dbErr := s.db.GetAll(namespace)
 		if dbErr != nil {
 			switch dbErr.ErrorCode {
@@ -127,6 +249,31 @@ func (s *Server) namespaceHandler(w http.ResponseWriter, r *http.Request) {
 				respondWithError(w, http.StatusInternalServerError, dbErr.Error())
 			}
 		}
+		for key, value := range data {
+			data[key], err = s.transformRead(namespace, key, value)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		if expansion != nil {
+			err = s.expand(namespace, data, expansion)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		if wantsEnvelope(r) {
+			enveloped := make(map[string][]byte, len(data))
+			for key, value := range data {
+				enveloped[key], err = s.envelope(namespace, key, value)
+				if err != nil {
+					respondWithError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+			}
+			data = enveloped
+		}
 		namespaceData, err := jsonWrapper(data)
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
@@ -135,22 +282,26 @@ func (s *Server) namespaceHandler(w http.ResponseWriter, r *http.Request) {
 		respondWithJSON(w, http.StatusOK, string(namespaceData))
 
 	case http.MethodDelete:
-		dbErr := s.db.DeleteAll(namespace)
-		if dbErr != nil {
-			switch dbErr.ErrorCode {
-			case database.NAMESPACE_NOT_FOUND:
+		docs, err := s.beforeDeleteAll(namespace, userId)
+		if err != nil {
+			respondWithHookError(w, err)
+			return
+		}
+		err = s.deleteNamespace(namespace, userId)
+		if err != nil {
+			var restrict *RestrictError
+			var dbErr *database.DbError
+			switch {
+			case errors.As(err, &restrict):
+				respondWithError(w, http.StatusConflict, err.Error())
+			case errors.As(err, &dbErr) && dbErr.ErrorCode == database.NAMESPACE_NOT_FOUND:
 				respondWithError(w, http.StatusBadRequest, dbErr.Error())
 			default:
-				respondWithError(w, http.StatusInternalServerError, dbErr.Error())
+				respondWithError(w, http.StatusInternalServerError, err.Error())
 			}
+			return
 		}
-		s.Notify(BrokerEvent{
-			Event:     EVENT_NAMESPACE_DELETED,
-			User:      userId,
-			Namespace: namespace,
-			Key:       "",
-			Value:     nil,
-		})
+		s.afterDelete(namespace, userId, docs)
 		respondWithJSON(w, http.StatusAccepted, "{}")
 	}
 }
@@ -177,46 +328,105 @@ func (s *Server) keyValueHandler(w http.ResponseWriter, r *http.Request) {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		parsedData, err := s.validate(namespace, data)
+		data, err = s.transformWrite(namespace, key, data)
 		if err != nil {
 			respondWithError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-
-		if s.AuthEnabled {
-			// override data with a payload
-			payload := Payload{
-				User: userId,
-				Data: parsedData,
+		hooked := s.hasHooks(namespace)
+		var old []byte
+		if hooked {
+			if current, dbErr := s.db.Get(namespace, key); dbErr == nil {
+				old = current
 			}
-			data, err = payload.wrap()
-
+			data, err = s.runHook(HOOK_BEFORE_WRITE, hookContext{Namespace: namespace, Key: key, User: userId, Old: old, New: data})
 			if err != nil {
-				respondWithError(w, http.StatusInternalServerError, err.Error())
+				respondWithHookError(w, err)
 				return
 			}
 		}
-
-		dbErr := s.db.Upsert(namespace, key, data)
-		if dbErr != nil {
-			switch dbErr.ErrorCode {
-			case database.NAMESPACE_NOT_FOUND:
-				respondWithError(w, http.StatusBadRequest, dbErr.Error())
-			default:
-				respondWithError(w, http.StatusInternalServerError, dbErr.Error())
-			}
+		ifMatch := r.Header.Get(IfMatchHeader)
+		versioned, ok := s.db.(VersionedDatabase)
+		if ifMatch != "" && !ok {
+			respondWithError(w, http.StatusBadRequest, "conditional writes are not supported by this database")
 			return
 		}
-		s.Notify(BrokerEvent{
+		// validated and stored under the same schema
+		gate := s.uniques.gate(namespace)
+		gate.RLock()
+		parsedData, err := s.validate(namespace, data)
+		if err != nil {
+			gate.RUnlock()
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		err = s.writeUnique(namespace, key, parsedData, func() *database.DbError {
+			if ifMatch != "" {
+				return s.withMetadata(namespace, key, userId, func() *database.DbError {
+					return versioned.UpsertIfMatch(namespace, key, data, strings.Trim(ifMatch, `"`))
+				})
+			}
+			return s.upsert(namespace, key, data, userId)
+		}, BrokerEvent{
 			Event:     EVENT_ITEM_ADDED,
 			User:      userId,
 			Namespace: namespace,
 			Key:       key,
 			Value:     parsedData,
+			Raw:       data,
 		})
+		gate.RUnlock()
+		if err != nil {
+			var dbErr *database.DbError
+			if uniqueErr, ok := asUniqueError(err); ok {
+				respondWithUniqueError(w, uniqueErr)
+			} else if errors.As(err, &dbErr) {
+				switch dbErr.ErrorCode {
+				case database.NAMESPACE_NOT_FOUND:
+					respondWithError(w, http.StatusBadRequest, dbErr.Error())
+				case database.VERSION_CONFLICT:
+					respondWithError(w, http.StatusPreconditionFailed, dbErr.Error())
+				default:
+					respondWithError(w, http.StatusInternalServerError, dbErr.Error())
+				}
+			} else {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+		if hooked {
+			// the document is stored already, afterWrite can't refuse it
+			_, err = s.runHook(HOOK_AFTER_WRITE, hookContext{Namespace: namespace, Key: key, User: userId, Old: old, New: data})
+			if err != nil {
+				log.Printf("error on %v hook of namespace '%v': %v\n", HOOK_AFTER_WRITE, namespace, err)
+			}
+		}
+		if wantsEnvelope(r) {
+			data, err = s.envelope(namespace, key, data)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
 		respondWithJSON(w, http.StatusCreated, string(data))
 	case http.MethodGet:
-		data, dbErr := s.db.Get(namespace, key)
+		expansion, err := parseExpansion(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var data []byte
+		var dbErr *database.DbError
+		if versioned, ok := s.db.(VersionedDatabase); ok {
+			var version string
+			data, version, dbErr = versioned.GetVersion(namespace, key)
+			if dbErr == nil {
+				w.Header().Set(ETagHeader, `"`+version+`"`)
+				w.Header().Set("Access-Control-Expose-Headers", ETagHeader)
+			}
+		} else {
+			data, dbErr = s.db.Get(namespace, key)
+		}
 		if dbErr != nil {
 			switch dbErr.ErrorCode {
 			case database.ID_NOT_FOUND:
@@ -228,28 +438,57 @@ func (s *Server) keyValueHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
+		data, err = s.transformRead(namespace, key, data)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if expansion != nil {
+			docs := map[string][]byte{key: data}
+			err = s.expand(namespace, docs, expansion)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			data = docs[key]
+		}
+		if wantsEnvelope(r) {
+			data, err = s.envelope(namespace, key, data)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
 		respondWithJSON(w, http.StatusOK, string(data))
 	case http.MethodDelete:
-		err := s.db.Delete(namespace, key)
+		var hooked map[string][]byte
+		if s.hasHooks(namespace) {
+			if old, dbErr := s.db.Get(namespace, key); dbErr == nil {
+				_, err := s.runHook(HOOK_BEFORE_DELETE, hookContext{Namespace: namespace, Key: key, User: userId, Old: old})
+				if err != nil {
+					respondWithHookError(w, err)
+					return
+				}
+				hooked = map[string][]byte{key: old}
+			}
+		}
+		err := s.deleteDocument(namespace, key, userId)
 		if err != nil {
-
-			switch err.ErrorCode {
-			case database.ID_NOT_FOUND:
-				respondWithError(w, http.StatusNotFound, err.Error())
-			case database.NAMESPACE_NOT_FOUND:
-				respondWithError(w, http.StatusBadRequest, err.Error())
+			var restrict *RestrictError
+			var dbErr *database.DbError
+			switch {
+			case errors.As(err, &restrict):
+				respondWithError(w, http.StatusConflict, err.Error())
+			case errors.As(err, &dbErr) && dbErr.ErrorCode == database.ID_NOT_FOUND:
+				respondWithError(w, http.StatusNotFound, dbErr.Error())
+			case errors.As(err, &dbErr) && dbErr.ErrorCode == database.NAMESPACE_NOT_FOUND:
+				respondWithError(w, http.StatusBadRequest, dbErr.Error())
 			default:
 				respondWithError(w, http.StatusInternalServerError, err.Error())
 			}
 			return
 		}
-		s.Notify(BrokerEvent{
-			Event:     EVENT_ITEM_DELETED,
-			User:      userId,
-			Namespace: namespace,
-			Key:       key,
-			Value:     nil,
-		})
+		s.afterDelete(namespace, userId, hooked)
 		respondWithJSON(w, http.StatusAccepted, "{}")
 	}
 }
@@ -267,13 +506,11 @@ func (s *Server) schemaHandler(w http.ResponseWriter, r *http.Request) {
 			respondWithError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-
-		dbErr := s.db.Upsert(namespace, SchemaId, data)
-		if dbErr != nil {
-			respondWithError(w, http.StatusBadRequest, err.Error())
+		err = s.installSchema(vars["namespace"], data, r.URL.Query().Get(StrictParam) == "true")
+		if err != nil {
+			respondWithSchemaError(w, err)
 			return
 		}
-		log.Printf("added schema for namespace '%s'\n", vars["namespace"])
 		respondWithJSON(w, http.StatusCreated, string(data))
 	case http.MethodGet:
 		data, dbErr := s.db.Get(namespace, SchemaId)
@@ -288,6 +525,15 @@ func (s *Server) schemaHandler(w http.ResponseWriter, r *http.Request) {
 			respondWithError(w, http.StatusNotFound, dbErr.Error())
 			return
 		}
+		s.Notify(BrokerEvent{
+			Event:     EVENT_SCHEMA_DELETED,
+			Namespace: vars["namespace"],
+		})
+		err := s.syncUnique(vars["namespace"])
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
 		respondWithJSON(w, http.StatusAccepted, "{}")
 	}
 }
@@ -314,12 +560,32 @@ func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
 			respondWithError(w, http.StatusBadRequest, err.Error())
 			return
 		}
+		expansion, err := parseExpansion(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 		data, dbErr := s.db.GetAll(vars["namespace"])
 		if dbErr != nil {
 			log.Println("error on GetAll", err)
 			respondWithError(w, http.StatusBadRequest, dbErr.Error())
 			return
 		}
+		for key, value := range data {
+			data[key], err = s.transformRead(vars["namespace"], key, value)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		// expanded before the filter runs, so it can use the referenced documents
+		if expansion != nil {
+			err = s.expand(vars["namespace"], data, expansion)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
 		for key, value := range data {
 			var jsonContent map[string]interface{}
 			err := json.Unmarshal(value, &jsonContent)
@@ -373,21 +639,34 @@ func (s *Server) openAPIHandler(w http.ResponseWriter, r *http.Request) {
 // utils
 
 func (s *Server) validate(namespace string, data []byte) (interface{}, error) {
+	return s.validateDocument(namespace, data, true)
+}
+
+// validateDocument validates a document against the schema of its namespace, if any,
+// checking its references only if refs is true
+func (s *Server) validateDocument(namespace string, data []byte, refs bool) (interface{}, error) {
 	var parsed interface{}
 
 	// if namespace has a schema, validate against it
 	schemaJson, dbErr := s.db.Get(namespace+SchemaId, SchemaId)
 	if dbErr == nil {
-		schemaLoader := gojsonschema.NewBytesLoader(schemaJson)
-		documentLoader := gojsonschema.NewBytesLoader(data)
-
-		result, err := gojsonschema.Validate(schemaLoader, documentLoader)
+		schema, err := s.schemas.get(namespace, schemaJson)
+		if err != nil {
+			return nil, err
+		}
+		result, err := schema.Validate(gojsonschema.NewBytesLoader(data))
 		if err != nil {
 			return nil, err
 		}
 
 		if result.Valid() {
 			json.Unmarshal(data, &parsed)
+			if refs {
+				err = s.checkRefs(namespace, schemaJson, parsed)
+				if err != nil {
+					return nil, err
+				}
+			}
 		} else {
 			log.Printf("The document is not valid according to its schema. see errors :")
 			errorLog := ""
@@ -408,9 +687,175 @@ func (s *Server) validate(namespace string, data []byte) (interface{}, error) {
 	return parsed, nil
 }
 
+// upsert stores a document and, if known, the user that wrote it
+func (s *Server) upsert(namespace, key string, data []byte, userId string) *database.DbError {
+	return s.withMetadata(namespace, key, userId, func() *database.DbError {
+		return s.db.Upsert(namespace, key, data)
+	})
+}
+
+// withMetadata runs a write of a document, then stores its metadata. The two aren't
+// written atomically: if the metadata fails the previous document is put back.
+func (s *Server) withMetadata(namespace, key string, userId string, write func() *database.DbError) *database.DbError {
+	previous, getErr := s.db.Get(namespace, key)
+	dbErr := write()
+	if dbErr != nil {
+		return dbErr
+	}
+	dbErr = s.upsertMetadata(namespace, key, userId)
+	if dbErr != nil {
+		if getErr == nil {
+			s.db.Upsert(namespace, key, previous)
+		} else {
+			s.db.Delete(namespace, key)
+		}
+		return dbErr
+	}
+	return nil
+}
+
+// upsertMetadata stores the owner of a document, removing the previous one if the user isn't known
+func (s *Server) upsertMetadata(namespace, key string, userId string) *database.DbError {
+	if userId == "" {
+		dbErr := s.db.Delete(namespace+MetaId, key)
+		if dbErr != nil && dbErr.ErrorCode != database.ID_NOT_FOUND && dbErr.ErrorCode != database.NAMESPACE_NOT_FOUND {
+			return dbErr
+		}
+		return nil
+	}
+	// ownership is stored next to the document, never inside it
+	metadata, _ := json.Marshal(Metadata{User: userId})
+	return s.db.Upsert(namespace+MetaId, key, metadata)
+}
+
+// owner returns the user that wrote a document, if known
+func (s *Server) owner(namespace, key string) string {
+	var metadata Metadata
+	metadataJson, dbErr := s.db.Get(namespace+MetaId, key)
+	if dbErr == nil {
+		json.Unmarshal(metadataJson, &metadata)
+	}
+	return metadata.User
+}
+
+// unwrapLegacyOnce runs unwrapLegacy unless it completed already, returning -1 then. Completing it is
+// recorded in MigrationsNamespace: afterwards a document looking like a payload is left as it is.
+func (s *Server) unwrapLegacyOnce() (int, error) {
+	if _, dbErr := s.db.Get(MigrationsNamespace, unwrapLegacyMigration); dbErr == nil {
+		return -1, nil
+	}
+	count, err := s.unwrapLegacy()
+	if err != nil {
+		return count, err
+	}
+	done, _ := json.Marshal(struct {
+		Count     int       `json:"count"`
+		Completed time.Time `json:"completed"`
+	}{count, time.Now().UTC()})
+	dbErr := s.db.Upsert(MigrationsNamespace, unwrapLegacyMigration, done)
+	if dbErr != nil {
+		return count, dbErr
+	}
+	return count, nil
+}
+
+// unwrapLegacy converts the documents stored, by the versions before the metadata
+// namespaces, wrapped in a Payload when auth was enabled: the document is unwrapped
+// and its user moved to the metadata. A document is taken as wrapped if it has only
+// user_id and data, and no metadata yet, so converting it again does nothing.
+func (s *Server) unwrapLegacy() (int, error) {
+	count := 0
+	for _, namespace := range s.db.GetNamespaces() {
+		if strings.HasSuffix(namespace, MetaId) || strings.HasSuffix(namespace, SchemaId) || strings.HasSuffix(namespace, TransformId) ||
+			strings.HasSuffix(namespace, HooksId) || internalNamespace(namespace) {
+			continue
+		}
+		docs, dbErr := s.db.GetAll(namespace)
+		if dbErr != nil {
+			return count, dbErr
+		}
+		meta, _ := s.db.GetAll(namespace + MetaId)
+		for _, key := range sortedKeys(docs) {
+			if _, ok := meta[key]; ok {
+				continue
+			}
+			payload, ok := legacyPayload(docs[key])
+			if !ok {
+				continue
+			}
+			// the document first: if interrupted, the next run finds it without metadata but unwrapped
+			dbErr = s.db.Upsert(namespace, key, payload.Data.(json.RawMessage))
+			if dbErr != nil {
+				return count, dbErr
+			}
+			metadata, _ := json.Marshal(Metadata{User: payload.User})
+			dbErr = s.db.Upsert(namespace+MetaId, key, metadata)
+			if dbErr != nil {
+				return count, dbErr
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+func legacyPayload(data []byte) (*Payload, bool) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil || len(fields) != 2 || fields["data"] == nil {
+		return nil, false
+	}
+	var user string
+	if json.Unmarshal(fields["user_id"], &user) != nil {
+		return nil, false
+	}
+	return &Payload{User: user, Data: fields["data"]}, true
+}
+
+// envelope wraps a stored document together with its metadata, if any
+func (s *Server) envelope(namespace, key string, data []byte) ([]byte, error) {
+	var metadata Metadata
+	metadataJson, dbErr := s.db.Get(namespace+MetaId, key)
+	if dbErr == nil {
+		err := json.Unmarshal(metadataJson, &metadata)
+		if err != nil {
+			return nil, err
+		}
+	}
+	payload := Payload{
+		User: metadata.User,
+		Data: json.RawMessage(data),
+	}
+	return payload.wrap()
+}
+
+func wantsEnvelope(r *http.Request) bool {
+	return r.URL.Query().Get(EnvelopeParam) == "true"
+}
+
 func (s *Server) Notify(event BrokerEvent) {
+	if s.Feed != nil {
+		s.Feed.record(s.db, event)
+	}
+	if s.Webhooks != nil || s.Outbox != nil {
+		readable := s.readEvent(event)
+		if s.Webhooks != nil {
+			s.Webhooks.dispatch(s.db, readable)
+		}
+		if s.Outbox != nil {
+			s.Outbox.add(s.db, readable)
+		}
+	}
+	s.notifyLocal(event)
+}
+
+// notifyLocal only updates the unique and reference indexes and the replication log, and notifies the clients of
+// this node, e.g. for the changes replicated from a leader, which already sent them to the feed and sinks
+func (s *Server) notifyLocal(event BrokerEvent) {
+	s.changes.append(event)
+	s.uniques.notify(event)
+	s.refs.notify(event)
 	if s.broker != nil {
-		jsonData, _ := json.Marshal(event)
-		s.broker.Notifier <- jsonData
+		readable := s.readEvent(event)
+		s.publish(event.Namespace, &readable)
 	}
 }
@@ -1,15 +1,32 @@
 package service
 
 import (
+	"bytes"
+	"crypto/md5"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
 	"github.com/google/go-cmp/cmp"
 	"github.com/gorilla/mux"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
 
 	"github.com/rehacktive/caffeine/database"
 )
@@ -33,6 +50,14 @@ var validJsonForSchema = `{
 	"lastName":"never",
 	"age":666
 }`
+var computedTransform = `{"write":". + {fullName: (.firstName + \" \" + .lastName), id: $key}","read":"del(.age)"}`
+var postsHooks = `{"script":"function beforeWrite(ctx) {\n  if (ctx.old && ctx.old.status === 'published' && ctx.new.status === 'draft') throw 'a published post cannot go back to draft';\n  ctx.new.slug = ctx.key;\n}\nfunction afterWrite(ctx) {\n  caffeine.put('audit', ctx.key, {status: ctx.new.status, previous: ctx.old ? ctx.old.status : null});\n}\nfunction beforeDelete(ctx) {\n  if (ctx.old.status === 'published') throw 'unpublish the post first';\n}\nfunction afterDelete(ctx) {\n  caffeine.put('audit', ctx.key, {status: 'deleted', previous: ctx.old.status});\n}"}`
+var ordersSchema = `{"type":"object","properties":{"user":{"type":"string","x-ref":{"namespace":"users"}}}}`
+var invoicesSchema = `{"type":"object","properties":{"customer":{"type":"string","x-ref":{"namespace":"customers","onDelete":"cascade"}}}}`
+var booksSchema = `{"type":"object","properties":{"author":{"type":["string","null"],"x-ref":{"namespace":"authors","onDelete":"nullify"}}}}`
+var membersSchema = `{"type":"object","x-unique":["email",["first","last"]]}`
+var peopleSchema = `{"type":"object","properties":{"name":{"type":"string"}},"required":["name"]}`
+var peopleMigration = `{"schema":{"type":"object","properties":{"first":{"type":"string"},"last":{"type":"string"}},"required":["first","last"]},"transform":"(.name | split(\" \")) as $parts | {first: $parts[0], last: $parts[1]}"}`
 var invalidJsonForSchema = `{
 	"firstName":"john"
 }`
@@ -46,6 +71,17 @@ var tests = []testCase{
 		expectedResponseCode: http.StatusOK,
 		expectedResponse:     `["ns1"]`,
 	},
+	{
+		name:                 "test home handler hides metadata",
+		method:               http.MethodGet,
+		path:                 "/",
+		payload:              "",
+		expectedResponseCode: http.StatusOK,
+		expectedResponse:     `["ns1"]`,
+		beforeTest: func(d Database) {
+			d.Upsert(testNamespace+MetaId, testKey, []byte(`{"user_id":"johnd"}`))
+		},
+	},
 	{
 		name:                 "test namespace get",
 		method:               http.MethodGet,
@@ -113,6 +149,45 @@ var tests = []testCase{
 		expectedResponseCode: http.StatusOK,
 		expectedResponse:     jsonPayload,
 	},
+	{
+		name:                 "test keyvalue get with envelope",
+		method:               http.MethodGet,
+		path:                 "/ns/" + testNamespace + "/" + testKey + "?envelope=true",
+		payload:              "",
+		expectedResponseCode: http.StatusOK,
+		expectedResponse:     fmt.Sprintf(`{"user_id":"johnd","data":%v}`, jsonPayload),
+		beforeTest: func(d Database) {
+			d.Upsert(testNamespace+MetaId, testKey, []byte(`{"user_id":"johnd"}`))
+		},
+	},
+	{
+		name:                 "test namespace get with envelope",
+		method:               http.MethodGet,
+		path:                 "/ns/" + testNamespace + "?envelope=true",
+		payload:              "",
+		expectedResponseCode: http.StatusOK,
+		expectedResponse:     fmt.Sprintf(`[{"key":"%v","value":{"data":%v,"user_id":"johnd"}}]`, testKey, jsonPayload),
+		beforeTest: func(d Database) {
+			d.Upsert(testNamespace+MetaId, testKey, []byte(`{"user_id":"johnd"}`))
+		},
+	},
+	{
+		name:                 "test keyvalue post without user drops the previous owner",
+		method:               http.MethodPost,
+		path:                 "/ns/" + testNamespace + "/" + testKey + "?envelope=true",
+		payload:              jsonPayload,
+		expectedResponseCode: http.StatusCreated,
+		expectedResponse:     fmt.Sprintf(`{"user_id":"","data":%v}`, jsonPayload),
+		beforeTest: func(d Database) {
+			d.Upsert(testNamespace+MetaId, testKey, []byte(`{"user_id":"johnd"}`))
+		},
+		dbCheck: func(d Database) error {
+			if metadata, err := d.Get(testNamespace+MetaId, testKey); err == nil {
+				return fmt.Errorf("expected no owner, got %s", metadata)
+			}
+			return nil
+		},
+	},
 	{
 		name:                 "test keyvalue get not existing",
 		method:               http.MethodGet,
@@ -137,6 +212,77 @@ var tests = []testCase{
 		expectedResponseCode: http.StatusNotFound,
 		expectedResponse:     "",
 	},
+	{
+		name:                 "test namespace export",
+		method:               http.MethodGet,
+		path:                 "/ns/" + testNamespace + "/_export",
+		payload:              "",
+		expectedResponseCode: http.StatusOK,
+		expectedResponse:     fmt.Sprintf("{\"key\":\"%v\",\"value\":%v,\"user_id\":\"johnd\"}\n", testKey, jsonPayload),
+		beforeTest: func(d Database) {
+			d.Upsert(testNamespace+MetaId, testKey, []byte(`{"user_id":"johnd"}`))
+		},
+	},
+	{
+		name:                 "test namespace import",
+		method:               http.MethodPost,
+		path:                 "/ns/imported/_import",
+		payload:              `{"schema":{"required":["name"]}}` + "\n" + `{"key":"1","value":` + jsonPayload + `}` + "\n",
+		expectedResponseCode: http.StatusCreated,
+		expectedResponse:     `{"imported":1}`,
+		dbCheck: func(d Database) error {
+			value, err := d.Get("imported", "1")
+			if err != nil {
+				return err
+			}
+			if diff := cmp.Diff(jsonPayload, string(value)); diff != "" {
+				return fmt.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+			_, err = d.Get("imported"+SchemaId, SchemaId)
+			if err != nil {
+				return err
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test namespace import invalid for schema",
+		method:               http.MethodPost,
+		path:                 "/ns/importedinvalid/_import",
+		payload:              `{"schema":{"required":["surname"]}}` + "\n" + `{"key":"1","value":` + jsonPayload + `}` + "\n",
+		expectedResponseCode: http.StatusBadRequest,
+		expectedResponse:     `{ "status": 400, "message": "line 2: (root): surname is required" }`,
+	},
+	{
+		name:                 "test namespace import broken schema",
+		method:               http.MethodPost,
+		path:                 "/ns/importedbroken/_import",
+		payload:              `{"schema":{"properties":{"user":{"x-ref":{"namespace":"users","onDelete":"ignore"}}}}}` + "\n",
+		expectedResponseCode: http.StatusBadRequest,
+		dbCheck: func(d Database) error {
+			if _, err := d.Get("importedbroken"+SchemaId, SchemaId); err == nil {
+				return fmt.Errorf("expected the schema not to be stored")
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test namespace import schema violated by the stored documents",
+		method:               http.MethodPost,
+		path:                 "/ns/importedunique/_import",
+		payload:              `{"schema":{"x-unique":["email"]}}` + "\n",
+		expectedResponseCode: http.StatusBadRequest,
+		beforeTest: func(d Database) {
+			d.Upsert("importedunique", "m1", []byte(`{"email":"jack@caffeine.io"}`))
+			d.Upsert("importedunique", "m2", []byte(`{"email":"jack@caffeine.io"}`))
+		},
+		dbCheck: func(d Database) error {
+			if _, err := d.Get("importedunique"+SchemaId, SchemaId); err == nil {
+				return fmt.Errorf("expected the schema not to be stored")
+			}
+			return nil
+		},
+	},
 	{
 		name:                 "test schema post",
 		method:               http.MethodPost,
@@ -208,64 +354,2268 @@ var tests = []testCase{
 			d.Upsert("user"+SchemaId, SchemaId, []byte(getUserSchema()))
 		},
 	},
-}
-
-func setupCaffeineTest(db Database) *TestingRouter {
-	db.Init()
-	db.Upsert(testNamespace, testKey, []byte(jsonPayload))
-
-	server := Server{
-		db: db,
-	}
-
-	testingRouter := TestingRouter{Router: mux.NewRouter()}
-	testingRouter.AddHandler("/", server.homeHandler)
-	testingRouter.AddHandler(NamespacePattern, server.namespaceHandler)
-	testingRouter.AddHandler(KeyValuePattern, server.keyValueHandler)
-	testingRouter.AddHandler(SchemaPattern, server.schemaHandler)
-
-	return &testingRouter
-}
-
-func testHandlers(db Database, t *testing.T) {
-	for _, test := range tests {
-		testingRouter := setupCaffeineTest(db)
-		if test.beforeTest != nil {
-			test.beforeTest(db)
-		}
-		log.Println("running test: ", test.name)
-		req, _ := http.NewRequest(test.method, test.path, strings.NewReader(test.payload))
-		response := testingRouter.ExecuteRequest(req)
-		checkResponseCode(t, test.name, test.expectedResponseCode, response.Code)
-		if test.expectedResponse != "" {
-			checkResponse(t, test.name, response.Body.String(), test.expectedResponse)
-		}
-		if test.dbCheck != nil {
-			err := test.dbCheck(db)
+	{
+		name:                 "test transform post invalid",
+		method:               http.MethodPost,
+		path:                 "/transform/computed",
+		payload:              `{"write":". +"}`,
+		expectedResponseCode: http.StatusBadRequest,
+	},
+	{
+		name:                 "test transform post",
+		method:               http.MethodPost,
+		path:                 "/transform/computed",
+		payload:              computedTransform,
+		expectedResponseCode: http.StatusCreated,
+		expectedResponse:     computedTransform,
+		dbCheck: func(d Database) error {
+			_, err := d.Get("computed"+TransformId, TransformId)
 			if err != nil {
-				t.Errorf(err.Error())
+				return err
 			}
-		}
-	}
-}
-
-func Test_UnitTest_MemoryDb(t *testing.T) {
-	testHandlers(&database.MemDatabase{}, t)
-}
-
-func Test_UnitTest_StorageDb(t *testing.T) {
-	db := &database.StorageDatabase{
-		RootDirPath: "/tmp/caffeine_test1",
-	}
-	testHandlers(db, t)
-	os.RemoveAll("/tmp/caffeine_test1")
-}
-
-func Test_UnitTest_SQLiteDb(t *testing.T) {
-	os.MkdirAll("/tmp/caffeine", os.ModePerm)
-	db := &database.SQLiteDatabase{
-		DirPath: "/tmp/caffeine",
-	}
-	testHandlers(db, t)
-	os.RemoveAll("/tmp/caffeine")
+			return nil
+		},
+	},
+	{
+		name:                 "test transform on write",
+		method:               http.MethodPost,
+		path:                 "/ns/computed/" + testKey,
+		payload:              validJsonForSchema,
+		expectedResponseCode: http.StatusCreated,
+		expectedResponse:     `{"age":666,"firstName":"john","fullName":"john never","id":"key1","lastName":"never"}`,
+		beforeTest: func(d Database) {
+			d.Upsert("computed"+TransformId, TransformId, []byte(computedTransform))
+		},
+	},
+	{
+		name:                 "test transform on read",
+		method:               http.MethodGet,
+		path:                 "/ns/computed/" + testKey,
+		expectedResponseCode: http.StatusOK,
+		expectedResponse:     `{"firstName":"john","fullName":"john never","id":"key1","lastName":"never"}`,
+		beforeTest: func(d Database) {
+			d.Upsert("computed"+TransformId, TransformId, []byte(computedTransform))
+			d.Upsert("computed", testKey, []byte(`{"age":666,"firstName":"john","fullName":"john never","id":"key1","lastName":"never"}`))
+		},
+	},
+	{
+		name:                 "test transform error on write",
+		method:               http.MethodPost,
+		path:                 "/ns/computed/key2",
+		payload:              `{"firstName":1,"lastName":"never"}`,
+		expectedResponseCode: http.StatusBadRequest,
+		beforeTest: func(d Database) {
+			d.Upsert("computed"+TransformId, TransformId, []byte(computedTransform))
+		},
+		dbCheck: func(d Database) error {
+			_, err := d.Get("computed", "key2")
+			if err == nil {
+				return fmt.Errorf("expected the document not to be stored")
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test hooks post invalid",
+		method:               http.MethodPost,
+		path:                 "/hooks/posts",
+		payload:              `function beforeWrite(ctx) {`,
+		expectedResponseCode: http.StatusBadRequest,
+	},
+	{
+		name:                 "test hooks post",
+		method:               http.MethodPost,
+		path:                 "/hooks/posts",
+		payload:              `function beforeWrite(ctx) { ctx.new.checked = true }`,
+		expectedResponseCode: http.StatusCreated,
+		dbCheck: func(d Database) error {
+			_, err := d.Get("posts"+HooksId, HooksId)
+			if err != nil {
+				return err
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test hooks before and after write",
+		method:               http.MethodPost,
+		path:                 "/ns/posts/" + testKey,
+		payload:              `{"status":"draft"}`,
+		expectedResponseCode: http.StatusCreated,
+		expectedResponse:     `{"status":"draft","slug":"key1"}`,
+		beforeTest: func(d Database) {
+			d.Upsert("posts"+HooksId, HooksId, []byte(postsHooks))
+		},
+		dbCheck: func(d Database) error {
+			audit, err := d.Get("audit", testKey)
+			if err != nil {
+				return err
+			}
+			if string(audit) != `{"previous":null,"status":"draft"}` {
+				return fmt.Errorf("unexpected audit %s", audit)
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test hooks rejected write",
+		method:               http.MethodPost,
+		path:                 "/ns/posts/" + testKey,
+		payload:              `{"status":"draft"}`,
+		expectedResponseCode: http.StatusBadRequest,
+		beforeTest: func(d Database) {
+			d.Upsert("posts"+HooksId, HooksId, []byte(postsHooks))
+			d.Upsert("posts", testKey, []byte(`{"slug":"key1","status":"published"}`))
+		},
+		dbCheck: func(d Database) error {
+			post, err := d.Get("posts", testKey)
+			if err != nil {
+				return err
+			}
+			if string(post) != `{"slug":"key1","status":"published"}` {
+				return fmt.Errorf("expected the post not to change, got %s", post)
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test hooks rejected delete",
+		method:               http.MethodDelete,
+		path:                 "/ns/posts/" + testKey,
+		expectedResponseCode: http.StatusBadRequest,
+		beforeTest: func(d Database) {
+			d.Upsert("posts"+HooksId, HooksId, []byte(postsHooks))
+			d.Upsert("posts", testKey, []byte(`{"slug":"key1","status":"published"}`))
+		},
+		dbCheck: func(d Database) error {
+			_, err := d.Get("posts", testKey)
+			if err != nil {
+				return fmt.Errorf("expected the post not to be deleted")
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test hooks rejected namespace delete",
+		method:               http.MethodDelete,
+		path:                 "/ns/posts",
+		expectedResponseCode: http.StatusBadRequest,
+		beforeTest: func(d Database) {
+			d.Upsert("posts"+HooksId, HooksId, []byte(postsHooks))
+			d.Upsert("posts", "draft", []byte(`{"slug":"draft","status":"draft"}`))
+			d.Upsert("posts", testKey, []byte(`{"slug":"key1","status":"published"}`))
+		},
+		dbCheck: func(d Database) error {
+			posts, err := d.GetAll("posts")
+			if err != nil || len(posts) != 2 {
+				return fmt.Errorf("expected the posts not to be deleted")
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test hooks after namespace delete",
+		method:               http.MethodDelete,
+		path:                 "/ns/posts",
+		expectedResponseCode: http.StatusAccepted,
+		beforeTest: func(d Database) {
+			d.Upsert("posts"+HooksId, HooksId, []byte(postsHooks))
+			d.Upsert("posts", testKey, []byte(`{"slug":"key1","status":"draft"}`))
+		},
+		dbCheck: func(d Database) error {
+			audit, err := d.Get("audit", testKey)
+			if err != nil {
+				return err
+			}
+			if string(audit) != `{"previous":"draft","status":"deleted"}` {
+				return fmt.Errorf("unexpected audit %s", audit)
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test ref schema invalid",
+		method:               http.MethodPost,
+		path:                 "/schema/orders",
+		payload:              `{"properties":{"user":{"x-ref":{"namespace":"users","onDelete":"ignore"}}}}`,
+		expectedResponseCode: http.StatusBadRequest,
+	},
+	{
+		name:                 "test ref missing on write",
+		method:               http.MethodPost,
+		path:                 "/ns/orders/o1",
+		payload:              `{"user":"nobody"}`,
+		expectedResponseCode: http.StatusBadRequest,
+		beforeTest: func(d Database) {
+			d.Upsert("orders"+SchemaId, SchemaId, []byte(ordersSchema))
+		},
+	},
+	{
+		name:                 "test ref existing on write",
+		method:               http.MethodPost,
+		path:                 "/ns/orders/o1",
+		payload:              `{"user":"jack"}`,
+		expectedResponseCode: http.StatusCreated,
+		beforeTest: func(d Database) {
+			d.Upsert("orders"+SchemaId, SchemaId, []byte(ordersSchema))
+			d.Upsert("users", "jack", []byte(jsonPayload))
+		},
+	},
+	{
+		name:                 "test ref restrict on delete",
+		method:               http.MethodDelete,
+		path:                 "/ns/users/jack",
+		expectedResponseCode: http.StatusConflict,
+		beforeTest: func(d Database) {
+			d.Upsert("orders"+SchemaId, SchemaId, []byte(ordersSchema))
+			d.Upsert("users", "jack", []byte(jsonPayload))
+			d.Upsert("orders", "o1", []byte(`{"user":"jack"}`))
+		},
+		dbCheck: func(d Database) error {
+			_, err := d.Get("users", "jack")
+			if err != nil {
+				return fmt.Errorf("expected the user not to be deleted")
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test ref cascade on delete",
+		method:               http.MethodDelete,
+		path:                 "/ns/customers/jack",
+		expectedResponseCode: http.StatusAccepted,
+		beforeTest: func(d Database) {
+			d.Upsert("invoices"+SchemaId, SchemaId, []byte(invoicesSchema))
+			d.Upsert("customers", "jack", []byte(jsonPayload))
+			d.Upsert("customers", "jill", []byte(jsonPayload))
+			d.Upsert("invoices", "i1", []byte(`{"customer":"jack"}`))
+			d.Upsert("invoices", "i2", []byte(`{"customer":"jill"}`))
+		},
+		dbCheck: func(d Database) error {
+			if _, err := d.Get("invoices", "i1"); err == nil {
+				return fmt.Errorf("expected the invoice of jack to be deleted")
+			}
+			if _, err := d.Get("invoices", "i2"); err != nil {
+				return fmt.Errorf("expected the invoice of jill to be kept")
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test ref nullify on delete",
+		method:               http.MethodDelete,
+		path:                 "/ns/authors/jack",
+		expectedResponseCode: http.StatusAccepted,
+		beforeTest: func(d Database) {
+			d.Upsert("books"+SchemaId, SchemaId, []byte(booksSchema))
+			d.Upsert("authors", "jack", []byte(jsonPayload))
+			d.Upsert("books", "b1", []byte(`{"author":"jack","title":"on the road"}`))
+		},
+		dbCheck: func(d Database) error {
+			book, err := d.Get("books", "b1")
+			if err != nil {
+				return err
+			}
+			if string(book) != `{"author":null,"title":"on the road"}` {
+				return fmt.Errorf("expected the author to be null, got %s", book)
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test ref nullify on a non nullable field",
+		method:               http.MethodDelete,
+		path:                 "/ns/authors/jack",
+		expectedResponseCode: http.StatusConflict,
+		beforeTest: func(d Database) {
+			d.Upsert("books"+SchemaId, SchemaId, []byte(`{"type":"object","properties":{"author":{"type":"string","x-ref":{"namespace":"authors","onDelete":"nullify"}}}}`))
+			d.Upsert("authors", "jack", []byte(jsonPayload))
+			d.Upsert("books", "b1", []byte(`{"author":"jack"}`))
+		},
+		dbCheck: func(d Database) error {
+			if _, err := d.Get("authors", "jack"); err != nil {
+				return fmt.Errorf("expected the author not to be deleted")
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test ref restrict on namespace delete",
+		method:               http.MethodDelete,
+		path:                 "/ns/users",
+		expectedResponseCode: http.StatusConflict,
+		beforeTest: func(d Database) {
+			d.Upsert("orders"+SchemaId, SchemaId, []byte(ordersSchema))
+			d.Upsert("users", "jack", []byte(jsonPayload))
+			d.Upsert("users", "jill", []byte(jsonPayload))
+			d.Upsert("orders", "o1", []byte(`{"user":"jill"}`))
+		},
+		dbCheck: func(d Database) error {
+			users, err := d.GetAll("users")
+			if err != nil || len(users) != 2 {
+				return fmt.Errorf("expected the users not to be deleted")
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test ref cascade on namespace delete",
+		method:               http.MethodDelete,
+		path:                 "/ns/customers",
+		expectedResponseCode: http.StatusAccepted,
+		beforeTest: func(d Database) {
+			d.Upsert("invoices"+SchemaId, SchemaId, []byte(invoicesSchema))
+			d.Upsert("customers", "jack", []byte(jsonPayload))
+			d.Upsert("customers", "jill", []byte(jsonPayload))
+			d.Upsert("invoices", "i1", []byte(`{"customer":"jack"}`))
+			d.Upsert("invoices", "i2", []byte(`{"customer":"jill"}`))
+			d.Upsert("invoices", "i3", []byte(`{"customer":null}`))
+		},
+		dbCheck: func(d Database) error {
+			invoices, _ := d.GetAll("invoices")
+			if len(invoices) != 1 || invoices["i3"] == nil {
+				return fmt.Errorf("expected only the invoice without customer to be kept, got %v", len(invoices))
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test ref nullify on namespace delete",
+		method:               http.MethodDelete,
+		path:                 "/ns/authors",
+		expectedResponseCode: http.StatusAccepted,
+		beforeTest: func(d Database) {
+			d.Upsert("books"+SchemaId, SchemaId, []byte(booksSchema))
+			d.Upsert("authors", "jack", []byte(jsonPayload))
+			d.Upsert("books", "b1", []byte(`{"author":"jack","title":"on the road"}`))
+			d.Upsert("books"+MetaId, "b1", []byte(`{"user_id":"jill"}`))
+		},
+		dbCheck: func(d Database) error {
+			book, err := d.Get("books", "b1")
+			if err != nil {
+				return err
+			}
+			if string(book) != `{"author":null,"title":"on the road"}` {
+				return fmt.Errorf("expected the author to be null, got %s", book)
+			}
+			metadata, err := d.Get("books"+MetaId, "b1")
+			if err != nil || string(metadata) != `{"user_id":"jill"}` {
+				return fmt.Errorf("expected the book to keep its owner, got %s", metadata)
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test ref to the same namespace on namespace delete",
+		method:               http.MethodDelete,
+		path:                 "/ns/staff",
+		expectedResponseCode: http.StatusAccepted,
+		beforeTest: func(d Database) {
+			d.Upsert("staff"+SchemaId, SchemaId, []byte(`{"type":"object","properties":{"manager":{"type":"string","x-ref":{"namespace":"staff"}}}}`))
+			d.Upsert("staff", "jack", []byte(`{}`))
+			d.Upsert("staff", "jill", []byte(`{"manager":"jack"}`))
+		},
+	},
+	{
+		name:                 "test unique schema invalid",
+		method:               http.MethodPost,
+		path:                 "/schema/members",
+		payload:              `{"x-unique":[["email",""]]}`,
+		expectedResponseCode: http.StatusBadRequest,
+	},
+	{
+		name:                 "test unique schema on duplicates",
+		method:               http.MethodPost,
+		path:                 "/schema/members1",
+		payload:              membersSchema,
+		expectedResponseCode: http.StatusConflict,
+		expectedResponse:     `{"status":409,"message":"email must be unique in namespace 'members1', 'm1' has the same","key":"m1"}`,
+		beforeTest: func(d Database) {
+			d.Upsert("members1", "m1", []byte(`{"email":"jack@caffeine.io"}`))
+			d.Upsert("members1", "m2", []byte(`{"email":"jack@caffeine.io"}`))
+		},
+	},
+	{
+		name:                 "test unique conflict",
+		method:               http.MethodPost,
+		path:                 "/ns/members2/m2",
+		payload:              `{"email":"jack@caffeine.io"}`,
+		expectedResponseCode: http.StatusConflict,
+		expectedResponse:     `{"status":409,"message":"email must be unique in namespace 'members2', 'm1' has the same","key":"m1"}`,
+		beforeTest: func(d Database) {
+			d.Upsert("members2"+SchemaId, SchemaId, []byte(membersSchema))
+			d.Upsert("members2", "m1", []byte(`{"email":"jack@caffeine.io"}`))
+		},
+		dbCheck: func(d Database) error {
+			if _, err := d.Get("members2", "m2"); err == nil {
+				return fmt.Errorf("expected the duplicate not to be stored")
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test unique compound conflict",
+		method:               http.MethodPost,
+		path:                 "/ns/members3/m2",
+		payload:              `{"first":"jack","last":"never"}`,
+		expectedResponseCode: http.StatusConflict,
+		beforeTest: func(d Database) {
+			d.Upsert("members3"+SchemaId, SchemaId, []byte(membersSchema))
+			d.Upsert("members3", "m1", []byte(`{"first":"jack","last":"never"}`))
+		},
+	},
+	{
+		name:                 "test unique compound partial match",
+		method:               http.MethodPost,
+		path:                 "/ns/members4/m2",
+		payload:              `{"first":"jack","last":"sparrow"}`,
+		expectedResponseCode: http.StatusCreated,
+		beforeTest: func(d Database) {
+			d.Upsert("members4"+SchemaId, SchemaId, []byte(membersSchema))
+			d.Upsert("members4", "m1", []byte(`{"first":"jack","last":"never"}`))
+		},
+	},
+	{
+		name:                 "test unique update of the same key",
+		method:               http.MethodPost,
+		path:                 "/ns/members5/m1",
+		payload:              `{"email":"jack@caffeine.io","first":"jack"}`,
+		expectedResponseCode: http.StatusCreated,
+		beforeTest: func(d Database) {
+			d.Upsert("members5"+SchemaId, SchemaId, []byte(membersSchema))
+			d.Upsert("members5", "m1", []byte(`{"email":"jack@caffeine.io"}`))
+		},
+	},
+	{
+		name:                 "test schema check",
+		method:               http.MethodPost,
+		path:                 "/schema/people1/_check",
+		payload:              peopleSchema,
+		expectedResponseCode: http.StatusOK,
+		expectedResponse:     `{"valid":false,"checked":2,"invalid":[{"key":"p2","errors":["name: Invalid type. Expected: string, given: integer"]}]}`,
+		beforeTest: func(d Database) {
+			d.Upsert("people1", "p1", []byte(`{"name":"jack"}`))
+			d.Upsert("people1", "p2", []byte(`{"name":1}`))
+		},
+		dbCheck: func(d Database) error {
+			if _, err := d.Get("people1"+SchemaId, SchemaId); err == nil {
+				return fmt.Errorf("expected the schema not to be stored by a check")
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test schema check invalid schema",
+		method:               http.MethodPost,
+		path:                 "/schema/people1/_check",
+		payload:              `{"type":"nothing"}`,
+		expectedResponseCode: http.StatusBadRequest,
+	},
+	{
+		name:                 "test schema strict refused",
+		method:               http.MethodPost,
+		path:                 "/schema/people2?strict=true",
+		payload:              peopleSchema,
+		expectedResponseCode: http.StatusConflict,
+		expectedResponse:     `{"valid":false,"checked":1,"invalid":[{"key":"p1","errors":["(root): name is required"]}]}`,
+		beforeTest: func(d Database) {
+			d.Upsert("people2", "p1", []byte(`{"age":25}`))
+		},
+		dbCheck: func(d Database) error {
+			if _, err := d.Get("people2"+SchemaId, SchemaId); err == nil {
+				return fmt.Errorf("expected the schema not to be stored")
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test schema strict",
+		method:               http.MethodPost,
+		path:                 "/schema/people3?strict=true",
+		payload:              peopleSchema,
+		expectedResponseCode: http.StatusCreated,
+		beforeTest: func(d Database) {
+			d.Upsert("people3", "p1", []byte(`{"name":"jack"}`))
+		},
+	},
+	{
+		name:                 "test schema migrate",
+		method:               http.MethodPost,
+		path:                 "/schema/people4/_migrate",
+		payload:              peopleMigration,
+		expectedResponseCode: http.StatusCreated,
+		beforeTest: func(d Database) {
+			d.Upsert("people4"+SchemaId, SchemaId, []byte(peopleSchema))
+			d.Upsert("people4", "p1", []byte(`{"name":"jack never"}`))
+			d.Upsert("people4", "p2", []byte(`{"name":"jill never"}`))
+		},
+		dbCheck: func(d Database) error {
+			person, err := d.Get("people4", "p2")
+			if err != nil {
+				return err
+			}
+			var parsed map[string]interface{}
+			json.Unmarshal(person, &parsed)
+			if !cmp.Equal(parsed, map[string]interface{}{"first": "jill", "last": "never"}) {
+				return fmt.Errorf("unexpected migrated document %s", person)
+			}
+			schema, err := d.Get("people4"+SchemaId, SchemaId)
+			if err != nil || !strings.Contains(string(schema), "first") {
+				return fmt.Errorf("expected the new schema, got %s", schema)
+			}
+			return nil
+		},
+	},
+	{
+		name:                 "test schema migrate refused",
+		method:               http.MethodPost,
+		path:                 "/schema/people5/_migrate",
+		payload:              peopleMigration,
+		expectedResponseCode: http.StatusConflict,
+		expectedResponse:     `{"valid":false,"checked":2,"invalid":[{"key":"p2","errors":["last: Invalid type. Expected: string, given: null"]}]}`,
+		beforeTest: func(d Database) {
+			d.Upsert("people5"+SchemaId, SchemaId, []byte(peopleSchema))
+			d.Upsert("people5", "p1", []byte(`{"name":"jack never"}`))
+			d.Upsert("people5", "p2", []byte(`{"name":"jill"}`))
+		},
+		dbCheck: func(d Database) error {
+			person, err := d.Get("people5", "p1")
+			if err != nil || string(person) != `{"name":"jack never"}` {
+				return fmt.Errorf("expected the documents not to change, got %s", person)
+			}
+			return nil
+		},
+	},
+}
+
+func setupCaffeineTest(db Database) *TestingRouter {
+	db.Init()
+	db.Upsert(testNamespace, testKey, []byte(jsonPayload))
+
+	server := Server{
+		db: db,
+	}
+
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler("/", server.homeHandler)
+	testingRouter.AddHandler(NamespacePattern, server.namespaceHandler)
+	testingRouter.AddHandler(KeyValuePattern, server.keyValueHandler)
+	testingRouter.AddHandler(SchemaCheckPattern, server.schemaCheckHandler)
+	testingRouter.AddHandler(SchemaMigratePattern, server.schemaMigrateHandler)
+	testingRouter.AddHandler(SchemaPattern, server.schemaHandler)
+	testingRouter.AddHandler(TransformPattern, server.transformHandler)
+	testingRouter.AddHandler(HooksPattern, server.hooksHandler)
+	testingRouter.AddHandler(ExportPattern, server.exportHandler)
+	testingRouter.AddHandler(ImportPattern, server.importHandler)
+
+	return &testingRouter
+}
+
+func testHandlers(db Database, t *testing.T) {
+	for _, test := range tests {
+		testingRouter := setupCaffeineTest(db)
+		if test.beforeTest != nil {
+			test.beforeTest(db)
+		}
+		log.Println("running test: ", test.name)
+		req, _ := http.NewRequest(test.method, test.path, strings.NewReader(test.payload))
+		response := testingRouter.ExecuteRequest(req)
+		checkResponseCode(t, test.name, test.expectedResponseCode, response.Code)
+		if test.expectedResponse != "" {
+			checkResponse(t, test.name, response.Body.String(), test.expectedResponse)
+		}
+		if test.dbCheck != nil {
+			err := test.dbCheck(db)
+			if err != nil {
+				t.Errorf(err.Error())
+			}
+		}
+	}
+}
+
+func Test_UnitTest_MemoryDb(t *testing.T) {
+	testHandlers(&database.MemDatabase{}, t)
+}
+
+func Test_UnitTest_MemoryDbConcurrentGetAll(t *testing.T) {
+	db := &database.MemDatabase{}
+	db.Init()
+	db.Upsert(testNamespace, testKey, []byte(jsonPayload))
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			db.Upsert(testNamespace, fmt.Sprint(i), []byte(jsonPayload))
+		}
+		done <- true
+	}()
+	// the namespace changes while its documents are read
+	for i := 0; i < 1000; i++ {
+		all, _ := db.GetAll(testNamespace)
+		for key := range all {
+			_ = all[key]
+		}
+	}
+	<-done
+}
+
+func Test_UnitTest_StorageDb(t *testing.T) {
+	db := &database.StorageDatabase{
+		RootDirPath: "/tmp/caffeine_test1",
+	}
+	testHandlers(db, t)
+	os.RemoveAll("/tmp/caffeine_test1")
+}
+
+func Test_UnitTest_SQLiteDb(t *testing.T) {
+	os.MkdirAll("/tmp/caffeine", os.ModePerm)
+	db := &database.SQLiteDatabase{
+		DirPath: "/tmp/caffeine",
+	}
+	testHandlers(db, t)
+	os.RemoveAll("/tmp/caffeine")
+}
+
+func Test_UnitTest_RedisDb(t *testing.T) {
+	mr, err := miniredis.Run()
+	checkErr(t, err)
+	defer mr.Close()
+
+	db := &database.RedisDatabase{Addr: mr.Addr()}
+	testHandlers(db, t)
+	if !mr.Exists("caffeine:ns:" + testNamespace) {
+		t.Errorf("expected namespace '%v' stored as a hash", testNamespace)
+	}
+	if dbErr := db.UpsertBatch("empty", map[string][]byte{}); dbErr != nil {
+		t.Errorf("expected an empty batch to be a no-op, got %v", dbErr)
+	}
+	checkErr(t, db.Close())
+}
+
+func Test_UnitTest_RedisBus(t *testing.T) {
+	mr, err := miniredis.Run()
+	checkErr(t, err)
+	defer mr.Close()
+
+	// two instances sharing the same redis
+	subscriber := &RedisBus{Client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	publisher := &RedisBus{Client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+
+	received := make(chan []byte, 1)
+	checkErr(t, subscriber.Subscribe(func(event []byte) {
+		received <- event
+	}))
+	checkErr(t, publisher.Publish([]byte(jsonPayload)))
+
+	select {
+	case event := <-received:
+		checkResponse(t, "bus event", string(event), jsonPayload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+	}
+}
+
+func Test_UnitTest_DumpRestore(t *testing.T) {
+	source := Server{db: &database.MemDatabase{}}
+	source.db.Init()
+	source.db.Upsert("user"+SchemaId, SchemaId, []byte(getUserSchema()))
+	source.db.Upsert("user", "1", []byte(validJsonForSchema))
+	source.db.Upsert("user"+MetaId, "1", []byte(`{"user_id":"johnd"}`))
+	source.db.Upsert(testNamespace, testKey, []byte(jsonPayload))
+
+	var archive bytes.Buffer
+	checkErr(t, source.dump(&archive))
+
+	target := Server{db: &database.MemDatabase{}}
+	target.db.Init()
+	namespaces, count, err := target.restore(&archive, func(namespace string, r io.Reader) (int, error) {
+		return target.importNamespace(namespace, r, "janed")
+	})
+	checkErr(t, err)
+	if namespaces != 2 || count != 2 {
+		t.Fatalf("expected 2 namespaces and 2 documents, got %v and %v", namespaces, count)
+	}
+	// the archive can't choose the owners
+	metadata, _ := target.db.Get("user"+MetaId, "1")
+	checkResponse(t, "restored owner", string(metadata), `{"user_id":"janed"}`)
+
+	for _, namespace := range []string{"user", "user" + SchemaId, "user" + MetaId, testNamespace} {
+		want, _ := source.db.GetAll(namespace)
+		got, _ := target.db.GetAll(namespace)
+		if len(want) != len(got) {
+			t.Errorf("namespace %v: expected %v entries, got %v", namespace, len(want), len(got))
+		}
+	}
+}
+
+func Test_UnitTest_Migrate(t *testing.T) {
+	source := &database.MemDatabase{}
+	source.Init()
+	source.Upsert("user"+SchemaId, SchemaId, []byte(getUserSchema()))
+	source.Upsert("user", "1", []byte(validJsonForSchema))
+	source.Upsert(testNamespace, testKey, []byte(jsonPayload))
+
+	destination := &database.StorageDatabase{
+		RootDirPath: "/tmp/caffeine_migrate",
+	}
+	destination.Init()
+	defer os.RemoveAll("/tmp/caffeine_migrate")
+
+	migration := Migration{
+		From:      source,
+		To:        destination,
+		StatePath: "/tmp/caffeine_migrate/.state",
+	}
+	report, err := migration.Run()
+	checkErr(t, err)
+	if report.Namespaces != 3 || report.Keys != 3 {
+		t.Fatalf("expected 3 namespaces and 3 keys, got %v and %v", report.Namespaces, report.Keys)
+	}
+	value, dbErr := destination.Get("user", "1")
+	if dbErr != nil {
+		t.Fatalf("error: %v", dbErr)
+	}
+	checkResponse(t, "migrated value", string(value), validJsonForSchema)
+
+	// a second run resumes from the state file and copies nothing
+	report, err = migration.Run()
+	checkErr(t, err)
+	if report.Skipped != 3 || report.Keys != 0 {
+		t.Fatalf("expected 3 skipped namespaces, got %v (%v keys)", report.Skipped, report.Keys)
+	}
+}
+
+func Test_UnitTest_MemoryDbSnapshot(t *testing.T) {
+	dir := "/tmp/caffeine_snapshot"
+	defer os.RemoveAll(dir)
+
+	db := &database.MemDatabase{SnapshotDir: dir, FsyncPolicy: database.FsyncAlways}
+	db.Init()
+	db.Upsert(testNamespace, testKey, []byte(jsonPayload))
+	db.Upsert(testNamespace, "key2", []byte(jsonPayload))
+	checkErr(t, db.Snapshot())
+	// these are only in the write log
+	db.Delete(testNamespace, "key2")
+	db.Upsert("test", "1", []byte(validJsonForSchema))
+
+	// simulate a crash: no Close, a new instance replays snapshot and log
+	restarted := &database.MemDatabase{SnapshotDir: dir}
+	restarted.Init()
+	defer restarted.Close()
+
+	value, dbErr := restarted.Get(testNamespace, testKey)
+	if dbErr != nil {
+		t.Fatalf("error: %v", dbErr)
+	}
+	checkResponse(t, "value from snapshot", string(value), jsonPayload)
+	if _, dbErr = restarted.Get(testNamespace, "key2"); dbErr == nil {
+		t.Errorf("deleted key restored from snapshot")
+	}
+	value, dbErr = restarted.Get("test", "1")
+	if dbErr != nil {
+		t.Fatalf("error: %v", dbErr)
+	}
+	checkResponse(t, "value from write log", string(value), validJsonForSchema)
+}
+
+func Test_UnitTest_StorageDbQuarantine(t *testing.T) {
+	dir := "/tmp/caffeine_quarantine"
+	defer os.RemoveAll(dir)
+
+	db := &database.StorageDatabase{RootDirPath: dir}
+	db.Init()
+	db.Upsert(testNamespace, testKey, []byte(jsonPayload))
+	// a write truncated by a crash
+	checkErr(t, os.WriteFile(dir+"/"+testNamespace+"/key2.json", []byte(`{"age":2`), 0644))
+
+	db.Init()
+	data, dbErr := db.GetAll(testNamespace)
+	if dbErr != nil {
+		t.Fatalf("error: %v", dbErr)
+	}
+	if len(data) != 1 {
+		t.Errorf("expected only the valid document, got %v", len(data))
+	}
+	quarantined, err := os.ReadDir(dir + "/.quarantine/" + testNamespace)
+	checkErr(t, err)
+	if len(quarantined) != 1 {
+		t.Errorf("expected the corrupted document in quarantine, got %v files", len(quarantined))
+	}
+	checkResponse(t, "namespaces", strings.Join(db.GetNamespaces(), ","), testNamespace)
+
+	// documents are checked when read, not at startup
+	checkErr(t, os.WriteFile(dir+"/"+testNamespace+"/key3.json", []byte(`{"age":3`), 0644))
+	db.Init()
+	if _, err := os.Stat(dir + "/" + testNamespace + "/key3.json"); err != nil {
+		t.Errorf("expected the startup not to read the documents, got %v", err)
+	}
+	if _, dbErr := db.Get(testNamespace, "key3"); dbErr == nil {
+		t.Errorf("expected the corrupted document not to be returned")
+	}
+	quarantined, err = os.ReadDir(dir + "/.quarantine/" + testNamespace)
+	checkErr(t, err)
+	if len(quarantined) != 2 {
+		t.Errorf("expected the corrupted document in quarantine, got %v files", len(quarantined))
+	}
+}
+
+func Test_UnitTest_StorageDbLayoutMigration(t *testing.T) {
+	dir := "/tmp/caffeine_layout"
+	defer os.RemoveAll(dir)
+
+	// data written by a version without layout: raw keys as filenames
+	checkErr(t, os.MkdirAll(dir+"/"+testNamespace, 0755))
+	checkErr(t, os.WriteFile(dir+"/"+testNamespace+"/"+testKey+".json", []byte(jsonPayload), 0644))
+	checkErr(t, os.WriteFile(dir+"/"+testNamespace+"/v1.2.json", []byte(jsonPayload), 0644))
+
+	for _, sharded := range []bool{true, false} {
+		db := &database.StorageDatabase{RootDirPath: dir, Sharded: sharded}
+		db.Init()
+		db.Upsert(testNamespace, "a/b.c", []byte(jsonPayload))
+
+		data, dbErr := db.GetAll(testNamespace)
+		if dbErr != nil {
+			t.Fatalf("error: %v", dbErr)
+		}
+		for _, key := range []string{testKey, "v1.2", "a/b.c"} {
+			if string(data[key]) != jsonPayload {
+				t.Errorf("sharded %v: key '%v' not found after migration", sharded, key)
+			}
+		}
+		if len(data) != 3 {
+			t.Errorf("sharded %v: expected 3 documents, got %v", sharded, len(data))
+		}
+	}
+}
+
+func Test_UnitTest_SQLiteDbCatalog(t *testing.T) {
+	dir := "/tmp/caffeine_catalog"
+	checkErr(t, os.MkdirAll(dir, os.ModePerm))
+	defer os.RemoveAll(dir)
+
+	// a table created by a previous version and one caffeine doesn't own
+	legacy, err := sql.Open("sqlite3", dir+"/caffeine")
+	checkErr(t, err)
+	_, err = legacy.Exec("CREATE TABLE legacy ( id string PRIMARY KEY, data string NOT NULL)")
+	checkErr(t, err)
+	_, err = legacy.Exec("INSERT INTO legacy (id, data) VALUES ('1', '{}')")
+	checkErr(t, err)
+	_, err = legacy.Exec("CREATE TABLE accounts ( name string, balance integer)")
+	checkErr(t, err)
+	// id and data columns, but not created by caffeine
+	_, err = legacy.Exec("CREATE TABLE app_sessions ( id string PRIMARY KEY, data string NOT NULL)")
+	checkErr(t, err)
+	_, err = legacy.Exec("CREATE TABLE orders ( id integer PRIMARY KEY, data blob, total integer)")
+	checkErr(t, err)
+	legacy.Close()
+
+	db := &database.SQLiteDatabase{DirPath: dir}
+	db.Init()
+	oddNamespace := `drop table accounts; -- "`
+	if dbErr := db.Upsert(oddNamespace, testKey, []byte(jsonPayload)); dbErr != nil {
+		t.Fatalf("error: %v", dbErr)
+	}
+	value, dbErr := db.Get(oddNamespace, testKey)
+	if dbErr != nil {
+		t.Fatalf("error: %v", dbErr)
+	}
+	checkResponse(t, "odd namespace", string(value), jsonPayload)
+	checkResponse(t, "namespaces", strings.Join(db.GetNamespaces(), ","), oddNamespace+",legacy")
+
+	if dbErr = db.DeleteAll("accounts"); dbErr == nil || dbErr.ErrorCode != database.NAMESPACE_NOT_FOUND {
+		t.Errorf("expected tables outside the catalog to be unreachable, got %v", dbErr)
+	}
+
+	// migrations are recorded and not applied twice
+	reopened := &database.SQLiteDatabase{DirPath: dir}
+	reopened.Init()
+	checkResponse(t, "namespaces after restart", strings.Join(reopened.GetNamespaces(), ","), oddNamespace+",legacy")
+	check, err := sql.Open("sqlite3", dir+"/caffeine")
+	checkErr(t, err)
+	defer check.Close()
+	var applied int
+	checkErr(t, check.QueryRow("SELECT count(*) FROM caffeine_migrations").Scan(&applied))
+	if applied != 1 {
+		t.Errorf("expected 1 applied migration, got %v", applied)
+	}
+}
+
+func Test_UnitTest_SQLiteDbConcurrentWrites(t *testing.T) {
+	dir := "/tmp/caffeine_sqlite_writes"
+	defer os.RemoveAll(dir)
+
+	db := &database.SQLiteDatabase{DirPath: dir, WriteBatch: 8}
+	db.Init()
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan *database.DbError, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- db.Upsert("concurrent", strconv.Itoa(i), []byte(jsonPayload))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for dbErr := range errs {
+		if dbErr != nil {
+			t.Fatalf("error on concurrent write: %v", dbErr)
+		}
+	}
+	all, dbErr := db.GetAll("concurrent")
+	if dbErr != nil {
+		t.Fatalf("error: %v", dbErr)
+	}
+	if len(all) != 100 {
+		t.Errorf("expected 100 documents, got %v", len(all))
+	}
+
+	// creating namespaces writes to the catalog, through the writer as well
+	errs = make(chan *database.DbError, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			namespace := "concurrent" + strconv.Itoa(i)
+			if dbErr := db.Upsert(namespace, testKey, []byte(jsonPayload)); dbErr != nil {
+				errs <- dbErr
+				return
+			}
+			errs <- db.DeleteAll(namespace)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for dbErr := range errs {
+		if dbErr != nil {
+			t.Fatalf("error on concurrent namespace creation: %v", dbErr)
+		}
+	}
+	checkResponse(t, "namespaces", strings.Join(db.GetNamespaces(), ","), "concurrent")
+}
+
+func Test_UnitTest_BoltDb(t *testing.T) {
+	dir := "/tmp/caffeine_bolt"
+	defer os.RemoveAll(dir)
+
+	source := &database.MemDatabase{}
+	source.Init()
+	for _, key := range []string{"3", "1", "2"} {
+		source.Upsert(testNamespace, key, []byte(jsonPayload))
+	}
+
+	db := &database.BoltDatabase{DirPath: dir}
+	db.Init()
+	// the migration writes through UpsertBatch
+	migration := Migration{From: source, To: db}
+	_, err := migration.Run()
+	checkErr(t, err)
+
+	all, dbErr := db.GetAll(testNamespace)
+	if dbErr != nil {
+		t.Fatalf("error: %v", dbErr)
+	}
+	checkResponse(t, "keys", strings.Join(sortedKeys(all), ","), "1,2,3")
+	for _, key := range []string{"10", "20"} {
+		if dbErr = db.Upsert(testNamespace, key, []byte(jsonPayload)); dbErr != nil {
+			t.Fatalf("error: %v", dbErr)
+		}
+	}
+	values, dbErr := db.GetRange(testNamespace, "2", 5)
+	if dbErr != nil {
+		t.Fatalf("error: %v", dbErr)
+	}
+	keys := make([]string, 0, len(values))
+	for _, value := range values {
+		keys = append(keys, value.Key)
+	}
+	checkResponse(t, "range", strings.Join(keys, ","), "2,20,3")
+
+	if dbErr = db.Delete(testNamespace, "4"); dbErr == nil || dbErr.ErrorCode != database.ID_NOT_FOUND {
+		t.Errorf("expected ID_NOT_FOUND, got %v", dbErr)
+	}
+	checkErr(t, db.Close())
+
+	reopened := &database.BoltDatabase{DirPath: dir}
+	reopened.Init()
+	defer reopened.Close()
+	value, dbErr := reopened.Get(testNamespace, "2")
+	if dbErr != nil {
+		t.Fatalf("error: %v", dbErr)
+	}
+	checkResponse(t, "value after reopen", string(value), jsonPayload)
+	if dbErr = reopened.DeleteAll(testNamespace); dbErr != nil {
+		t.Fatalf("error: %v", dbErr)
+	}
+	if _, dbErr = reopened.GetAll(testNamespace); dbErr == nil || dbErr.ErrorCode != database.NAMESPACE_NOT_FOUND {
+		t.Errorf("expected NAMESPACE_NOT_FOUND, got %v", dbErr)
+	}
+}
+
+func Test_UnitTest_S3Db(t *testing.T) {
+	s3 := newFakeS3()
+	defer s3.Close()
+	newDb := func() *database.S3Database {
+		return &database.S3Database{
+			Endpoint:  s3.Listener.Addr().String(),
+			Bucket:    "caffeine",
+			Region:    "us-east-1",
+			Secure:    true,
+			Transport: s3.Client().Transport,
+		}
+	}
+	testHandlers(newDb(), t)
+
+	// the fake returns at most 2 objects per page
+	db := newDb()
+	db.Init()
+	for i := 0; i < 5; i++ {
+		db.Upsert("paged", strconv.Itoa(i), []byte(jsonPayload))
+	}
+	all, dbErr := db.GetAll("paged")
+	if dbErr != nil {
+		t.Fatalf("error: %v", dbErr)
+	}
+	if len(all) != 5 {
+		t.Errorf("expected 5 documents, got %v", len(all))
+	}
+
+	// conditional writes
+	testingRouter := setupCaffeineTest(newDb())
+	req, _ := http.NewRequest(http.MethodGet, "/ns/"+testNamespace+"/"+testKey, nil)
+	response := testingRouter.ExecuteRequest(req)
+	checkResponseCode(t, "get with etag", http.StatusOK, response.Code)
+	etag := response.Header().Get(ETagHeader)
+	if etag == "" {
+		t.Fatal("expected an ETag header")
+	}
+	for _, test := range []struct {
+		name         string
+		ifMatch      string
+		expectedCode int
+	}{
+		{"write with current etag", etag, http.StatusCreated},
+		{"write with stale etag", etag, http.StatusPreconditionFailed},
+	} {
+		req, _ = http.NewRequest(http.MethodPost, "/ns/"+testNamespace+"/"+testKey, strings.NewReader(`{"age":26,"name":"jack"}`))
+		req.Header.Set(IfMatchHeader, test.ifMatch)
+		response = testingRouter.ExecuteRequest(req)
+		checkResponseCode(t, test.name, test.expectedCode, response.Code)
+	}
+}
+
+type fakeS3Object struct {
+	data []byte
+	etag string
+}
+
+type fakeS3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []struct {
+		Key  string
+		ETag string
+		Size int
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// newFakeS3 is an in-process stand-in for the subset of the S3 API used by S3Database
+func newFakeS3() *httptest.Server {
+	var mu sync.Mutex
+	buckets := make(map[string]map[string]fakeS3Object)
+	s3Error := func(w http.ResponseWriter, status int, code string) {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "<Error><Code>%v</Code><Message>%v</Message></Error>", code, code)
+	}
+
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		bucket, exists := buckets[parts[0]]
+		if len(parts) == 1 || parts[1] == "" {
+			switch {
+			case r.Method == http.MethodPut:
+				buckets[parts[0]] = make(map[string]fakeS3Object)
+			case !exists:
+				s3Error(w, http.StatusNotFound, "NoSuchBucket")
+			case r.Method == http.MethodPost && r.URL.Query().Has("delete"):
+				var request struct {
+					Object []struct{ Key string }
+				}
+				xml.NewDecoder(r.Body).Decode(&request)
+				fmt.Fprint(w, "<DeleteResult>")
+				for _, object := range request.Object {
+					delete(bucket, object.Key)
+					fmt.Fprintf(w, "<Deleted><Key>%v</Key></Deleted>", object.Key)
+				}
+				fmt.Fprint(w, "</DeleteResult>")
+			case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+				query := r.URL.Query()
+				prefix, delimiter, token := query.Get("prefix"), query.Get("delimiter"), query.Get("continuation-token")
+				keys := make([]string, 0)
+				for key := range bucket {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				result := fakeS3ListResult{Name: parts[0], Prefix: prefix, MaxKeys: 2}
+				last := ""
+				for _, key := range keys {
+					if !strings.HasPrefix(key, prefix) || key <= token || (strings.HasSuffix(token, "/") && strings.HasPrefix(key, token)) {
+						continue
+					}
+					entry := key
+					if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+						entry = key[:len(prefix)+i+1]
+						if entry == last {
+							continue
+						}
+					}
+					if result.KeyCount == result.MaxKeys {
+						result.IsTruncated = true
+						result.NextContinuationToken = last
+						break
+					}
+					if strings.HasSuffix(entry, delimiter) && delimiter != "" {
+						result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{entry})
+					} else {
+						result.Contents = append(result.Contents, struct {
+							Key  string
+							ETag string
+							Size int
+						}{key, bucket[key].etag, len(bucket[key].data)})
+					}
+					result.KeyCount++
+					last = entry
+				}
+				xml.NewEncoder(w).Encode(result)
+			default:
+				w.WriteHeader(http.StatusOK)
+			}
+			return
+		}
+		if !exists {
+			s3Error(w, http.StatusNotFound, "NoSuchBucket")
+			return
+		}
+
+		key := parts[1]
+		object, found := bucket[key]
+		switch r.Method {
+		case http.MethodPut:
+			if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && (!found || `"`+object.etag+`"` != ifMatch) {
+				s3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+				return
+			}
+			data, _ := io.ReadAll(r.Body)
+			object = fakeS3Object{data: data, etag: fmt.Sprintf("%x", md5.Sum(data))}
+			bucket[key] = object
+			w.Header().Set("ETag", `"`+object.etag+`"`)
+		case http.MethodGet, http.MethodHead:
+			if !found {
+				s3Error(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			w.Header().Set("ETag", `"`+object.etag+`"`)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			if r.Method == http.MethodGet {
+				w.Write(object.data)
+			}
+		case http.MethodDelete:
+			delete(bucket, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+// countingDatabase counts the reads reaching the wrapped database
+type countingDatabase struct {
+	Database
+	gets int
+	alls map[string]int
+}
+
+func (c *countingDatabase) Get(namespace string, key string) ([]byte, *database.DbError) {
+	c.gets++
+	return c.Database.Get(namespace, key)
+}
+
+func (c *countingDatabase) GetAll(namespace string) (map[string][]byte, *database.DbError) {
+	if c.alls == nil {
+		c.alls = make(map[string]int)
+	}
+	c.alls[namespace]++
+	return c.Database.GetAll(namespace)
+}
+
+// slowDatabase signals a Get, completing it once released
+type slowDatabase struct {
+	Database
+	read    chan bool
+	release chan bool
+	once    sync.Once
+}
+
+func (s *slowDatabase) Get(namespace string, key string) ([]byte, *database.DbError) {
+	value, dbErr := s.Database.Get(namespace, key)
+	s.once.Do(func() {
+		s.read <- true
+		<-s.release
+	})
+	return value, dbErr
+}
+
+// failingDatabase fails the writes of a key
+type failingDatabase struct {
+	Database
+	namespace string
+	key       string
+}
+
+func (f *failingDatabase) Upsert(namespace string, key string, value []byte) *database.DbError {
+	if namespace == f.namespace && key == f.key {
+		return &database.DbError{ErrorCode: database.INTERNAL_ERROR, Message: "write failed"}
+	}
+	return f.Database.Upsert(namespace, key, value)
+}
+
+func Test_UnitTest_CachedDb(t *testing.T) {
+	testHandlers(NewCachedDatabase(&database.MemDatabase{}, CacheOptions{MaxEntries: 100}), t)
+
+	counting := &countingDatabase{Database: &database.MemDatabase{}}
+	db := NewCachedDatabase(counting, CacheOptions{MaxEntries: 2, TTL: 50 * time.Millisecond})
+	db.Init()
+	db.Upsert(testNamespace, "1", []byte(jsonPayload))
+	db.Upsert(testNamespace, "2", []byte(jsonPayload))
+
+	db.Get(testNamespace, "1")
+	db.Get(testNamespace, "1")
+	// misses are cached too, e.g. the schema lookups of namespaces without schema
+	db.Get(testNamespace+SchemaId, SchemaId)
+	db.Get(testNamespace+SchemaId, SchemaId)
+	if counting.gets != 2 {
+		t.Errorf("expected 2 reads reaching the database, got %v", counting.gets)
+	}
+
+	db.Upsert(testNamespace+SchemaId, SchemaId, []byte(getUserSchema()))
+	schema, dbErr := db.Get(testNamespace+SchemaId, SchemaId)
+	if dbErr != nil || string(schema) != getUserSchema() {
+		t.Errorf("expected the cache to be invalidated by the write, got %v", dbErr)
+	}
+
+	// "1" is the least recently used entry, evicted by "2" (MaxEntries is 2)
+	db.Get(testNamespace, "2")
+	counting.gets = 0
+	db.Get(testNamespace, "1")
+	if counting.gets != 1 {
+		t.Errorf("expected the least recently used entry to be evicted")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	db.Get(testNamespace, "1")
+	if counting.gets != 2 {
+		t.Errorf("expected the entry to expire")
+	}
+
+	// a read started before a write doesn't fill the cache with the old value
+	slow := &slowDatabase{Database: &database.MemDatabase{}, read: make(chan bool), release: make(chan bool)}
+	db = NewCachedDatabase(slow, CacheOptions{MaxEntries: 100})
+	db.Init()
+	db.Upsert(testNamespace, "1", []byte(`{"v":1}`))
+	go func() {
+		<-slow.read
+		db.Upsert(testNamespace, "1", []byte(`{"v":2}`))
+		slow.release <- true
+	}()
+	db.Get(testNamespace, "1")
+	value, _ := db.Get(testNamespace, "1")
+	if string(value) != `{"v":2}` {
+		t.Errorf("expected the value written during the read, got %v", string(value))
+	}
+
+	// a write creating the namespace drops the cached "namespace not found" of other keys
+	db = NewCachedDatabase(&database.MemDatabase{}, CacheOptions{MaxEntries: 100})
+	db.Init()
+	db.Get("created", "1")
+	db.Upsert("created", "2", []byte(jsonPayload))
+	_, dbErr = db.Get("created", "1")
+	if dbErr == nil || dbErr.ErrorCode != database.ID_NOT_FOUND {
+		t.Errorf("expected id not found, got %v", dbErr)
+	}
+
+	// the optional capabilities of the cached database are kept, and only those
+	if _, ok := NewCachedDatabase(&database.BoltDatabase{}, CacheOptions{}).(BatchDatabase); !ok {
+		t.Errorf("expected the cache to forward UpsertBatch")
+	}
+	if _, ok := NewCachedDatabase(&database.SQLiteDatabase{}, CacheOptions{}).(UniqueDatabase); !ok {
+		t.Errorf("expected the cache to forward EnsureUnique")
+	}
+	if _, ok := NewCachedDatabase(&database.MemDatabase{}, CacheOptions{}).(BatchDatabase); ok {
+		t.Errorf("expected the cache not to batch for a database unable to")
+	}
+
+	var schemas schemaCache
+	first, err := schemas.get(testNamespace, []byte(getUserSchema()))
+	checkErr(t, err)
+	second, err := schemas.get(testNamespace, []byte(getUserSchema()))
+	checkErr(t, err)
+	if first != second {
+		t.Errorf("expected the compiled schema to be reused")
+	}
+	third, err := schemas.get(testNamespace, []byte(`{"type":"object"}`))
+	checkErr(t, err)
+	if third == first {
+		t.Errorf("expected a changed schema to be recompiled")
+	}
+}
+
+func Test_UnitTest_Cluster(t *testing.T) {
+	mr, err := miniredis.Run()
+	checkErr(t, err)
+	defer mr.Close()
+
+	// two instances with their own cache, sharing storage and bus
+	storage := &database.MemDatabase{}
+	storage.Init()
+	newInstance := func() (*Server, chan []byte) {
+		s := &Server{
+			Bus:    &RedisBus{Client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+			db:     NewCachedDatabase(storage, CacheOptions{MaxEntries: 100}),
+			broker: NewServer(),
+		}
+		checkErr(t, s.subscribe())
+		client := make(chan []byte, 10)
+		s.broker.newClients <- client
+		return s, client
+	}
+	a, clientA := newInstance()
+	b, clientB := newInstance()
+
+	b.db.Upsert(testNamespace, testKey, []byte(jsonPayload))
+	b.db.Get(testNamespace, testKey)
+	a.db.Upsert(testNamespace, testKey, []byte(validJsonForSchema))
+	a.Notify(BrokerEvent{Event: EVENT_ITEM_ADDED, Namespace: testNamespace, Key: testKey})
+
+	for name, client := range map[string]chan []byte{"instance a": clientA, "instance b": clientB} {
+		select {
+		case event := <-client:
+			checkResponse(t, name, string(event), `{"event":"ITEM_ADDED","namespace":"`+testNamespace+`","key":"`+testKey+`"}`)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: event not delivered", name)
+		}
+	}
+	value, _ := b.db.Get(testNamespace, testKey)
+	checkResponse(t, "invalidated cache", string(value), validJsonForSchema)
+
+	// a message delivered twice, e.g. by two buses, reaches the clients once
+	message, _ := json.Marshal(busMessage{Id: "other:1", Origin: "other", Namespace: testNamespace, Event: []byte(`{}`)})
+	b.dispatch(message)
+	b.dispatch(message)
+	time.Sleep(50 * time.Millisecond)
+	if len(clientB) != 1 {
+		t.Errorf("expected the duplicated message to be delivered once, got %v", len(clientB))
+	}
+}
+
+func Test_UnitTest_Replication(t *testing.T) {
+	leader := &Server{db: &database.MemDatabase{}}
+	leader.db.Init()
+	leader.db.Upsert(testNamespace, testKey, []byte(jsonPayload))
+	leader.db.Upsert("user"+SchemaId, SchemaId, []byte(getUserSchema()))
+	// stored before the schema, that rejects it now
+	leader.db.Upsert("user", "2", []byte(invalidJsonForSchema))
+	leader.db.Upsert("user"+MetaId, "2", []byte(`{"user_id":"johnd"}`))
+	router := mux.NewRouter()
+	router.HandleFunc(KeyValuePattern, leader.keyValueHandler)
+	router.HandleFunc(SchemaPattern, leader.schemaHandler)
+	router.HandleFunc(ReplicationSnapshotPattern, leader.replicationSnapshotHandler)
+	var streams int32
+	router.HandleFunc(ReplicationStreamPattern, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&streams, 1)
+		leader.replicationStreamHandler(w, r)
+	})
+	ts := httptest.NewUnstartedServer(router)
+	// the streams outlive the timeouts
+	ts.Config.WriteTimeout = 200 * time.Millisecond
+	ts.Config.ReadTimeout = 200 * time.Millisecond
+	ts.Config.ConnContext = withConn
+	ts.Start()
+	defer ts.Close()
+	// the streams to the followers never end by themselves
+	defer ts.CloseClientConnections()
+
+	dir := t.TempDir()
+	// every follower keeps its own offset
+	newFollower := func(offsetPath string) *Server {
+		follower := &Server{
+			db:      &database.MemDatabase{},
+			Replica: &Replica{LeaderURL: ts.URL, OffsetPath: offsetPath},
+			Feed:    &ChangeFeed{},
+		}
+		follower.db.Init()
+		return follower
+	}
+	waitFor := func(name string, check func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !check() {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v: follower did not converge", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// compares JSON values, whatever their formatting
+	hasValue := func(s *Server, namespace string, key string, want string) func() bool {
+		return func() bool {
+			value, dbErr := s.db.Get(namespace, key)
+			var got, expected interface{}
+			return dbErr == nil && json.Unmarshal(value, &got) == nil && json.Unmarshal([]byte(want), &expected) == nil && cmp.Equal(got, expected)
+		}
+	}
+
+	follower := newFollower(dir + "/replica.offset")
+	go follower.Replica.run(follower)
+	waitFor("snapshot", hasValue(follower, testNamespace, testKey, jsonPayload))
+	waitFor("snapshot schema", hasValue(follower, "user"+SchemaId, SchemaId, getUserSchema()))
+	// the snapshot is loaded as it is, with the owners
+	waitFor("snapshot of a rejected document", hasValue(follower, "user", "2", invalidJsonForSchema))
+	waitFor("snapshot owner", hasValue(follower, "user"+MetaId, "2", `{"user_id":"johnd"}`))
+	waitFor("stream", follower.Replica.isConnected)
+	time.Sleep(300 * time.Millisecond)
+
+	post := func(path string, payload string) {
+		resp, err := http.Post(ts.URL+path, "application/json", strings.NewReader(payload))
+		checkErr(t, err)
+		resp.Body.Close()
+	}
+	post("/ns/user/1", validJsonForSchema)
+	waitFor("upsert", hasValue(follower, "user", "1", validJsonForSchema))
+	// the stored bytes are streamed, keeping the keys order and the large numbers
+	exact := `{"z":1,"a":12345678901234567890}`
+	post("/ns/numbers/1", exact)
+	waitFor("exact upsert", func() bool {
+		value, dbErr := follower.db.Get("numbers", "1")
+		return dbErr == nil && string(value) == exact
+	})
+	post("/schema/other", `{"required":["name"]}`)
+	waitFor("schema", hasValue(follower, "other"+SchemaId, SchemaId, `{"required":["name"]}`))
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/ns/"+testNamespace+"/"+testKey, nil)
+	resp, err := http.DefaultClient.Do(req)
+	checkErr(t, err)
+	resp.Body.Close()
+	waitFor("delete", func() bool {
+		_, dbErr := follower.db.Get(testNamespace, testKey)
+		return dbErr != nil
+	})
+	epoch, seq := leader.changes.offset()
+	waitFor("offset", func() bool { return follower.Replica.offset() == formatOffset(epoch, seq) })
+	if n := atomic.LoadInt32(&streams); n != 1 {
+		t.Errorf("expected a single stream past the server timeouts, got %v", n)
+	}
+	// the leader already recorded the changes, followers only notify their clients
+	if changes, _ := follower.db.GetAll(ChangesNamespace); len(changes) > 0 {
+		t.Errorf("expected no change feed on the follower, got %v changes", len(changes))
+	}
+
+	// an offset of a previous life of the leader needs a new snapshot, replacing everything
+	checkErr(t, os.WriteFile(dir+"/restarted.offset", []byte("stale:3"), 0644))
+	restarted := newFollower(dir + "/restarted.offset")
+	restarted.db.Upsert("leftover", testKey, []byte(jsonPayload))
+	go restarted.Replica.run(restarted)
+	waitFor("new snapshot", hasValue(restarted, "user", "1", validJsonForSchema))
+	if _, dbErr := restarted.db.GetAll("leftover"); dbErr == nil {
+		t.Errorf("expected the snapshot to replace the local data")
+	}
+
+	// followers serve reads only
+	readOnly := mux.NewRouter()
+	readOnly.HandleFunc(KeyValuePattern, restarted.keyValueHandler)
+	readOnly.Use(restarted.readOnly)
+	for method, want := range map[string]int{http.MethodGet: http.StatusOK, http.MethodPost: http.StatusForbidden, http.MethodDelete: http.StatusForbidden} {
+		req, _ := http.NewRequest(method, "/ns/user/1", strings.NewReader(validJsonForSchema))
+		response := httptest.NewRecorder()
+		readOnly.ServeHTTP(response, req)
+		checkResponseCode(t, "replica "+method, want, response.Code)
+	}
+}
+
+func Test_UnitTest_ChangeFeed(t *testing.T) {
+	dir := t.TempDir()
+	// read as a whole, or by range
+	testChangeFeed(t, &database.MemDatabase{})
+	testChangeFeed(t, &database.SQLiteDatabase{DirPath: dir})
+	bolt := &database.BoltDatabase{DirPath: dir}
+	testChangeFeed(t, bolt)
+	bolt.Close()
+	// ranges are read behind the cache
+	testChangeFeed(t, NewCachedDatabase(&database.SQLiteDatabase{DirPath: t.TempDir()}, CacheOptions{MaxEntries: 100}))
+
+	// without ranges the feed is read whole only when loaded, at every start
+	counting := &countingDatabase{Database: &database.MemDatabase{}}
+	testChangeFeed(t, counting)
+	if n := counting.alls[ChangesNamespace]; n != 2 {
+		t.Errorf("expected the feed to be read whole twice, got %v", n)
+	}
+}
+
+func testChangeFeed(t *testing.T, db Database) {
+	server := Server{db: db, Feed: &ChangeFeed{}}
+	server.db.Init()
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler("/", server.homeHandler)
+	testingRouter.AddHandler(KeyValuePattern, server.keyValueHandler)
+	testingRouter.AddHandler(ChangesPattern, server.changesHandler)
+	testingRouter.AddHandler(NamespaceChangesPattern, server.changesHandler)
+	execute := func(method string, path string, payload string) string {
+		req, _ := http.NewRequest(method, path, strings.NewReader(payload))
+		response := testingRouter.ExecuteRequest(req)
+		if response.Code >= 300 {
+			t.Fatalf("%v %v: unexpected status %v", method, path, response.Code)
+		}
+		return response.Body.String()
+	}
+	type changes struct {
+		Results []Change `json:"results"`
+		LastSeq uint64   `json:"last_seq"`
+		Pending int      `json:"pending"`
+	}
+	poll := func(path string) (ret changes) {
+		checkErr(t, json.Unmarshal([]byte(execute(http.MethodGet, path, "")), &ret))
+		return ret
+	}
+
+	execute(http.MethodPost, "/ns/"+testNamespace+"/"+testKey, jsonPayload)
+	execute(http.MethodPost, "/ns/other/"+testKey, jsonPayload)
+	execute(http.MethodPost, "/ns/"+testNamespace+"/key2", jsonPayload)
+	execute(http.MethodDelete, "/ns/"+testNamespace+"/"+testKey, "")
+
+	page := poll("/changes?limit=2")
+	if len(page.Results) != 2 || page.LastSeq != 2 || page.Pending != 2 {
+		t.Fatalf("unexpected first page %+v", page)
+	}
+	page = poll(fmt.Sprintf("/changes?since=%v", page.LastSeq))
+	if len(page.Results) != 2 || page.Results[1].Event != EVENT_ITEM_DELETED || page.LastSeq != 4 || page.Pending != 0 {
+		t.Fatalf("unexpected second page %+v", page)
+	}
+	page = poll("/ns/" + testNamespace + "/_changes?limit=1")
+	if len(page.Results) != 1 || page.LastSeq != 1 || page.Pending != 2 {
+		t.Fatalf("unexpected namespace page %+v", page)
+	}
+	page = poll("/ns/other/_changes?include_docs=true")
+	if len(page.Results) != 1 || page.Results[0].Seq != 2 || string(page.Results[0].Doc) != jsonPayload {
+		t.Fatalf("unexpected namespace changes %+v", page)
+	}
+	page = poll("/changes?since=4")
+	if len(page.Results) != 0 || page.LastSeq != 4 {
+		t.Fatalf("expected no changes, got %+v", page)
+	}
+	var namespaces []string
+	checkErr(t, json.Unmarshal([]byte(execute(http.MethodGet, "/", "")), &namespaces))
+	sort.Strings(namespaces)
+	checkResponse(t, "feed hidden", strings.Join(namespaces, ","), testNamespace+",other")
+
+	// the compaction keeps the last change, the sequence goes on after a restart
+	server.Feed.MaxChanges = 1
+	removed, err := server.Feed.compact(db)
+	checkErr(t, err)
+	if removed != 3 {
+		t.Errorf("expected 3 changes removed, got %v", removed)
+	}
+	server.Feed = &ChangeFeed{}
+	execute(http.MethodPost, "/ns/"+testNamespace+"/"+testKey, jsonPayload)
+	page = poll("/changes")
+	if len(page.Results) != 2 || page.Results[0].Seq != 4 || page.Results[1].Seq != 5 {
+		t.Fatalf("unexpected changes after compaction %+v", page)
+	}
+}
+
+func Test_UnitTest_Webhooks(t *testing.T) {
+	type received struct {
+		event     string
+		signature string
+		body      []byte
+	}
+	deliveries := make(chan received, 10)
+	var failing sync.Map
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if _, ok := failing.Load(r.URL.Path); ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		deliveries <- received{r.Header.Get(WebhookEventHeader), r.Header.Get(WebhookSignatureHeader), body}
+	}))
+	defer stub.Close()
+	failing.Store("/down", true)
+
+	server := Server{
+		db:       &database.MemDatabase{},
+		Webhooks: &WebhookDispatcher{MaxAttempts: 2, InitialBackoff: 10 * time.Millisecond, AllowPrivate: true},
+	}
+	server.db.Init()
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(KeyValuePattern, server.keyValueHandler)
+	testingRouter.AddHandler(WebhooksPattern, server.webhooksHandler)
+	testingRouter.AddHandler(WebhookPattern, server.webhookHandler)
+	testingRouter.AddHandler(WebhookDeliveriesPattern, server.webhookDeliveriesHandler)
+	testingRouter.AddHandler(WebhookDeadLettersPattern, server.webhookDeadLettersHandler)
+	testingRouter.AddHandler(WebhookRetryPattern, server.webhookRetryHandler)
+	execute := func(method string, path string, payload string, expectedCode int) string {
+		req, _ := http.NewRequest(method, path, strings.NewReader(payload))
+		response := testingRouter.ExecuteRequest(req)
+		checkResponseCode(t, method+" "+path, expectedCode, response.Code)
+		return response.Body.String()
+	}
+	register := func(payload string) Webhook {
+		var webhook Webhook
+		checkErr(t, json.Unmarshal([]byte(execute(http.MethodPost, WebhooksPattern, payload, http.StatusCreated)), &webhook))
+		if webhook.Secret != "" {
+			t.Errorf("the secret must not be returned")
+		}
+		return webhook
+	}
+
+	execute(http.MethodPost, WebhooksPattern, `{"namespace":"`+testNamespace+`","url":"ftp://nowhere"}`, http.StatusBadRequest)
+	execute(http.MethodPost, WebhooksPattern, `{"namespace":"`+testNamespace+`","url":"`+stub.URL+`","events":["UNKNOWN"]}`, http.StatusBadRequest)
+	up := register(`{"namespace":"` + testNamespace + `","url":"` + stub.URL + `/up","events":["ITEM_ADDED"],"secret":"s3cret"}`)
+	down := register(`{"namespace":"` + testNamespace + `","url":"` + stub.URL + `/down","events":["ITEM_DELETED"]}`)
+
+	execute(http.MethodPost, "/ns/"+testNamespace+"/"+testKey, jsonPayload, http.StatusCreated)
+	select {
+	case delivery := <-deliveries:
+		checkResponse(t, "webhook event", delivery.event, EVENT_ITEM_ADDED)
+		checkResponse(t, "webhook signature", delivery.signature, Sign("s3cret", delivery.body))
+	case <-time.After(5 * time.Second):
+		t.Fatalf("webhook not called")
+	}
+
+	// a webhook always failing ends in the dead letters, after all the attempts
+	execute(http.MethodDelete, "/ns/"+testNamespace+"/"+testKey, "", http.StatusAccepted)
+	var deadLetters []Delivery
+	deadline := time.Now().Add(5 * time.Second)
+	for len(deadLetters) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		checkErr(t, json.Unmarshal([]byte(execute(http.MethodGet, "/webhooks/"+down.Id+"/deadletters", "", http.StatusOK)), &deadLetters))
+	}
+	if len(deadLetters) != 1 || deadLetters[0].Attempts != 2 || deadLetters[0].ResponseCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected dead letters %+v", deadLetters)
+	}
+	var deliveryLog []Delivery
+	checkErr(t, json.Unmarshal([]byte(execute(http.MethodGet, "/webhooks/"+down.Id+"/deliveries", "", http.StatusOK)), &deliveryLog))
+	if len(deliveryLog) != 1 || deliveryLog[0].Status != DELIVERY_FAILED {
+		t.Fatalf("unexpected delivery log %+v", deliveryLog)
+	}
+
+	// once the webhook is back, the dead letter can be sent again
+	failing.Delete("/down")
+	execute(http.MethodPost, "/webhooks/"+down.Id+"/deadletters/"+deadLetters[0].Id+"/_retry", "", http.StatusAccepted)
+	select {
+	case delivery := <-deliveries:
+		checkResponse(t, "retried event", delivery.event, EVENT_ITEM_DELETED)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("dead letter not delivered again")
+	}
+	checkResponse(t, "dead letters emptied", execute(http.MethodGet, "/webhooks/"+down.Id+"/deadletters", "", http.StatusOK), "[]")
+
+	// the registrations are cached until changed
+	execute(http.MethodDelete, "/webhooks/"+up.Id, "", http.StatusAccepted)
+	execute(http.MethodPost, "/ns/"+testNamespace+"/"+testKey, jsonPayload, http.StatusCreated)
+	select {
+	case delivery := <-deliveries:
+		t.Fatalf("unexpected delivery to a deleted webhook: %v", delivery.event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// private addresses are refused, unless allowed
+	server.Webhooks.AllowPrivate = false
+	execute(http.MethodPost, WebhooksPattern, `{"namespace":"`+testNamespace+`","url":"`+stub.URL+`"}`, http.StatusBadRequest)
+	execute(http.MethodPost, WebhooksPattern, `{"namespace":"`+testNamespace+`","url":"http://localhost:8000/ns"}`, http.StatusBadRequest)
+	execute(http.MethodPost, WebhooksPattern, `{"namespace":"`+testNamespace+`","url":"http://169.254.169.254/latest"}`, http.StatusBadRequest)
+	// whatever the hostname resolves to
+	if _, err := (&http.Client{Transport: publicTransport()}).Get(strings.Replace(stub.URL, "127.0.0.1", "localhost", 1)); err == nil {
+		t.Errorf("expected the connection to a private address to be refused")
+	}
+}
+
+// flakySink fails while down, then records the events
+type flakySink struct {
+	mu       sync.Mutex
+	down     bool
+	subjects []string
+	events   [][]byte
+}
+
+func (f *flakySink) Publish(subject string, event []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return fmt.Errorf("sink down")
+	}
+	f.subjects = append(f.subjects, subject)
+	f.events = append(f.events, event)
+	return nil
+}
+
+func (f *flakySink) published() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.subjects...)
+}
+
+func Test_UnitTest_NatsSink(t *testing.T) {
+	ns, err := natsserver.NewServer(&natsserver.Options{Host: "127.0.0.1", Port: -1})
+	checkErr(t, err)
+	go ns.Start()
+	defer ns.Shutdown()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	client, err := nats.Connect(ns.ClientURL())
+	checkErr(t, err)
+	defer client.Close()
+	messages := make(chan *nats.Msg, 10)
+	_, err = client.ChanSubscribe("events."+testNamespace+".>", messages)
+	checkErr(t, err)
+	checkErr(t, client.Flush())
+
+	sink := &NatsSink{URL: ns.ClientURL()}
+	defer sink.Close()
+	server := Server{
+		db:     &database.MemDatabase{},
+		Outbox: &Outbox{Sink: sink, Subject: "events.{namespace}.{event}"},
+	}
+	server.db.Init()
+	server.Notify(BrokerEvent{Event: EVENT_ITEM_ADDED, Namespace: testNamespace, Key: testKey})
+
+	select {
+	case message := <-messages:
+		checkResponse(t, "nats subject", message.Subject, "events."+testNamespace+"."+EVENT_ITEM_ADDED)
+		checkResponse(t, "nats event", string(message.Data), `{"event":"ITEM_ADDED","namespace":"`+testNamespace+`","key":"`+testKey+`"}`)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not published")
+	}
+}
+
+func Test_UnitTest_Outbox(t *testing.T) {
+	sink := &flakySink{down: true}
+	server := Server{
+		db:     &database.MemDatabase{},
+		Outbox: &Outbox{Sink: sink, RetryInterval: 10 * time.Millisecond},
+	}
+	server.db.Init()
+	for _, key := range []string{"1", "2", "3"} {
+		server.Notify(BrokerEvent{Event: EVENT_ITEM_ADDED, Namespace: testNamespace, Key: key})
+	}
+	server.Notify(BrokerEvent{Event: EVENT_NAMESPACE_DELETED, Namespace: testNamespace})
+
+	// the events wait in the outbox while the sink is down
+	time.Sleep(50 * time.Millisecond)
+	saved, _ := server.db.GetAll(OutboxNamespace)
+	if len(saved) != 4 || len(sink.published()) != 0 {
+		t.Fatalf("expected 4 events in the outbox, got %v", len(saved))
+	}
+	// after a restart, new events go after the saved ones
+	restarted := &Outbox{Sink: &flakySink{down: true}, RetryInterval: time.Hour}
+	restarted.add(server.db, BrokerEvent{Event: EVENT_ITEM_ADDED, Namespace: "other", Key: "1"})
+	saved, _ = server.db.GetAll(OutboxNamespace)
+	if len(saved) != 5 {
+		t.Fatalf("expected the restarted outbox to keep the saved events, got %v", len(saved))
+	}
+	server.db.Delete(OutboxNamespace, changeKey(5))
+
+	sink.mu.Lock()
+	sink.down = false
+	sink.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	left := saved
+	for len(left) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		left, _ = server.db.GetAll(OutboxNamespace)
+	}
+	want := []string{"caffeine.ns1.ITEM_ADDED", "caffeine.ns1.ITEM_ADDED", "caffeine.ns1.ITEM_ADDED", "caffeine.ns1.NAMESPACE_DELETED"}
+	if diff := cmp.Diff(want, sink.published()); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+	if len(left) != 0 {
+		t.Errorf("expected the outbox to be empty, got %v events", len(left))
+	}
+}
+
+func Test_UnitTest_HookTimeout(t *testing.T) {
+	db := &database.MemDatabase{}
+	db.Init()
+	server := Server{db: db, HookTimeout: 50 * time.Millisecond}
+	db.Upsert("loops"+HooksId, HooksId, []byte(`{"script":"function beforeWrite(ctx) { for (;;) {} }"}`))
+
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(KeyValuePattern, server.keyValueHandler)
+
+	start := time.Now()
+	req, _ := http.NewRequest(http.MethodPost, "/ns/loops/"+testKey, strings.NewReader(jsonPayload))
+	response := testingRouter.ExecuteRequest(req)
+	checkResponseCode(t, "hook timeout", http.StatusGatewayTimeout, response.Code)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the hook to be interrupted, took %v", elapsed)
+	}
+	if _, dbErr := db.Get("loops", testKey); dbErr == nil {
+		t.Errorf("expected the document not to be stored")
+	}
+}
+
+type namespaceCountingDatabase struct {
+	Database
+	mu   sync.Mutex
+	gets map[string]int
+}
+
+func (c *namespaceCountingDatabase) Get(namespace string, key string) ([]byte, *database.DbError) {
+	c.mu.Lock()
+	c.gets[namespace]++
+	c.mu.Unlock()
+	return c.Database.Get(namespace, key)
+}
+
+func Test_UnitTest_Expand(t *testing.T) {
+	db := &namespaceCountingDatabase{Database: &database.MemDatabase{}, gets: make(map[string]int)}
+	db.Init()
+	server := Server{db: db}
+	db.Upsert("orders"+SchemaId, SchemaId, []byte(ordersSchema))
+	db.Upsert("users"+SchemaId, SchemaId, []byte(`{"properties":{"company":{"type":"string","x-ref":{"namespace":"companies"}}}}`))
+	db.Upsert("companies", "acme", []byte(`{"name":"acme"}`))
+	db.Upsert("users", "jack", []byte(`{"company":"acme","name":"jack"}`))
+	db.Upsert("users", "jill", []byte(`{"company":"acme","name":"jill"}`))
+	db.Upsert("orders", "o1", []byte(`{"total":10,"user":"jack"}`))
+	db.Upsert("orders", "o2", []byte(`{"total":20,"user":"jill"}`))
+	db.Upsert("orders", "o3", []byte(`{"total":30,"user":"jack"}`))
+	db.Upsert("orders", "o4", []byte(`{"total":40,"user":"nobody"}`))
+
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(NamespacePattern, server.namespaceHandler)
+	testingRouter.AddHandler(KeyValuePattern, server.keyValueHandler)
+	testingRouter.AddHandler(SearchPattern, server.searchHandler, "filter", "{filter}")
+
+	expandTests := []testCase{
+		{
+			name:                 "expand key",
+			path:                 "/ns/orders/o1?expand=user",
+			expectedResponseCode: http.StatusOK,
+			expectedResponse:     `{"total":10,"user":{"company":"acme","name":"jack"}}`,
+		},
+		{
+			name:                 "expand key with depth",
+			path:                 "/ns/orders/o1?expand=*&depth=2",
+			expectedResponseCode: http.StatusOK,
+			expectedResponse:     `{"total":10,"user":{"company":{"name":"acme"},"name":"jack"}}`,
+		},
+		{
+			name:                 "expand unknown field",
+			path:                 "/ns/orders/o1?expand=total",
+			expectedResponseCode: http.StatusOK,
+			expectedResponse:     `{"total":10,"user":"jack"}`,
+		},
+		{
+			name:                 "expand missing reference",
+			path:                 "/ns/orders/o4?expand=user",
+			expectedResponseCode: http.StatusOK,
+			expectedResponse:     `{"total":40,"user":"nobody"}`,
+		},
+		{
+			name:                 "expand invalid depth",
+			path:                 "/ns/orders/o1?expand=user&depth=" + strconv.Itoa(MaxExpandDepth+1),
+			expectedResponseCode: http.StatusBadRequest,
+		},
+		{
+			name:                 "expand search",
+			path:                 "/search/orders?" + url.Values{"filter": {`select(.user.name? == "jill") | .total`}, "expand": {"user"}}.Encode(),
+			expectedResponseCode: http.StatusOK,
+			expectedResponse:     `{"results":[{"key":"o2","value":20}]}`,
+		},
+	}
+	for _, test := range expandTests {
+		req, _ := http.NewRequest(http.MethodGet, test.path, nil)
+		response := testingRouter.ExecuteRequest(req)
+		checkResponseCode(t, test.name, test.expectedResponseCode, response.Code)
+		if test.expectedResponse != "" {
+			checkResponse(t, test.name, response.Body.String(), test.expectedResponse)
+		}
+	}
+
+	// every user is read once, however many orders reference it
+	db.gets = make(map[string]int)
+	req, _ := http.NewRequest(http.MethodGet, "/ns/orders?expand=user&depth=2", nil)
+	response := testingRouter.ExecuteRequest(req)
+	checkResponseCode(t, "expand namespace", http.StatusOK, response.Code)
+	var orders []struct {
+		Key   string
+		Value map[string]interface{}
+	}
+	checkErr(t, json.Unmarshal(response.Body.Bytes(), &orders))
+	if user, ok := orders[2].Value["user"].(map[string]interface{}); !ok || user["name"] != "jack" {
+		t.Errorf("expected o3 to embed jack, got %v", orders[2])
+	}
+	if db.gets["users"] != 3 || db.gets["companies"] != 0 {
+		t.Errorf("expected 3 reads of users, jack, jill and nobody, and none of companies, got %v", db.gets)
+	}
+}
+
+func Test_UnitTest_UniqueConcurrentWrites(t *testing.T) {
+	dir := "/tmp/caffeine_unique"
+	defer os.RemoveAll(dir)
+	sqlite := &database.SQLiteDatabase{DirPath: dir}
+
+	for name, db := range map[string]Database{"memory": &database.MemDatabase{}, "sqlite": sqlite} {
+		db.Init()
+		server := Server{db: db}
+		db.Upsert("members"+SchemaId, SchemaId, []byte(membersSchema))
+		testingRouter := TestingRouter{Router: mux.NewRouter()}
+		testingRouter.AddHandler(KeyValuePattern, server.keyValueHandler)
+
+		var wg sync.WaitGroup
+		codes := make(chan int, 20)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("/ns/members/m%v", i), strings.NewReader(`{"email":"jack@caffeine.io"}`))
+				codes <- testingRouter.ExecuteRequest(req).Code
+			}(i)
+		}
+		wg.Wait()
+		close(codes)
+		created := 0
+		for code := range codes {
+			switch code {
+			case http.StatusCreated:
+				created++
+			case http.StatusConflict:
+			default:
+				t.Errorf("%v: unexpected response code %v", name, code)
+			}
+		}
+		if created != 1 {
+			t.Errorf("%v: expected exactly one member created, got %v", name, created)
+		}
+	}
+	sqlite.Close()
+}
+
+func Test_UnitTest_UniqueText(t *testing.T) {
+	dir := "/tmp/caffeine_unique_text"
+	defer os.RemoveAll(dir)
+	sqlite := &database.SQLiteDatabase{DirPath: dir}
+
+	for name, db := range map[string]Database{"memory": &database.MemDatabase{}, "sqlite": sqlite} {
+		db.Init()
+		server := Server{db: db}
+		db.Upsert("codes"+SchemaId, SchemaId, []byte(`{"x-unique":["code"]}`))
+		testingRouter := TestingRouter{Router: mux.NewRouter()}
+		testingRouter.AddHandler(KeyValuePattern, server.keyValueHandler)
+
+		// values are compared as text, as in postgres
+		for _, write := range []struct {
+			key      string
+			payload  string
+			expected int
+		}{
+			{"c1", `{"code":1}`, http.StatusCreated},
+			{"c2", `{"code":"1"}`, http.StatusConflict},
+			{"c3", `{"code":true}`, http.StatusCreated},
+			{"c4", `{"code":"true"}`, http.StatusConflict},
+			{"c5", `{"code":"a"}`, http.StatusCreated},
+		} {
+			req, _ := http.NewRequest(http.MethodPost, "/ns/codes/"+write.key, strings.NewReader(write.payload))
+			if code := testingRouter.ExecuteRequest(req).Code; code != write.expected {
+				t.Errorf("%v: writing %v: expected %v, got %v", name, write.payload, write.expected, code)
+			}
+		}
+	}
+	sqlite.Close()
+}
+
+func Test_UnitTest_SchemaMigrateLocked(t *testing.T) {
+	db := &failingDatabase{Database: &database.MemDatabase{}, namespace: "people", key: "p2"}
+	db.Init()
+	server := Server{db: db}
+	db.Upsert("people"+SchemaId, SchemaId, []byte(peopleSchema))
+	db.Upsert("people", "p1", []byte(`{"name":"jack never"}`))
+	db.Database.Upsert("people", "p2", []byte(`{"name":"jill never"}`))
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(KeyValuePattern, server.keyValueHandler)
+	testingRouter.AddHandler(SchemaMigratePattern, server.schemaMigrateHandler)
+
+	// a rewrite failing midway puts back the documents already rewritten
+	req, _ := http.NewRequest(http.MethodPost, "/schema/people/_migrate", strings.NewReader(peopleMigration))
+	if code := testingRouter.ExecuteRequest(req).Code; code != http.StatusInternalServerError {
+		t.Errorf("expected the migration to fail, got %v", code)
+	}
+	if person, _ := db.Get("people", "p1"); string(person) != `{"name":"jack never"}` {
+		t.Errorf("expected p1 to be restored, got %s", person)
+	}
+	if schema, _ := db.Get("people"+SchemaId, SchemaId); string(schema) != peopleSchema {
+		t.Errorf("expected the schema not to change, got %s", schema)
+	}
+
+	// a write waiting for a schema change is validated against the new schema
+	gate := server.uniques.gate("people")
+	gate.Lock()
+	codes := make(chan int)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPost, "/ns/people/p3", strings.NewReader(`{"name":"joe"}`))
+		codes <- testingRouter.ExecuteRequest(req).Code
+	}()
+	time.Sleep(50 * time.Millisecond)
+	db.Upsert("people"+SchemaId, SchemaId, []byte(`{"type":"object","required":["first"]}`))
+	gate.Unlock()
+	if code := <-codes; code != http.StatusBadRequest {
+		t.Errorf("expected the write to be refused by the new schema, got %v", code)
+	}
+}
+
+func Test_UnitTest_ImportUnique(t *testing.T) {
+	dir := "/tmp/caffeine_import_unique"
+	defer os.RemoveAll(dir)
+	db := &database.SQLiteDatabase{DirPath: dir}
+	db.Init()
+	defer db.Close()
+	server := Server{db: db}
+	db.Upsert("members", "m1", []byte(`{"email":"jack@caffeine.io"}`))
+
+	// the imported constraints get their unique index
+	_, err := server.importNamespace("members", strings.NewReader(`{"schema":{"x-unique":["email"]}}`+"\n"), "")
+	checkErr(t, err)
+	dbErr := db.Upsert("members", "m2", []byte(`{"email":"jack@caffeine.io"}`))
+	if dbErr == nil || dbErr.ErrorCode != database.UNIQUE_VIOLATION {
+		t.Errorf("expected the index to refuse a duplicate, got %v", dbErr)
+	}
+}
+
+func Test_UnitTest_RefIndex(t *testing.T) {
+	db := &database.MemDatabase{}
+	db.Init()
+	server := Server{db: db}
+	db.Upsert("orders"+SchemaId, SchemaId, []byte(ordersSchema))
+	db.Upsert("users", "jack", []byte(jsonPayload))
+	db.Upsert("users", "jill", []byte(jsonPayload))
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(KeyValuePattern, server.keyValueHandler)
+	execute := func(method string, path string, payload string) int {
+		req, _ := http.NewRequest(method, path, strings.NewReader(payload))
+		return testingRouter.ExecuteRequest(req).Code
+	}
+
+	if code := execute(http.MethodPost, "/ns/orders/o1", `{"user":"jack"}`); code != http.StatusCreated {
+		t.Fatalf("unexpected response code %v", code)
+	}
+	// builds the index
+	if code := execute(http.MethodDelete, "/ns/users/jack", ""); code != http.StatusConflict {
+		t.Errorf("expected jack to be restricted, got %v", code)
+	}
+	if code := execute(http.MethodPost, "/ns/orders/o1", `{"user":"jill"}`); code != http.StatusCreated {
+		t.Fatalf("unexpected response code %v", code)
+	}
+	if code := execute(http.MethodDelete, "/ns/users/jack", ""); code != http.StatusAccepted {
+		t.Errorf("expected jack to be deleted once not referenced, got %v", code)
+	}
+	if code := execute(http.MethodDelete, "/ns/users/jill", ""); code != http.StatusConflict {
+		t.Errorf("expected jill to be restricted, got %v", code)
+	}
+	if code := execute(http.MethodDelete, "/ns/orders/o1", ""); code != http.StatusAccepted {
+		t.Fatalf("unexpected response code %v", code)
+	}
+	if code := execute(http.MethodDelete, "/ns/users/jill", ""); code != http.StatusAccepted {
+		t.Errorf("expected jill to be deleted once not referenced, got %v", code)
+	}
+}
+
+// failingDeleteDatabase fails the delete of a document
+type failingDeleteDatabase struct {
+	Database
+	namespace string
+	key       string
+}
+
+func (f *failingDeleteDatabase) Delete(namespace string, key string) *database.DbError {
+	if namespace == f.namespace && key == f.key {
+		return &database.DbError{ErrorCode: database.INTERNAL_ERROR, Message: "delete failed"}
+	}
+	return f.Database.Delete(namespace, key)
+}
+
+func Test_UnitTest_CascadeOrder(t *testing.T) {
+	db := &failingDeleteDatabase{Database: &database.MemDatabase{}, namespace: "invoices", key: "i1"}
+	db.Init()
+	db.Upsert("invoices"+SchemaId, SchemaId, []byte(invoicesSchema))
+	db.Upsert("lines"+SchemaId, SchemaId, []byte(`{"type":"object","properties":{"invoice":{"type":"string","x-ref":{"namespace":"invoices","onDelete":"cascade"}}}}`))
+	db.Upsert("customers", "c1", []byte(jsonPayload))
+	db.Upsert("invoices", "i1", []byte(`{"customer":"c1"}`))
+	db.Upsert("lines", "l1", []byte(`{"invoice":"i1"}`))
+	server := Server{db: db}
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(KeyValuePattern, server.keyValueHandler)
+
+	// the cascade stops at the invoice: its lines are gone, the customer is kept
+	req, _ := http.NewRequest(http.MethodDelete, "/ns/customers/c1", nil)
+	checkResponseCode(t, "failed cascade", http.StatusInternalServerError, testingRouter.ExecuteRequest(req).Code)
+	for namespace, key := range map[string]string{"customers": "c1", "invoices": "i1"} {
+		if _, dbErr := db.Get(namespace, key); dbErr != nil {
+			t.Errorf("expected %v/%v to be kept, got %v", namespace, key, dbErr)
+		}
+	}
+	if _, dbErr := db.Get("lines", "l1"); dbErr == nil {
+		t.Errorf("expected the line referencing the invoice to be deleted first")
+	}
+
+	// the referencing namespaces are locked until the delete is applied
+	unlock, err := server.lockDelete("customers")
+	checkErr(t, err)
+	written := make(chan bool)
+	go func() {
+		gate := server.uniques.gate("lines")
+		gate.RLock()
+		gate.RUnlock()
+		written <- true
+	}()
+	select {
+	case <-written:
+		t.Fatalf("expected the writes of a referencing namespace to wait for the delete")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-written
+	// the namespace itself is only shared
+	unlock, err = server.lockDelete("customers")
+	checkErr(t, err)
+	gate := server.uniques.gate("customers")
+	gate.RLock()
+	gate.RUnlock()
+	unlock()
+}
+
+func Test_UnitTest_UnwrapLegacy(t *testing.T) {
+	db := &database.MemDatabase{}
+	db.Init()
+	db.Upsert("legacy", "a", []byte(`{"user_id":"johnd","data":{"name":"john"}}`))
+	// already unwrapped, its data happens to look like a payload
+	db.Upsert("legacy", "b", []byte(`{"user_id":"jane","data":1}`))
+	db.Upsert("legacy"+MetaId, "b", []byte(`{"user_id":"jane"}`))
+	db.Upsert("legacy", "c", []byte(`{"user_id":"jane","data":1,"other":true}`))
+
+	s := Server{db: db}
+	count, err := s.unwrapLegacy()
+	checkErr(t, err)
+	if count != 1 {
+		t.Fatalf("expected 1 document unwrapped, got %v", count)
+	}
+	expected := map[string]string{
+		"a": `{"name":"john"}`,
+		"b": `{"user_id":"jane","data":1}`,
+		"c": `{"user_id":"jane","data":1,"other":true}`,
+	}
+	for key, value := range expected {
+		data, dbErr := db.Get("legacy", key)
+		if dbErr != nil || string(data) != value {
+			t.Errorf("%v: expected %v, got %s", key, value, data)
+		}
+	}
+	metadata, dbErr := db.Get("legacy"+MetaId, "a")
+	if dbErr != nil || string(metadata) != `{"user_id":"johnd"}` {
+		t.Errorf("expected the owner in the metadata, got %s", metadata)
+	}
+
+	count, err = s.unwrapLegacy()
+	checkErr(t, err)
+	if count != 0 {
+		t.Errorf("expected nothing to unwrap twice, got %v", count)
+	}
+
+	// once completed, the documents shaped as a payload are left as they are
+	count, err = s.unwrapLegacyOnce()
+	checkErr(t, err)
+	if count != 0 {
+		t.Errorf("expected nothing to unwrap, got %v", count)
+	}
+	db.Upsert("legacy", "d", []byte(`{"user_id":"jane","data":{"name":"jane"}}`))
+	count, err = s.unwrapLegacyOnce()
+	checkErr(t, err)
+	if count != -1 {
+		t.Errorf("expected the migration not to run again, got %v", count)
+	}
+	if data, _ := db.Get("legacy", "d"); string(data) != `{"user_id":"jane","data":{"name":"jane"}}` {
+		t.Errorf("expected the document not to be unwrapped, got %s", data)
+	}
+}
+
+func Test_UnitTest_OpenAPINamespaces(t *testing.T) {
+	server := Server{db: &database.MemDatabase{}}
+	server.db.Init()
+	for _, namespace := range []string{testNamespace, testNamespace + MetaId, testNamespace + TransformId, testNamespace + HooksId, ChangesNamespace, OutboxNamespace} {
+		server.db.Upsert(namespace, testKey, []byte(jsonPayload))
+	}
+	rootMap, err := server.generateOpenAPIMap(server.db.GetNamespaces())
+	checkErr(t, err)
+	paths := make([]string, 0)
+	for path := range rootMap["paths"].(map[string]interface{}) {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	checkResponse(t, "documented paths", strings.Join(paths, ","), "/ns,/ns/"+testNamespace+",/ns/"+testNamespace+"/{id},/search/"+testNamespace)
+}
+
+func Test_UnitTest_TransformEvents(t *testing.T) {
+	sink := &flakySink{}
+	server := Server{
+		db:     &database.MemDatabase{},
+		Feed:   &ChangeFeed{},
+		Outbox: &Outbox{Sink: sink, RetryInterval: 10 * time.Millisecond},
+	}
+	server.db.Init()
+	testingRouter := TestingRouter{Router: mux.NewRouter()}
+	testingRouter.AddHandler(KeyValuePattern, server.keyValueHandler)
+	testingRouter.AddHandler(TransformPattern, server.transformHandler)
+	testingRouter.AddHandler(ChangesPattern, server.changesHandler)
+	for _, write := range [][2]string{{"/transform/user", `{"read":"del(.age)"}`}, {"/ns/user/1", `{"name":"john","age":30}`}} {
+		req, _ := http.NewRequest(http.MethodPost, write[0], strings.NewReader(write[1]))
+		checkResponseCode(t, write[0], http.StatusCreated, testingRouter.ExecuteRequest(req).Code)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "/changes?include_docs=true", nil)
+	var changes struct {
+		Results []Change `json:"results"`
+	}
+	checkErr(t, json.Unmarshal(testingRouter.ExecuteRequest(req).Body.Bytes(), &changes))
+	if len(changes.Results) != 2 || string(changes.Results[1].Doc) != `{"name":"john"}` {
+		t.Fatalf("expected the change document read through the transform, got %+v", changes.Results)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.published()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.events) != 2 {
+		t.Fatalf("expected 2 published events, got %v", len(sink.events))
+	}
+	var event BrokerEvent
+	checkErr(t, json.Unmarshal(sink.events[1], &event))
+	if diff := cmp.Diff(map[string]interface{}{"name": "john"}, event.Value); diff != "" {
+		t.Fatalf("mismatch of the published document (-want +got):\n%s", diff)
+	}
+	// the stored document is untouched
+	stored, _ := server.db.Get("user", "1")
+	checkResponse(t, "stored document", string(stored), `{"name":"john","age":30}`)
 }
@@ -0,0 +1,226 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/itchyny/gojq"
+)
+
+const (
+	TransformPattern = "/transform/{namespace:[a-zA-Z0-9]+}"
+	TransformId      = "_transform"
+
+	// a transform can loop forever, e.g. with repeat
+	transformTimeout = time.Second
+)
+
+// Transform holds the jq programs of a namespace: Write computes or normalises the documents
+// before they are validated and stored, Read projects them when they are returned.
+// Both get the document as input, and $namespace and $key as variables.
+type Transform struct {
+	Write string `json:"write,omitempty"`
+	Read  string `json:"read,omitempty"`
+}
+
+type compiledTransform struct {
+	hash  [sha256.Size]byte
+	write *gojq.Code
+	read  *gojq.Code
+}
+
+// transformCache keeps the compiled transforms of every namespace, recompiled when they change
+type transformCache struct {
+	mu         sync.Mutex
+	transforms map[string]*compiledTransform
+}
+
+func (c *transformCache) get(namespace string, definition []byte) (*compiledTransform, error) {
+	hash := sha256.Sum256(definition)
+	c.mu.Lock()
+	cached, ok := c.transforms[namespace]
+	c.mu.Unlock()
+	if ok && cached.hash == hash {
+		return cached, nil
+	}
+
+	compiled, err := compileTransform(definition)
+	if err != nil {
+		return nil, err
+	}
+	compiled.hash = hash
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.transforms == nil {
+		c.transforms = make(map[string]*compiledTransform)
+	}
+	c.transforms[namespace] = compiled
+	return compiled, nil
+}
+
+func compileTransform(definition []byte) (*compiledTransform, error) {
+	var transform Transform
+	err := json.Unmarshal(definition, &transform)
+	if err != nil {
+		return nil, err
+	}
+	if transform.Write == "" && transform.Read == "" {
+		return nil, errors.New("a transform needs a write or a read program")
+	}
+	compiled := &compiledTransform{}
+	compiled.write, err = compileProgram(transform.Write)
+	if err != nil {
+		return nil, fmt.Errorf("write: %v", err)
+	}
+	compiled.read, err = compileProgram(transform.Read)
+	if err != nil {
+		return nil, fmt.Errorf("read: %v", err)
+	}
+	return compiled, nil
+}
+
+func compileProgram(program string) (*gojq.Code, error) {
+	if program == "" {
+		return nil, nil
+	}
+	query, err := gojq.Parse(program)
+	if err != nil {
+		return nil, err
+	}
+	return gojq.Compile(query, gojq.WithVariables([]string{"$namespace", "$key"}))
+}
+
+// transform returns the compiled transform of a namespace, nil if it has none
+func (s *Server) transform(namespace string) (*compiledTransform, error) {
+	definition, dbErr := s.db.Get(namespace+TransformId, TransformId)
+	if dbErr != nil {
+		// as for the schemas, not every database tells a missing document apart
+		return nil, nil
+	}
+	return s.transforms.get(namespace, definition)
+}
+
+// transformWrite runs the write program of the namespace, if any, on a document to be stored
+func (s *Server) transformWrite(namespace string, key string, data []byte) ([]byte, error) {
+	transform, err := s.transform(namespace)
+	if err != nil || transform == nil || transform.write == nil {
+		return data, err
+	}
+	return runProgram(transform.write, namespace, key, data)
+}
+
+// transformRead runs the read program of the namespace, if any, on a document to be returned
+func (s *Server) transformRead(namespace string, key string, data []byte) ([]byte, error) {
+	transform, err := s.transform(namespace)
+	if err != nil || transform == nil || transform.read == nil {
+		return data, err
+	}
+	return runProgram(transform.read, namespace, key, data)
+}
+
+// readEvent returns an event as the clients see its document, with the read transform of the namespace.
+// If the transform fails the document is left out of the event.
+func (s *Server) readEvent(event BrokerEvent) BrokerEvent {
+	if event.Event != EVENT_ITEM_ADDED || event.Value == nil {
+		return event
+	}
+	transform, err := s.transform(event.Namespace)
+	if err == nil && (transform == nil || transform.read == nil) {
+		return event
+	}
+	var data []byte
+	if err == nil {
+		data, err = runProgram(transform.read, event.Namespace, event.Key, eventData(event))
+	}
+	if err != nil {
+		log.Printf("error on the read transform of %v/%v, event sent without document: %v\n", event.Namespace, event.Key, err)
+		event.Value, event.Raw = nil, nil
+		return event
+	}
+	event.Value, event.Raw = json.RawMessage(data), data
+	return event
+}
+
+// runProgram runs a program that must return exactly one value
+func runProgram(code *gojq.Code, namespace string, key string, data []byte) ([]byte, error) {
+	var input interface{}
+	err := json.Unmarshal(data, &input)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), transformTimeout)
+	defer cancel()
+
+	iter := code.RunWithContext(ctx, input, namespace, key)
+	output, ok := iter.Next()
+	if !ok {
+		return nil, errors.New("transform returned no value")
+	}
+	if err, ok := output.(error); ok {
+		return nil, fmt.Errorf("transform: %v", err)
+	}
+	if _, ok := iter.Next(); ok {
+		return nil, errors.New("transform returned more than one value")
+	}
+	return json.Marshal(output)
+}
+
+func (s *Server) transformHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"] + TransformId
+
+	switch r.Method {
+	case http.MethodPost:
+		defer r.Body.Close()
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		_, err = compileTransform(data)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		dbErr := s.db.Upsert(namespace, TransformId, data)
+		if dbErr != nil {
+			respondWithError(w, http.StatusInternalServerError, dbErr.Error())
+			return
+		}
+		log.Printf("added transform for namespace '%s'\n", vars["namespace"])
+		s.Notify(BrokerEvent{
+			Event:     EVENT_TRANSFORM_UPDATED,
+			Namespace: vars["namespace"],
+			Value:     json.RawMessage(data),
+		})
+		respondWithJSON(w, http.StatusCreated, string(data))
+	case http.MethodGet:
+		data, dbErr := s.db.Get(namespace, TransformId)
+		if dbErr != nil {
+			respondWithError(w, http.StatusNotFound, dbErr.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, string(data))
+	case http.MethodDelete:
+		dbErr := s.db.Delete(namespace, TransformId)
+		if dbErr != nil {
+			respondWithError(w, http.StatusNotFound, dbErr.Error())
+			return
+		}
+		s.Notify(BrokerEvent{
+			Event:     EVENT_TRANSFORM_DELETED,
+			Namespace: vars["namespace"],
+		})
+		respondWithJSON(w, http.StatusAccepted, "{}")
+	}
+}
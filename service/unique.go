@@ -0,0 +1,484 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rehacktive/caffeine/database"
+)
+
+// UniqueKeyword declares, in the schema of a namespace, the fields that can't have the same value in
+// two documents: each entry is a field, or a list of fields unique together, e.g. ["email", ["first", "last"]]
+const UniqueKeyword = "x-unique"
+
+// UniqueDatabase is implemented by the databases enforcing the unique constraints with their own
+// indexes, atomically even with several instances sharing the storage: Upsert fails with UNIQUE_VIOLATION
+type UniqueDatabase interface {
+	EnsureUnique(namespace string, constraints [][]string) *database.DbError
+}
+
+// UniqueError is returned when a document has the same values of a unique constraint as another one
+type UniqueError struct {
+	Namespace string
+	Fields    []string
+	// Key is the key of the other document
+	Key string
+}
+
+func (e *UniqueError) Error() string {
+	return fmt.Sprintf("%v must be unique in namespace '%v', '%v' has the same", strings.Join(e.Fields, "+"), e.Namespace, e.Key)
+}
+
+func respondWithUniqueError(w http.ResponseWriter, err *UniqueError) {
+	content, _ := json.Marshal(struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+		Key     string `json:"key"`
+	}{http.StatusConflict, err.Error(), err.Key})
+	respondWithJSON(w, http.StatusConflict, string(content))
+}
+
+// parseUnique returns the unique constraints declared by a schema
+func parseUnique(schemaJson []byte) ([][]string, error) {
+	var schema struct {
+		Unique []json.RawMessage `json:"x-unique"`
+	}
+	err := json.Unmarshal(schemaJson, &schema)
+	if err != nil {
+		return nil, err
+	}
+	constraints := make([][]string, 0, len(schema.Unique))
+	for _, entry := range schema.Unique {
+		var field string
+		if json.Unmarshal(entry, &field) == nil && field != "" {
+			constraints = append(constraints, []string{field})
+			continue
+		}
+		var fields []string
+		if json.Unmarshal(entry, &fields) != nil || len(fields) == 0 {
+			return nil, fmt.Errorf("%v: invalid entry %s, expected a field or a list of fields", UniqueKeyword, entry)
+		}
+		for _, field := range fields {
+			if field == "" {
+				return nil, fmt.Errorf("%v: invalid entry %s, empty field", UniqueKeyword, entry)
+			}
+		}
+		constraints = append(constraints, fields)
+	}
+	return constraints, nil
+}
+
+// uniqueValues returns the values of some fields of a document, as a key of an index.
+// Documents missing any of them, or with null, aren't constrained, as with SQL unique indexes.
+func uniqueValues(doc interface{}, fields []string) (string, bool) {
+	object, ok := doc.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		value, ok := object[field]
+		if !ok || value == nil {
+			return "", false
+		}
+		values[i] = uniqueText(value)
+	}
+	data, _ := json.Marshal(values)
+	return string(data), true
+}
+
+// uniqueText returns a value as text, the way the SQL indexes compare it, e.g. data->>'field'
+// in postgres: the string "1" and the number 1 are the same value
+func uniqueText(value interface{}) string {
+	if text, ok := value.(string); ok {
+		return text
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// uniqueIndexes guards the unique constraints. With a UniqueDatabase it only keeps its indexes
+// in sync with the schemas; otherwise every namespace has an index of the values of its
+// constraints, built at the first write, checked and updated holding the lock of the namespace.
+// Those constraints are only enforced within an instance: the writes of the other instances
+// sharing the storage aren't checked against them.
+type uniqueIndexes struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+	// the writes of a namespace share its gate while validating and storing a document,
+	// the schema changes checking or rewriting all its documents hold it alone
+	gates   map[string]*sync.RWMutex
+	indexes map[string]*uniqueIndex
+	// bumped on every change of a namespace, so an index built meanwhile isn't kept
+	versions map[string]uint64
+	// the constraints last applied to the UniqueDatabase, by namespace
+	ensured map[string]string
+}
+
+type uniqueIndex struct {
+	signature   string
+	constraints [][]string
+	// for every constraint, the key of the document having some values
+	values []map[string]string
+	// for every key, its values of every constraint, empty if not constrained
+	keys map[string][]string
+}
+
+func signature(constraints [][]string) string {
+	data, _ := json.Marshal(constraints)
+	return string(data)
+}
+
+func newUniqueIndex(constraints [][]string) *uniqueIndex {
+	index := &uniqueIndex{
+		signature:   signature(constraints),
+		constraints: constraints,
+		values:      make([]map[string]string, len(constraints)),
+		keys:        make(map[string][]string),
+	}
+	for i := range constraints {
+		index.values[i] = make(map[string]string)
+	}
+	return index
+}
+
+func (index *uniqueIndex) add(key string, doc interface{}) {
+	values := make([]string, len(index.constraints))
+	for i, fields := range index.constraints {
+		if value, ok := uniqueValues(doc, fields); ok {
+			values[i] = value
+			index.values[i][value] = key
+		}
+	}
+	index.keys[key] = values
+}
+
+func (index *uniqueIndex) remove(key string) {
+	for i, value := range index.keys[key] {
+		if value != "" && index.values[i][value] == key {
+			delete(index.values[i], value)
+		}
+	}
+	delete(index.keys, key)
+}
+
+// conflict returns the first constraint a document violates
+func (index *uniqueIndex) conflict(namespace string, key string, doc interface{}) *UniqueError {
+	for i, fields := range index.constraints {
+		value, ok := uniqueValues(doc, fields)
+		if !ok {
+			continue
+		}
+		if other, found := index.values[i][value]; found && other != key {
+			return &UniqueError{Namespace: namespace, Fields: fields, Key: other}
+		}
+	}
+	return nil
+}
+
+// lock returns the lock serializing the guarded writes of a namespace
+func (u *uniqueIndexes) lock(namespace string) *sync.Mutex {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.locks == nil {
+		u.locks = make(map[string]*sync.Mutex)
+	}
+	lock, ok := u.locks[namespace]
+	if !ok {
+		lock = &sync.Mutex{}
+		u.locks[namespace] = lock
+	}
+	return lock
+}
+
+// gate returns the lock ordering the writes of a namespace with the changes of its schema
+func (u *uniqueIndexes) gate(namespace string) *sync.RWMutex {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.gates == nil {
+		u.gates = make(map[string]*sync.RWMutex)
+	}
+	gate, ok := u.gates[namespace]
+	if !ok {
+		gate = &sync.RWMutex{}
+		u.gates[namespace] = gate
+	}
+	return gate
+}
+
+// lockGates takes the gate of namespace shared and the gates of exclusive exclusively, ordered
+// by name so concurrent callers don't deadlock, and returns the function releasing them
+func (u *uniqueIndexes) lockGates(namespace string, exclusive []string) func() {
+	isExclusive := make(map[string]bool)
+	for _, name := range exclusive {
+		isExclusive[name] = true
+	}
+	names := append([]string(nil), exclusive...)
+	if !isExclusive[namespace] {
+		names = append(names, namespace)
+	}
+	sort.Strings(names)
+	unlocks := make([]func(), 0, len(names))
+	for _, name := range names {
+		gate := u.gate(name)
+		if isExclusive[name] {
+			gate.Lock()
+			unlocks = append(unlocks, gate.Unlock)
+		} else {
+			gate.RLock()
+			unlocks = append(unlocks, gate.RUnlock)
+		}
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
+
+// conflict checks a document against the index of its namespace, building it if needed.
+// It must be called holding the lock of the namespace: the index is read from the database
+// without holding u.mu, so the writes of the other namespaces don't wait for it.
+func (u *uniqueIndexes) conflict(db Database, namespace string, key string, constraints [][]string, doc interface{}) (*UniqueError, error) {
+	u.mu.Lock()
+	index, ok := u.indexes[namespace]
+	version := u.versions[namespace]
+	u.mu.Unlock()
+	if !ok || index.signature != signature(constraints) {
+		var err error
+		index, err = loadUniqueIndex(db, namespace, constraints)
+		if err != nil {
+			return nil, err
+		}
+		u.mu.Lock()
+		if u.versions[namespace] == version {
+			if u.indexes == nil {
+				u.indexes = make(map[string]*uniqueIndex)
+			}
+			u.indexes[namespace] = index
+		}
+		u.mu.Unlock()
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return index.conflict(namespace, key, doc), nil
+}
+
+func loadUniqueIndex(db Database, namespace string, constraints [][]string) (*uniqueIndex, error) {
+	index := newUniqueIndex(constraints)
+	all, dbErr := db.GetAll(namespace)
+	if dbErr != nil {
+		// not every database tells a missing namespace apart
+		if !namespaceExists(db, namespace) {
+			return index, nil
+		}
+		return nil, dbErr
+	}
+	for key, data := range all {
+		var doc interface{}
+		if json.Unmarshal(data, &doc) == nil {
+			index.add(key, doc)
+		}
+	}
+	return index, nil
+}
+
+func namespaceExists(db Database, namespace string) bool {
+	for _, existing := range db.GetNamespaces() {
+		if existing == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// ensure applies the constraints of a namespace to a UniqueDatabase, if they changed
+func (u *uniqueIndexes) ensure(db UniqueDatabase, namespace string, constraints [][]string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	current := signature(constraints)
+	if applied, ok := u.ensured[namespace]; ok && applied == current {
+		return nil
+	}
+	dbErr := db.EnsureUnique(namespace, constraints)
+	if dbErr != nil {
+		return dbErr
+	}
+	if u.ensured == nil {
+		u.ensured = make(map[string]string)
+	}
+	u.ensured[namespace] = current
+	return nil
+}
+
+// notify keeps the indexes up to date with the changes
+func (u *uniqueIndexes) notify(event BrokerEvent) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.bump(event.Namespace)
+	index, ok := u.indexes[event.Namespace]
+	switch event.Event {
+	case EVENT_ITEM_ADDED:
+		if ok {
+			index.remove(event.Key)
+			index.add(event.Key, eventDocument(event.Value))
+		}
+	case EVENT_ITEM_DELETED:
+		if ok {
+			index.remove(event.Key)
+		}
+	case EVENT_NAMESPACE_DELETED, EVENT_SCHEMA_UPDATED, EVENT_SCHEMA_DELETED:
+		u.drop(event.Namespace)
+	}
+}
+
+// invalidate forgets what is known of a namespace, e.g. when it is changed by another instance
+func (u *uniqueIndexes) invalidate(namespace string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.bump(namespace)
+	u.drop(namespace)
+}
+
+func (u *uniqueIndexes) bump(namespace string) {
+	if u.versions == nil {
+		u.versions = make(map[string]uint64)
+	}
+	u.versions[namespace]++
+}
+
+func (u *uniqueIndexes) drop(namespace string) {
+	delete(u.indexes, namespace)
+	delete(u.ensured, namespace)
+}
+
+// eventDocument returns the document of an event, that can be still encoded when replicated
+func eventDocument(value interface{}) interface{} {
+	var data []byte
+	switch raw := value.(type) {
+	case json.RawMessage:
+		data = raw
+	case []byte:
+		data = raw
+	default:
+		return value
+	}
+	var doc interface{}
+	json.Unmarshal(data, &doc)
+	return doc
+}
+
+// uniqueConstraints returns the unique constraints of a namespace, if any
+func (s *Server) uniqueConstraints(namespace string) ([][]string, error) {
+	schemaJson, dbErr := s.db.Get(namespace+SchemaId, SchemaId)
+	if dbErr != nil {
+		// as for the validation, not every database tells a missing schema apart
+		return nil, nil
+	}
+	return parseUnique(schemaJson)
+}
+
+// writeUnique runs the write of a document, and notifies the event, enforcing the unique
+// constraints of its namespace. It returns a *UniqueError if they are violated, or the
+// *database.DbError of the write.
+func (s *Server) writeUnique(namespace string, key string, doc interface{}, write func() *database.DbError, event BrokerEvent) error {
+	constraints, err := s.uniqueConstraints(namespace)
+	if err != nil {
+		return err
+	}
+	if unique, ok := s.db.(UniqueDatabase); ok {
+		// the database checks the constraints when writing
+		err = s.uniques.ensure(unique, namespace, constraints)
+		if err != nil {
+			return err
+		}
+	} else if len(constraints) > 0 {
+		lock := s.uniques.lock(namespace)
+		lock.Lock()
+		defer lock.Unlock()
+		conflict, err := s.uniques.conflict(s.db, namespace, key, constraints, doc)
+		if err != nil {
+			return err
+		}
+		if conflict != nil {
+			return conflict
+		}
+	}
+
+	dbErr := write()
+	if dbErr != nil {
+		if dbErr.ErrorCode == database.UNIQUE_VIOLATION {
+			if conflict := s.findConflict(namespace, key, constraints, doc); conflict != nil {
+				return conflict
+			}
+		}
+		return dbErr
+	}
+	s.Notify(event)
+	return nil
+}
+
+// syncUnique applies the constraints of a namespace to a UniqueDatabase as soon as its schema changes,
+// instead of at the next write, so the indexes of the removed constraints don't refuse writes meanwhile
+func (s *Server) syncUnique(namespace string) error {
+	unique, ok := s.db.(UniqueDatabase)
+	if !ok || !namespaceExists(s.db, namespace) {
+		return nil
+	}
+	constraints, err := s.uniqueConstraints(namespace)
+	if err != nil {
+		return err
+	}
+	return s.uniques.ensure(unique, namespace, constraints)
+}
+
+// findConflict looks for the document a write conflicted with, in the databases enforcing the constraints
+func (s *Server) findConflict(namespace string, key string, constraints [][]string, doc interface{}) *UniqueError {
+	index, err := loadUniqueIndex(s.db, namespace, constraints)
+	if err != nil {
+		return nil
+	}
+	return index.conflict(namespace, key, doc)
+}
+
+// duplicates returns the first violation of some constraints by the documents of a namespace
+func (s *Server) duplicates(namespace string, constraints [][]string) (*UniqueError, error) {
+	all, err := s.namespaceDocuments(namespace)
+	if err != nil {
+		return nil, err
+	}
+	index := newUniqueIndex(constraints)
+	for _, key := range sortedKeys(all) {
+		var doc interface{}
+		if json.Unmarshal(all[key], &doc) != nil {
+			continue
+		}
+		if conflict := index.conflict(namespace, key, doc); conflict != nil {
+			return conflict, nil
+		}
+		index.add(key, doc)
+	}
+	return nil, nil
+}
+
+func sortedKeys(values map[string][]byte) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// asUniqueError tells if an error is a violation of a unique constraint
+func asUniqueError(err error) (*UniqueError, bool) {
+	var uniqueErr *UniqueError
+	ok := errors.As(err, &uniqueErr)
+	return uniqueErr, ok
+}
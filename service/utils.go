@@ -9,6 +9,12 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Metadata is stored apart from the document, in the namespace's metadata namespace
+type Metadata struct {
+	User string `json:"user_id"`
+}
+
+// Payload is the optional envelope returned when a client asks for ownership info
 type Payload struct {
 	User string      `json:"user_id"`
 	Data interface{} `json:"data"`
@@ -0,0 +1,573 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/rehacktive/caffeine/database"
+)
+
+const (
+	WebhooksPattern           = "/webhooks"
+	WebhookPattern            = "/webhooks/{id:[a-zA-Z0-9]+}"
+	WebhookDeliveriesPattern  = "/webhooks/{id:[a-zA-Z0-9]+}/deliveries"
+	WebhookDeadLettersPattern = "/webhooks/{id:[a-zA-Z0-9]+}/deadletters"
+	WebhookRetryPattern       = "/webhooks/{id:[a-zA-Z0-9]+}/deadletters/{delivery:[a-zA-Z0-9]+}/_retry"
+	WebhooksNamespace         = "_webhooks"
+	DeadLettersNamespace      = "_deadletters"
+
+	WebhookEventHeader     = "X-Caffeine-Event"
+	WebhookDeliveryHeader  = "X-Caffeine-Delivery"
+	WebhookSignatureHeader = "X-Caffeine-Signature"
+
+	DELIVERY_PENDING   = "pending"
+	DELIVERY_DELIVERED = "delivered"
+	DELIVERY_RETRYING  = "retrying"
+	DELIVERY_FAILED    = "failed"
+
+	webhookQueueSize = 1024
+	// the registrations made through other instances are seen after it
+	webhooksRefresh = time.Minute
+)
+
+// Webhook is a registration: the events of a namespace are POSTed to URL
+type Webhook struct {
+	Id        string `json:"id"`
+	Namespace string `json:"namespace"`
+	// Events filters the events sent, empty is all of them
+	Events []string `json:"events,omitempty"`
+	URL    string   `json:"url"`
+	// Secret signs the deliveries, it's never returned once registered
+	Secret  string    `json:"secret,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Delivery is an event sent, or to be sent, to a webhook
+type Delivery struct {
+	Id           string          `json:"id"`
+	Webhook      string          `json:"webhook"`
+	Event        string          `json:"event"`
+	Status       string          `json:"status"`
+	Attempts     int             `json:"attempts"`
+	ResponseCode int             `json:"response_code,omitempty"`
+	Error        string          `json:"error,omitempty"`
+	Updated      time.Time       `json:"updated"`
+	Payload      json.RawMessage `json:"payload"`
+}
+
+// WebhookDispatcher delivers the events to the registered webhooks, asynchronously.
+// Failed deliveries are retried with exponential backoff, then moved to the dead letters.
+// Pending and retrying deliveries are only kept in memory: they are lost on restart.
+type WebhookDispatcher struct {
+	// Client sends the deliveries. Without AllowPrivate, a Client with its own Transport must
+	// refuse the private addresses itself.
+	Client *http.Client
+	// AllowPrivate allows the webhooks on loopback, link-local and private addresses
+	AllowPrivate bool
+	// MaxAttempts is the number of tries before giving up on a delivery
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Workers        int
+	// LogSize is the number of deliveries kept in the log of every webhook
+	LogSize int
+
+	once  sync.Once
+	db    Database
+	queue chan *Delivery
+
+	mu   sync.Mutex
+	logs map[string][]*Delivery
+
+	webhooksMu sync.Mutex
+	webhooks   []Webhook
+	loaded     time.Time
+}
+
+func (d *WebhookDispatcher) start(db Database) {
+	d.once.Do(func() {
+		if d.Client == nil {
+			d.Client = &http.Client{Timeout: 10 * time.Second}
+		}
+		if !d.AllowPrivate && d.Client.Transport == nil {
+			client := *d.Client
+			client.Transport = publicTransport()
+			d.Client = &client
+		}
+		if d.MaxAttempts <= 0 {
+			d.MaxAttempts = 5
+		}
+		if d.InitialBackoff <= 0 {
+			d.InitialBackoff = time.Second
+		}
+		if d.MaxBackoff <= 0 {
+			d.MaxBackoff = 5 * time.Minute
+		}
+		if d.Workers <= 0 {
+			d.Workers = 4
+		}
+		if d.LogSize <= 0 {
+			d.LogSize = 100
+		}
+		d.db = db
+		d.logs = make(map[string][]*Delivery)
+		d.queue = make(chan *Delivery, webhookQueueSize)
+		for i := 0; i < d.Workers; i++ {
+			go d.worker()
+		}
+	})
+}
+
+// dispatch queues the event for every webhook registered for it
+func (d *WebhookDispatcher) dispatch(db Database, event BrokerEvent) {
+	d.start(db)
+	webhooks, err := d.registrations()
+	if err != nil {
+		log.Printf("error loading webhooks, event %v not delivered: %v\n", event.Event, err)
+		return
+	}
+	var payload []byte
+	for _, webhook := range webhooks {
+		if !webhook.matches(event) {
+			continue
+		}
+		if payload == nil {
+			payload, _ = json.Marshal(event)
+		}
+		d.enqueue(&Delivery{
+			Id:      newId(),
+			Webhook: webhook.Id,
+			Event:   event.Event,
+			Status:  DELIVERY_PENDING,
+			Updated: time.Now().UTC(),
+			Payload: payload,
+		})
+	}
+}
+
+// registrations returns the webhooks, loaded again when invalidated or after webhooksRefresh
+func (d *WebhookDispatcher) registrations() ([]Webhook, error) {
+	d.webhooksMu.Lock()
+	defer d.webhooksMu.Unlock()
+	if !d.loaded.IsZero() && time.Since(d.loaded) < webhooksRefresh {
+		return d.webhooks, nil
+	}
+	webhooks, err := loadWebhooks(d.db)
+	if err != nil {
+		return nil, err
+	}
+	d.webhooks = webhooks
+	d.loaded = time.Now()
+	return webhooks, nil
+}
+
+// invalidate drops the registrations, on every change
+func (d *WebhookDispatcher) invalidate() {
+	d.webhooksMu.Lock()
+	defer d.webhooksMu.Unlock()
+	d.loaded = time.Time{}
+}
+
+func (d *WebhookDispatcher) enqueue(delivery *Delivery) {
+	d.track(delivery)
+	select {
+	case d.queue <- delivery:
+	default:
+		// never block the writes: a full queue is a failed attempt
+		d.update(delivery, func() {
+			delivery.Attempts++
+		})
+		d.failed(delivery, "delivery queue full")
+	}
+}
+
+func (d *WebhookDispatcher) worker() {
+	for delivery := range d.queue {
+		data, dbErr := d.db.Get(WebhooksNamespace, delivery.Webhook)
+		if dbErr != nil {
+			// unregistered meanwhile
+			d.update(delivery, func() {
+				delivery.Status = DELIVERY_FAILED
+				delivery.Error = "webhook not found"
+			})
+			continue
+		}
+		var webhook Webhook
+		err := json.Unmarshal(data, &webhook)
+		if err == nil {
+			err = d.send(&webhook, delivery)
+		}
+		if err != nil {
+			d.failed(delivery, err.Error())
+			continue
+		}
+		d.update(delivery, func() {
+			delivery.Status = DELIVERY_DELIVERED
+			delivery.Error = ""
+		})
+	}
+}
+
+// send POSTs the event, signed with the secret of the webhook
+func (d *WebhookDispatcher) send(webhook *Webhook, delivery *Delivery) error {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, delivery.Event)
+	req.Header.Set(WebhookDeliveryHeader, delivery.Id)
+	if webhook.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, Sign(webhook.Secret, delivery.Payload))
+	}
+
+	resp, err := d.Client.Do(req)
+	d.update(delivery, func() {
+		delivery.Attempts++
+		if resp != nil {
+			delivery.ResponseCode = resp.StatusCode
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
+
+// failed schedules the next attempt or, if none is left, moves the delivery to the dead letters
+func (d *WebhookDispatcher) failed(delivery *Delivery, reason string) {
+	var retry bool
+	var deadLetter []byte
+	d.update(delivery, func() {
+		delivery.Error = reason
+		retry = delivery.Attempts < d.MaxAttempts
+		if retry {
+			delivery.Status = DELIVERY_RETRYING
+		} else {
+			delivery.Status = DELIVERY_FAILED
+			deadLetter, _ = json.Marshal(delivery)
+		}
+	})
+	if retry {
+		time.AfterFunc(d.backoff(delivery.Attempts), func() {
+			d.enqueue(delivery)
+		})
+		return
+	}
+	dbErr := d.db.Upsert(DeadLettersNamespace, delivery.Id, deadLetter)
+	if dbErr != nil {
+		log.Printf("error saving dead letter %v: %v\n", delivery.Id, dbErr)
+	}
+}
+
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	backoff := d.InitialBackoff
+	for i := 1; i < attempts && backoff < d.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > d.MaxBackoff {
+		return d.MaxBackoff
+	}
+	return backoff
+}
+
+// track adds a delivery to the log of its webhook, dropping the oldest ones
+func (d *WebhookDispatcher) track(delivery *Delivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	deliveries := d.logs[delivery.Webhook]
+	for _, tracked := range deliveries {
+		if tracked == delivery {
+			return
+		}
+	}
+	deliveries = append(deliveries, delivery)
+	if len(deliveries) > d.LogSize {
+		deliveries = deliveries[len(deliveries)-d.LogSize:]
+	}
+	d.logs[delivery.Webhook] = deliveries
+}
+
+// update changes a delivery under the lock, as the log can be read meanwhile
+func (d *WebhookDispatcher) update(delivery *Delivery, fn func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fn()
+	delivery.Updated = time.Now().UTC()
+}
+
+// deliveries returns a copy of the log of a webhook, the most recent first
+func (d *WebhookDispatcher) deliveries(webhook string) []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ret := make([]Delivery, 0, len(d.logs[webhook]))
+	for i := len(d.logs[webhook]) - 1; i >= 0; i-- {
+		ret = append(ret, *d.logs[webhook][i])
+	}
+	return ret
+}
+
+// Sign returns the signature of a delivery, the hex HMAC-SHA256 of the body with the secret of the webhook
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *Webhook) matches(event BrokerEvent) bool {
+	if w.Namespace != event.Namespace {
+		return false
+	}
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event.Event {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Webhook) validate(allowPrivate bool) error {
+	if !identifierRegexp.MatchString(w.Namespace) {
+		return fmt.Errorf("invalid namespace '%v'", w.Namespace)
+	}
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url '%v'", w.URL)
+	}
+	// hostnames are checked when connecting, see publicTransport
+	if !allowPrivate && (u.Hostname() == "localhost" || privateIP(net.ParseIP(u.Hostname()))) {
+		return fmt.Errorf("url '%v' is a private address", w.URL)
+	}
+	for _, event := range w.Events {
+		switch event {
+		case EVENT_ITEM_ADDED, EVENT_ITEM_DELETED, EVENT_NAMESPACE_DELETED, EVENT_SCHEMA_UPDATED, EVENT_SCHEMA_DELETED, EVENT_TRANSFORM_UPDATED, EVENT_TRANSFORM_DELETED, EVENT_HOOKS_UPDATED, EVENT_HOOKS_DELETED:
+		default:
+			return fmt.Errorf("unknown event '%v'", event)
+		}
+	}
+	return nil
+}
+
+// publicTransport refuses to connect to the private addresses, whatever the hostname resolves to
+func publicTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if privateIP(net.ParseIP(host)) {
+				return fmt.Errorf("webhook on private address %v refused", address)
+			}
+			return nil
+		},
+	}
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// privateIP tells the loopback, link-local, private and unspecified addresses
+func privateIP(ip net.IP) bool {
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified())
+}
+
+func loadWebhooks(db Database) ([]Webhook, error) {
+	all, dbErr := db.GetAll(WebhooksNamespace)
+	if dbErr != nil {
+		if dbErr.ErrorCode == database.NAMESPACE_NOT_FOUND {
+			return nil, nil
+		}
+		return nil, dbErr
+	}
+	webhooks := make([]Webhook, 0, len(all))
+	for key, value := range all {
+		var webhook Webhook
+		err := json.Unmarshal(value, &webhook)
+		if err != nil {
+			log.Printf("skipping invalid webhook %v: %v\n", key, err)
+			continue
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].Created.Before(webhooks[j].Created)
+	})
+	return webhooks, nil
+}
+
+func newId() string {
+	// keys can only be alphanumeric
+	return strings.ReplaceAll(uuid.NewString(), "-", "")
+}
+
+func (s *Server) webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Webhooks == nil {
+		respondWithError(w, http.StatusNotFound, "webhooks are disabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		defer r.Body.Close()
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		var webhook Webhook
+		err := json.NewDecoder(r.Body).Decode(&webhook)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		err = webhook.validate(s.Webhooks.AllowPrivate)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		webhook.Id = newId()
+		webhook.Created = time.Now().UTC()
+		data, _ := json.Marshal(webhook)
+		dbErr := s.db.Upsert(WebhooksNamespace, webhook.Id, data)
+		s.Webhooks.invalidate()
+		if dbErr != nil {
+			respondWithError(w, http.StatusInternalServerError, dbErr.Error())
+			return
+		}
+		webhook.Secret = ""
+		data, _ = json.Marshal(webhook)
+		respondWithJSON(w, http.StatusCreated, string(data))
+	case http.MethodGet:
+		webhooks, err := loadWebhooks(s.db)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		ret := make([]Webhook, 0, len(webhooks))
+		for _, webhook := range webhooks {
+			webhook.Secret = ""
+			ret = append(ret, webhook)
+		}
+		data, _ := json.Marshal(ret)
+		respondWithJSON(w, http.StatusOK, string(data))
+	}
+}
+
+func (s *Server) webhookHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Webhooks == nil {
+		respondWithError(w, http.StatusNotFound, "webhooks are disabled")
+		return
+	}
+	id := mux.Vars(r)["id"]
+	switch r.Method {
+	case http.MethodGet:
+		data, dbErr := s.db.Get(WebhooksNamespace, id)
+		if dbErr != nil {
+			respondWithError(w, http.StatusNotFound, fmt.Sprintf("webhook '%v' not found", id))
+			return
+		}
+		var webhook Webhook
+		err := json.Unmarshal(data, &webhook)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		webhook.Secret = ""
+		data, _ = json.Marshal(webhook)
+		respondWithJSON(w, http.StatusOK, string(data))
+	case http.MethodDelete:
+		dbErr := s.db.Delete(WebhooksNamespace, id)
+		s.Webhooks.invalidate()
+		if dbErr != nil {
+			respondWithError(w, http.StatusNotFound, fmt.Sprintf("webhook '%v' not found", id))
+			return
+		}
+		respondWithJSON(w, http.StatusAccepted, "{}")
+	}
+}
+
+// webhookDeliveriesHandler returns the recent deliveries of a webhook, kept in memory by this instance
+func (s *Server) webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Webhooks == nil {
+		respondWithError(w, http.StatusNotFound, "webhooks are disabled")
+		return
+	}
+	data, _ := json.Marshal(s.Webhooks.deliveries(mux.Vars(r)["id"]))
+	respondWithJSON(w, http.StatusOK, string(data))
+}
+
+// webhookDeadLettersHandler returns the deliveries of a webhook that failed all their attempts
+func (s *Server) webhookDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Webhooks == nil {
+		respondWithError(w, http.StatusNotFound, "webhooks are disabled")
+		return
+	}
+	id := mux.Vars(r)["id"]
+	all, dbErr := s.db.GetAll(DeadLettersNamespace)
+	if dbErr != nil && dbErr.ErrorCode != database.NAMESPACE_NOT_FOUND {
+		respondWithError(w, http.StatusInternalServerError, dbErr.Error())
+		return
+	}
+	ret := make([]Delivery, 0)
+	for _, value := range all {
+		var delivery Delivery
+		if json.Unmarshal(value, &delivery) == nil && delivery.Webhook == id {
+			ret = append(ret, delivery)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Updated.After(ret[j].Updated)
+	})
+	data, _ := json.Marshal(ret)
+	respondWithJSON(w, http.StatusOK, string(data))
+}
+
+// webhookRetryHandler moves a dead letter back to the delivery queue, for MaxAttempts new attempts
+func (s *Server) webhookRetryHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Webhooks == nil {
+		respondWithError(w, http.StatusNotFound, "webhooks are disabled")
+		return
+	}
+	vars := mux.Vars(r)
+	data, dbErr := s.db.Get(DeadLettersNamespace, vars["delivery"])
+	var delivery Delivery
+	if dbErr != nil || json.Unmarshal(data, &delivery) != nil || delivery.Webhook != vars["id"] {
+		respondWithError(w, http.StatusNotFound, fmt.Sprintf("dead letter '%v' not found", vars["delivery"]))
+		return
+	}
+	dbErr = s.db.Delete(DeadLettersNamespace, delivery.Id)
+	if dbErr != nil {
+		respondWithError(w, http.StatusInternalServerError, dbErr.Error())
+		return
+	}
+	delivery.Attempts = 0
+	delivery.Status = DELIVERY_PENDING
+	delivery.Error = ""
+	s.Webhooks.start(s.db)
+	s.Webhooks.enqueue(&delivery)
+	respondWithJSON(w, http.StatusAccepted, "{}")
+}